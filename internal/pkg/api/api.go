@@ -0,0 +1,149 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/storage"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errorResponse describes the API error body
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// filter describes the optional package filters from the query
+type filter struct {
+	platform *gapps.Platform
+	android  *gapps.Android
+	variant  *gapps.Variant
+	latest   bool
+}
+
+func (f filter) match(p *storage.Package) bool {
+	return (f.platform == nil || *f.platform == p.Platform) &&
+		(f.android == nil || *f.android == p.Android) &&
+		(f.variant == nil || *f.variant == p.Variant)
+}
+
+// PackagesHandler returns the handler which lists the packages from all the loaded releases as JSON,
+// optionally filtered by the platform, android and variant query params.
+// If latest is true, only the current release packages are listed.
+func PackagesHandler(gs *storage.GlobalStorage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+			return
+		}
+
+		f, err := parseFilter(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		dates := gs.Dates()
+		if f.latest {
+			current, ok := gs.Get(storage.CurrentStorageKey)
+			if !ok {
+				writeError(w, http.StatusNotFound, "no current release")
+				return
+			}
+			dates = []string{current.Date}
+		}
+
+		packages := make([]*storage.Package, 0)
+		for _, date := range dates {
+			s, ok := gs.Get(date)
+			if !ok {
+				continue
+			}
+			for _, p := range s.List() {
+				if f.match(p) {
+					packages = append(packages, p)
+				}
+			}
+		}
+		if len(packages) == 0 {
+			writeError(w, http.StatusNotFound, "no packages match the filters")
+			return
+		}
+
+		// newest releases first, then by platform, Android version and variant
+		sort.Slice(packages, func(i, j int) bool {
+			pi, pj := packages[i], packages[j]
+			switch {
+			case pi.Date != pj.Date:
+				return pi.Date > pj.Date
+			case pi.Platform != pj.Platform:
+				return pi.Platform < pj.Platform
+			case pi.Android != pj.Android:
+				return pi.Android.Less(pj.Android)
+			default:
+				return pi.Variant < pj.Variant
+			}
+		})
+		writeJSON(w, http.StatusOK, packages)
+	})
+}
+
+// parseFilter parses the package filters from the query params, each of them is optional
+func parseFilter(r *http.Request) (f filter, err error) {
+	query := r.URL.Query()
+	if v := query.Get("platform"); v != "" {
+		platform, err := gapps.PlatformString(strings.ToLower(v))
+		if err != nil {
+			return f, fmt.Errorf("invalid platform: %s", v)
+		}
+		f.platform = &platform
+	}
+	if v := query.Get("android"); v != "" {
+		android, err := parseAndroid(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid android: %s", v)
+		}
+		f.android = &android
+	}
+	if v := query.Get("variant"); v != "" {
+		variant, err := gapps.VariantString(strings.ToLower(v))
+		if err != nil {
+			return f, fmt.Errorf("invalid variant: %s", v)
+		}
+		f.variant = &variant
+	}
+	if v := query.Get("latest"); v != "" {
+		if f.latest, err = strconv.ParseBool(v); err != nil {
+			return f, fmt.Errorf("invalid latest: %s", v)
+		}
+	}
+	return f, nil
+}
+
+// parseAndroid parses the Android version like "9.0", "90" or just "9"
+func parseAndroid(v string) (gapps.Android, error) {
+	v = strings.Replace(v, ".", "", -1)
+	android, err := gapps.AndroidString(v)
+	if err != nil && len(v) == 1 {
+		return gapps.AndroidString(v + "0")
+	}
+	return android, err
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Unable to write the API response: %v", err)
+	}
+}
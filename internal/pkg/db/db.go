@@ -1,6 +1,8 @@
 package db
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
@@ -16,7 +18,8 @@ var (
 	ErrNotFound = errors.New("key not found")
 	ErrNilValue = errors.New("value is nil")
 
-	bucketName = []byte("global")
+	bucketName         = []byte("global")
+	countersBucketName = []byte("counters")
 )
 
 // DB describes local BoltDB database
@@ -38,10 +41,13 @@ func NewDB(path string, timeout time.Duration) (*DB, error) {
 		return nil, fmt.Errorf("unable to open DB: %w", err)
 	}
 
-	// create global bucket if it doesn't exist yet
+	// create global and counters buckets if they don't exist yet
 	log.WithField("bucket", string(bucketName)).Debug("Setting the default bucket")
 	err = b.Update(func(tx *bbolt.Tx) error {
-		_, bErr := tx.CreateBucketIfNotExists(bucketName)
+		if _, bErr := tx.CreateBucketIfNotExists(bucketName); bErr != nil {
+			return bErr
+		}
+		_, bErr := tx.CreateBucketIfNotExists(countersBucketName)
 		return bErr
 	})
 	if err != nil {
@@ -171,3 +177,162 @@ func (db *DB) Purge() error {
 	}
 	return nil
 }
+
+// AddCounters adds the deltas to the counters by key in one transaction.
+// Counters are kept apart from the global bucket, so they're not affected by its purge.
+func (db *DB) AddCounters(deltas map[string]uint64) error {
+	log.WithField("count", len(deltas)).Debug("Updating the counters in DB")
+	err := db.b.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(countersBucketName)
+		if b == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		for key, delta := range deltas {
+			var value uint64
+			if v := b.Get([]byte(key)); len(v) == 8 {
+				value = binary.BigEndian.Uint64(v)
+			}
+			buf := make([]byte, 8)
+			binary.BigEndian.PutUint64(buf, value+delta)
+			if err := b.Put([]byte(key), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update counters in DB: %w", err)
+	}
+	return nil
+}
+
+// Counters returns all the counters by key
+func (db *DB) Counters() (map[string]uint64, error) {
+	counters := make(map[string]uint64)
+	err := db.b.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(countersBucketName)
+		if b == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if len(v) == 8 {
+				counters[string(k)] = binary.BigEndian.Uint64(v)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get counters from DB: %w", err)
+	}
+	return counters, nil
+}
+
+// CreateBucket creates the bucket if it doesn't exist yet
+func (db *DB) CreateBucket(bucket string) error {
+	log.WithField("bucket", bucket).Debug("Creating the bucket")
+	err := db.b.Update(func(tx *bbolt.Tx) error {
+		_, bErr := tx.CreateBucketIfNotExists([]byte(bucket))
+		return bErr
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create bucket '%s': %w", bucket, err)
+	}
+	return nil
+}
+
+// BucketGet acquires value from the bucket by provided key
+func (db *DB) BucketGet(bucket, key string) ([]byte, error) {
+	var value []byte
+	err := db.b.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		value = make([]byte, len(v))
+		copy(value, v)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get value for key '%s' from bucket '%s': %w", key, bucket, err)
+	}
+	return value, nil
+}
+
+// BucketPut sets/updates the values in the bucket by their keys in one transaction
+func (db *DB) BucketPut(bucket string, values map[string][]byte) error {
+	log.WithField("bucket", bucket).WithField("count", len(values)).Debug("Saving the values to DB")
+	err := db.b.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		for key, val := range values {
+			if err := b.Put([]byte(key), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to put values to bucket '%s': %w", bucket, err)
+	}
+	return nil
+}
+
+// BucketDelete removes the values from the bucket by their keys in one transaction
+func (db *DB) BucketDelete(bucket string, keys ...string) error {
+	log.WithField("bucket", bucket).WithField("count", len(keys)).Debug("Deleting the values from DB")
+	err := db.b.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		for _, key := range keys {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete values from bucket '%s': %w", bucket, err)
+	}
+	return nil
+}
+
+// BucketScan calls fn for each value in the bucket with the key prefix, in the key order.
+// The value is valid only until fn returns.
+func (db *DB) BucketScan(bucket, prefix string, fn func(key string, value []byte) error) error {
+	err := db.b.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if v == nil {
+				continue
+			}
+			if err := fn(string(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to scan bucket '%s': %w", bucket, err)
+	}
+	return nil
+}
+
+// Sync flushes the DB file to the disk
+func (db *DB) Sync() error {
+	if err := db.b.Sync(); err != nil {
+		return fmt.Errorf("unable to sync DB: %w", err)
+	}
+	return nil
+}
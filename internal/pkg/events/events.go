@@ -0,0 +1,94 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Type describes the type of the event
+type Type string
+
+// Event types
+const (
+	ScanStarted    Type = "scan_started"
+	ScanFinished   Type = "scan_finished"
+	MirrorCreated  Type = "mirror_created"
+	MirrorFailed   Type = "mirror_failed"
+	PackageMoved   Type = "package_moved"
+	StorageEvicted Type = "storage_evicted"
+	StoragePurged  Type = "storage_purged"
+)
+
+// Fields describes the event payload
+type Fields map[string]interface{}
+
+// Event describes a single event in the stream
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   Type      `json:"type"`
+	Fields Fields    `json:"fields,omitempty"`
+}
+
+var (
+	out io.Writer
+	mtx sync.Mutex
+)
+
+// SetOutput sets the event stream output, nil disables it
+func SetOutput(w io.Writer) {
+	mtx.Lock()
+	out = w
+	mtx.Unlock()
+}
+
+// OpenFile opens the file for appending and sets it as the event stream output.
+// The file is closed by Close.
+func OpenFile(path string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open events file: %w", err)
+	}
+	SetOutput(file)
+	return nil
+}
+
+// Close disables the event stream and closes its output, if it's closable,
+// so that all the emitted events are flushed
+func Close() error {
+	mtx.Lock()
+	defer mtx.Unlock()
+	c, ok := out.(io.Closer)
+	out = nil
+	if !ok {
+		return nil
+	}
+	if err := c.Close(); err != nil {
+		return fmt.Errorf("unable to close event stream: %w", err)
+	}
+	return nil
+}
+
+// Emit writes the event into the stream as a JSON line
+func Emit(t Type, fields Fields) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if out == nil {
+		return
+	}
+
+	body, err := json.Marshal(Event{Time: time.Now().UTC(), Type: t, Fields: fields})
+	if err != nil {
+		log.Errorf("Unable to marshal event %s: %v", t, err)
+		return
+	}
+
+	if _, err = out.Write(append(body, '\n')); err != nil {
+		log.Errorf("Unable to write event %s: %v", t, err)
+	}
+}
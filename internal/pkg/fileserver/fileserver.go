@@ -0,0 +1,77 @@
+package fileserver
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/storage"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Handler returns the handler which serves the package files from the local storage root,
+// with the URL path prefix stripped. Only the files with the extensions under the platform folders
+// are served: directory listing, hidden and any other files are reported as not found.
+// The quoted package MD5 from gs is set as the file ETag, so that the clients which already have
+// the file get 304 Not Modified for the If-None-Match request.
+func Handler(root, prefix string, extensions []string, gs *storage.GlobalStorage) http.Handler {
+	return http.StripPrefix(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := path.Clean("/" + r.URL.Path)
+		if !allowed(name, extensions) {
+			http.NotFound(w, r)
+			return
+		}
+
+		file, err := os.Open(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			http.NotFound(w, r)
+			return
+		}
+
+		if md5sum := gs.LocalChecksum(strings.TrimPrefix(name, "/")); md5sum != "" {
+			w.Header().Set("ETag", `"`+md5sum+`"`)
+		}
+		log.WithField("path", name).WithField("remote", r.RemoteAddr).Debug("Serving the package file")
+		http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+	}))
+}
+
+// allowed checks that the cleaned path is the <platform>/<date>/<file> one,
+// and that the file is not hidden and has one of the extensions
+func allowed(name string, extensions []string) bool {
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	if len(parts) != 3 {
+		return false
+	}
+	if _, err := gapps.PlatformString(parts[0]); err != nil {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" || strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	for _, ext := range extensions {
+		if strings.HasSuffix(parts[2], "."+ext) {
+			return true
+		}
+	}
+	return false
+}
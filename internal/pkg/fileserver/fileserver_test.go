@@ -0,0 +1,79 @@
+package fileserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/storage"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+)
+
+const (
+	testName = "open_gapps-arm64-10.0-nano-20200101.zip"
+	testMD5  = "0123456789abcdef0123456789abcdef"
+)
+
+func TestHandlerETag(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		md5sum      string
+		ifNoneMatch string
+		wantStatus  int
+		wantETag    string
+	}{
+		{name: "etag set", path: "/files/arm64/20200101/" + testName, md5sum: testMD5,
+			wantStatus: http.StatusOK, wantETag: `"` + testMD5 + `"`},
+		{name: "not modified", path: "/files/arm64/20200101/" + testName, md5sum: testMD5, ifNoneMatch: `"` + testMD5 + `"`,
+			wantStatus: http.StatusNotModified, wantETag: `"` + testMD5 + `"`},
+		{name: "other etag", path: "/files/arm64/20200101/" + testName, md5sum: testMD5, ifNoneMatch: `"ffffffffffffffffffffffffffffffff"`,
+			wantStatus: http.StatusOK, wantETag: `"` + testMD5 + `"`},
+		{name: "unknown checksum", path: "/files/arm64/20200101/" + testName, ifNoneMatch: `"` + testMD5 + `"`,
+			wantStatus: http.StatusOK},
+		{name: "not allowed", path: "/files/arm64/" + testName, md5sum: testMD5, wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "fileserver")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			dir := filepath.Join(root, "arm64", "20200101")
+			if err = os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(filepath.Join(dir, testName), []byte("gapps"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			gs := storage.NewGlobalStorage(nil)
+			s := &storage.Storage{Date: "20200101"}
+			s.Add(&storage.Package{Name: testName, Date: "20200101", MD5: tt.md5sum,
+				Platform: gapps.PlatformArm64, Android: gapps.Android100, Variant: gapps.VariantNano})
+			gs.Add("20200101", s)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			rec := httptest.NewRecorder()
+			Handler(root+"/", "/files", []string{"zip"}, gs).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("ETag"); got != tt.wantETag {
+				t.Errorf("ETag = %q, want %q", got, tt.wantETag)
+			}
+			if tt.wantStatus == http.StatusOK && rec.Body.String() != "gapps" {
+				t.Errorf("body = %q, want %q", rec.Body.String(), "gapps")
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package flight
+
+import (
+	"context"
+	"sync"
+)
+
+// Group deduplicates the concurrent calls with the same key
+type Group struct {
+	calls   map[string]*call
+	running map[string]int // calls by key, including the abandoned ones which are still finishing
+	mtx     sync.Mutex
+}
+
+type call struct {
+	done   chan struct{}
+	val    interface{}
+	err    error
+	refs   int
+	cancel context.CancelFunc
+}
+
+// Do executes fn once for all the concurrent callers with the same key
+// and returns its result to each of them. Result is not kept after the
+// call is done, so the following calls with the same key execute fn again.
+// shared is true if the result was given to multiple callers.
+func (g *Group) Do(key string, fn func() (interface{}, error)) (val interface{}, shared bool, err error) {
+	return g.DoContext(context.Background(), key, func(context.Context) (interface{}, error) {
+		return fn()
+	})
+}
+
+// DoContext is like Do, but each caller can stop waiting for the result
+// by cancelling its own context. fn receives the context which is cancelled
+// only when all the callers have stopped waiting, so the call goes on
+// as long as anyone still needs its result.
+func (g *Group) DoContext(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (val interface{}, shared bool, err error) {
+	g.mtx.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+		g.running = make(map[string]int)
+	}
+	c, shared := g.calls[key]
+	if shared {
+		c.refs++
+	} else {
+		callCtx, cancel := context.WithCancel(context.Background())
+		c = &call{done: make(chan struct{}), refs: 1, cancel: cancel}
+		g.calls[key] = c
+		g.running[key]++
+		go g.run(callCtx, key, c, fn)
+	}
+	g.mtx.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, shared, c.err
+	case <-ctx.Done():
+		g.leave(key, c)
+		return nil, shared, ctx.Err()
+	}
+}
+
+func (g *Group) run(ctx context.Context, key string, c *call, fn func(ctx context.Context) (interface{}, error)) {
+	defer c.cancel()
+	val, err := fn(ctx)
+
+	g.mtx.Lock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	if g.running[key]--; g.running[key] <= 0 {
+		delete(g.running, key)
+	}
+	c.val, c.err = val, err
+	close(c.done)
+	g.mtx.Unlock()
+}
+
+// Running reports if any call with the key is still executing,
+// even if all of its callers have stopped waiting for it
+func (g *Group) Running(key string) bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.running[key] > 0
+}
+
+// leave drops the caller from the call, which is cancelled when no callers are left
+func (g *Group) leave(key string, c *call) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if c.refs--; c.refs > 0 {
+		return
+	}
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	c.cancel()
+}
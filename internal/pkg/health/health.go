@@ -0,0 +1,100 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/config"
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/storage"
+
+	"github.com/google/go-github/v29/github"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// readyCacheTTL is how long the readiness check result is reused, so that the frequent probes
+	// don't make a Github request each time
+	readyCacheTTL = 30 * time.Second
+	// githubTimeout is the max duration of the Github check
+	githubTimeout = 5 * time.Second
+)
+
+// LiveHandler returns the handler which reports that the process is alive
+func LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, nil)
+	})
+}
+
+// ReadyHandler returns the handler which reports if the bot is ready to mirror the packages:
+// gapps.local_path is writable, if it's set, and the Github API is reachable.
+// The Github rate limit endpoint is used for the check, as it doesn't count against the limit.
+// Failed check is reported with 503 and its reason.
+func ReadyHandler(cfg *viper.Viper, ghClient *github.Client) http.Handler {
+	var (
+		lastErr   error
+		checkedAt time.Time
+		mtx       sync.Mutex
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		if time.Since(checkedAt) >= readyCacheTTL {
+			lastErr, checkedAt = checkReady(r.Context(), cfg, ghClient), time.Now()
+			if lastErr != nil {
+				log.Warnf("Readiness check failed: %v", lastErr)
+			}
+		}
+		err := lastErr
+		mtx.Unlock()
+
+		writeStatus(w, err)
+	})
+}
+
+// FreshnessHandler returns the handler which reports the mirror freshness as JSON:
+// the current and the latest upstream releases, the lag between them and whether the mirror is behind.
+// It responds 503 with the reason if the freshness is unknown yet.
+func FreshnessHandler(cfg *viper.Viper, gs *storage.GlobalStorage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := gs.Freshness(cfg)
+		if err != nil {
+			writeStatus(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(f); err != nil {
+			log.Errorf("Unable to write the freshness response: %v", err)
+		}
+	})
+}
+
+func checkReady(ctx context.Context, cfg *viper.Viper, ghClient *github.Client) error {
+	if localPath := cfg.GetString("gapps.local_path"); localPath != "" {
+		if err := config.CheckWritableDir(localPath); err != nil {
+			return fmt.Errorf("local storage is unavailable: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, githubTimeout)
+	defer cancel()
+	if _, _, err := ghClient.RateLimits(ctx); err != nil {
+		return fmt.Errorf("unable to reach Github: %w", err)
+	}
+	return nil
+}
+
+func writeStatus(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
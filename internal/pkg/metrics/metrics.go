@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "opengapps"
+
+// Download results
+const (
+	ResultOK    = "ok"
+	ResultError = "error"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	downloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloads_total",
+		Help:      "Number of the finished downloads by their kind and result.",
+	}, []string{"kind", "result"})
+	downloadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "download_duration_seconds",
+		Help:      "Duration of the finished downloads by their kind.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12), // 0.5s to ~17m
+	}, []string{"kind"})
+	mirrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mirrors_total",
+		Help:      "Number of the created mirrors.",
+	})
+	mirrorBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mirror_bytes_total",
+		Help:      "Total size of the packages in the created mirrors.",
+	})
+	mirrorFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mirror_failures_total",
+		Help:      "Number of the failed mirror creations by the failure reason.",
+	}, []string{"reason"})
+	releaseMirrorBytesLeft = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "release_mirror_bytes_left",
+		Help:      "Size of the packages left in the release mirroring in progress, 0 if it's unknown.",
+	}, []string{"release"})
+	releaseMirrorPackagesLeft = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "release_mirror_packages_left",
+		Help:      "Number of the packages left in the release mirroring in progress.",
+	}, []string{"release"})
+	releaseMirrorETA = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "release_mirror_eta_seconds",
+		Help:      "Estimated time left for the release mirroring in progress, 0 if it's unknown.",
+	}, []string{"release"})
+)
+
+func init() {
+	registry.MustRegister(downloads, downloadDuration, mirrors, mirrorBytes, mirrorFailures,
+		releaseMirrorBytesLeft, releaseMirrorPackagesLeft, releaseMirrorETA)
+}
+
+// ObserveDownload records the finished download of the kind, like "single" or "multi"
+func ObserveDownload(kind string, duration time.Duration, err error) {
+	result := ResultOK
+	if err != nil {
+		result = ResultError
+	}
+	downloads.WithLabelValues(kind, result).Inc()
+	downloadDuration.WithLabelValues(kind).Observe(duration.Seconds())
+}
+
+// MirrorCreated records the created mirror of the package with the size
+func MirrorCreated(size int) {
+	mirrors.Inc()
+	mirrorBytes.Add(float64(size))
+}
+
+// MirrorFailed records the failed mirror creation with the reason
+func MirrorFailed(reason string) {
+	mirrorFailures.WithLabelValues(reason).Inc()
+}
+
+// ReleaseMirrorProgress records the progress of the release mirroring
+func ReleaseMirrorProgress(release string, bytesLeft int64, packagesLeft int, eta time.Duration) {
+	releaseMirrorBytesLeft.WithLabelValues(release).Set(float64(bytesLeft))
+	releaseMirrorPackagesLeft.WithLabelValues(release).Set(float64(packagesLeft))
+	releaseMirrorETA.WithLabelValues(release).Set(eta.Seconds())
+}
+
+// ReleaseMirrorDone removes the progress of the finished release mirroring
+func ReleaseMirrorDone(release string) {
+	releaseMirrorBytesLeft.DeleteLabelValues(release)
+	releaseMirrorPackagesLeft.DeleteLabelValues(release)
+	releaseMirrorETA.DeleteLabelValues(release)
+}
+
+// RegisterQueue exposes the download queue depth, reported by fn
+func RegisterQueue(fn func() (active, waiting int)) {
+	registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "downloads_active",
+			Help:      "Number of the active downloads.",
+		}, func() float64 {
+			active, _ := fn()
+			return float64(active)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "downloads_waiting",
+			Help:      "Number of the downloads waiting for a free slot.",
+		}, func() float64 {
+			_, waiting := fn()
+			return float64(waiting)
+		}),
+	)
+}
+
+// RegisterFreshness exposes the lag of the mirror behind the upstream release, reported by fn.
+// The lag is 0 if fn fails, e.g. when the upstream release is not checked yet.
+func RegisterFreshness(fn func() (time.Duration, error)) {
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "freshness_lag_seconds",
+		Help:      "Lag between the mirrored and the latest upstream release dates.",
+	}, func() float64 {
+		lag, err := fn()
+		if err != nil {
+			return 0
+		}
+		return lag.Seconds()
+	}))
+}
+
+// Handler returns the HTTP handler which exposes the metrics for Prometheus
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
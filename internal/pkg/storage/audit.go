@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultAuditWorkers = 4
+	hashBufferSize      = 1 << 20
+)
+
+// AuditReport describes the difference between the local storage files and the cache
+type AuditReport struct {
+	// Orphans are the files in local storage without the cached package
+	Orphans []string
+	// Dangling are the cached mirrored packages without the local file
+	Dangling []*Package
+	// Mismatches are the cached mirrored packages with the local file checksum mismatch
+	Mismatches []*Package
+}
+
+// Audit compares the files in local storage with the mirrored packages in the GlobalStorage
+func (gs *GlobalStorage) Audit(cfg *viper.Viper) (AuditReport, error) {
+	var report AuditReport
+	root := cfg.GetString("gapps.local_path")
+	if root == "" {
+		return report, errors.New("local storage is not configured")
+	}
+
+	// collect the expected files from the storages
+	expected := make(map[string]*Package)
+	gs.mtx.RLock()
+	for _, s := range gs.storages {
+		for _, p := range s.List() {
+			if localURL, _ := p.mirrorURLs(); localURL != "" {
+				expected[filepath.Clean(p.localPath(root))] = p
+			}
+		}
+	}
+	gs.mtx.RUnlock()
+
+	// walk the local storage and look for the orphans
+	found := make(map[string]*Package)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || isLockFile(info.Name()) {
+			return nil
+		}
+		if p, ok := expected[filepath.Clean(path)]; ok {
+			found[filepath.Clean(path)] = p
+		} else {
+			report.Orphans = append(report.Orphans, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("unable to walk local storage: %w", err)
+	}
+
+	for path, p := range expected {
+		if _, ok := found[path]; !ok {
+			report.Dangling = append(report.Dangling, p)
+		}
+	}
+
+	// verify the checksums of the found files
+	var mtx sync.Mutex
+	verifyFiles(found, cfg.GetInt("gapps.audit_workers"), func(path string, p *Package, sum string, err error) {
+		if err != nil {
+			log.Errorf("Unable to verify file %s: %v", path, err)
+			return
+		}
+		if md5sum, _ := p.checksum(); sum != md5sum {
+			mtx.Lock()
+			report.Mismatches = append(report.Mismatches, p)
+			mtx.Unlock()
+		}
+	})
+
+	return report, nil
+}
+
+// VerifyAll verifies the checksums of all the local mirrors in the GlobalStorage
+// with the limited number of workers and returns the mismatched packages.
+// Optional progress func is called after each verified file.
+func (gs *GlobalStorage) VerifyAll(cfg *viper.Viper, workers int, progress ProgressFunc) ([]*Package, error) {
+	root := cfg.GetString("gapps.local_path")
+	if root == "" {
+		return nil, errors.New("local storage is not configured")
+	}
+
+	files := make(map[string]*Package)
+	gs.mtx.RLock()
+	for _, s := range gs.storages {
+		for _, p := range s.List() {
+			if localURL, _ := p.mirrorURLs(); localURL != "" {
+				files[filepath.Clean(p.localPath(root))] = p
+			}
+		}
+	}
+	gs.mtx.RUnlock()
+
+	var (
+		mismatches []*Package
+		done       int
+		mtx        sync.Mutex
+	)
+	verifyFiles(files, workers, func(path string, p *Package, sum string, err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		done++
+		if progress != nil {
+			progress(done, len(files), path)
+		}
+		if err != nil {
+			log.Errorf("Unable to verify file %s: %v", path, err)
+			return
+		}
+		if md5sum, _ := p.checksum(); sum != md5sum {
+			mismatches = append(mismatches, p)
+		}
+	})
+
+	return mismatches, nil
+}
+
+// ProgressFunc is called with the number of processed items, their total number and the current one
+type ProgressFunc func(done, total int, current string)
+
+// verifyFiles hashes the files with the limited number of workers
+// and calls the result func for each of them
+func verifyFiles(files map[string]*Package, workers int, result func(path string, p *Package, sum string, err error)) {
+	if workers <= 0 {
+		workers = defaultAuditWorkers
+	}
+
+	paths := make(chan string)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, hashBufferSize)
+			for path := range paths {
+				sum, err := hashFileBuffer(path, buf)
+				result(path, files[path], sum, err)
+			}
+		}()
+	}
+
+	for path := range files {
+		paths <- path
+	}
+	close(paths)
+	wg.Wait()
+}
+
+// hashFile calculates the MD5 checksum of the file without reading it into memory
+func hashFile(path string) (string, error) {
+	return hashFileBuffer(path, make([]byte, hashBufferSize))
+}
+
+func hashFileBuffer(path string, buf []byte) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to open the file: %w", err)
+	}
+	defer file.Close()
+
+	h := md5.New()
+	if _, err = io.CopyBuffer(h, file, buf); err != nil {
+		return "", fmt.Errorf("unable to read the file: %w", err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
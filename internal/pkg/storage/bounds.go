@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// ErrSizeAnomaly is returned when the package size is outside of the gapps.size_bounds for its variant
+var ErrSizeAnomaly = errors.New("package size is outside of the expected bounds")
+
+// checkSizeBounds checks that the package size is within the [min, max] MiB bounds
+// of its variant from gapps.size_bounds. Variants without the bounds are not checked.
+func checkSizeBounds(cfg *viper.Viper, p *Package) error {
+	bounds := cfg.GetIntSlice("gapps.size_bounds." + p.Variant.String())
+	if len(bounds) != 2 {
+		return nil
+	}
+
+	min, max := int64(bounds[0])<<20, int64(bounds[1])<<20
+	if size := int64(p.Size); size < min || size > max {
+		return fmt.Errorf("%w: %s is %s, want %d-%d MiB for %s", ErrSizeAnomaly, p.Name, p.HumanSize(), bounds[0], bounds[1], p.Variant)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package storage
+
+import "sync"
+
+// knownChecksums caches the package MD5 checksums by their MD5 file URLs.
+// Released files never change, so the MD5 file is not downloaded again
+// on rescan if its URL is the same. The cache is filled from the storages,
+// so the checksums persisted with the packages are reused after restart.
+var knownChecksums checksumCache
+
+type checksumCache struct {
+	sums map[string]string
+	mtx  sync.RWMutex
+}
+
+// get returns the cached checksum for the MD5 file URL
+func (c *checksumCache) get(url string) (string, bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	sum, ok := c.sums[url]
+	return sum, ok
+}
+
+// add caches the package checksum, if it's known
+func (c *checksumCache) add(p *Package) {
+	md5sum, _ := p.checksum()
+	if p.MD5URL == "" || md5sum == "" {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.sums == nil {
+		c.sums = make(map[string]string)
+	}
+	c.sums[p.MD5URL] = md5sum
+}
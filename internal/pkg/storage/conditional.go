@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/google/go-github/v29/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// githubResponses keeps the last Github API responses with their validators by request URL,
+// so that the repeated requests are conditional and don't count against the rate limit
+var githubResponses = responseCache{responses: make(map[string]cachedResponse)}
+
+// cachedResponse is the Github API response body along with its ETag and Last-Modified headers
+// and the next page of the list
+type cachedResponse struct {
+	etag         string
+	lastModified string
+	nextPage     int
+	body         json.RawMessage
+}
+
+type responseCache struct {
+	responses map[string]cachedResponse
+	mtx       sync.RWMutex
+}
+
+func (c *responseCache) get(url string) (cachedResponse, bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	r, ok := c.responses[url]
+	return r, ok
+}
+
+func (c *responseCache) put(url string, r cachedResponse) {
+	c.mtx.Lock()
+	c.responses[url] = r
+	c.mtx.Unlock()
+}
+
+// getConditional sends the GET request to the Github API URL and decodes its response into v.
+// If the response is cached, the request is conditional, and on 304 Not Modified
+// the cached response is decoded instead, which is reported by the returned bool.
+func getConditional(ctx context.Context, ghClient *github.Client, url string, v interface{}) (*github.Response, bool, error) {
+	req, err := ghClient.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to create request: %w", err)
+	}
+	cached, ok := githubResponses.get(url)
+	if ok {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		} else {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	var body json.RawMessage
+	resp, err := ghClient.Do(ctx, req, &body)
+	if ok && resp != nil && resp.StatusCode == http.StatusNotModified {
+		log.WithField("url", url).Debug("Github response is not modified, using the cached one")
+		resp.NextPage = cached.nextPage
+		return resp, true, json.Unmarshal(cached.body, v)
+	}
+	if err != nil {
+		return resp, false, err
+	}
+
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag != "" || lastModified != "" {
+		githubResponses.put(url, cachedResponse{etag: etag, lastModified: lastModified, nextPage: resp.NextPage, body: body})
+	}
+	return resp, false, json.Unmarshal(body, v)
+}
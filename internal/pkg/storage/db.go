@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/db"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// packagesBucket is the cache DB bucket of the package index
+const packagesBucket = "packages"
+
+// Package DB errors
+var (
+	ErrPackageStale = errors.New("package is stale")
+	ErrDBClosed     = errors.New("package DB is closed")
+)
+
+// DB is the package index persisted in the cache DB, so that the packages
+// of the saved releases are found without the Github requests.
+// Packages are keyed by Platform/Android/Variant/Date.
+type DB struct {
+	cache  *db.DB
+	ttl    time.Duration
+	closed bool
+	mtx    sync.RWMutex
+}
+
+// dbRecord is the package saved to the DB along with the save time
+type dbRecord struct {
+	Package *Package  `json:"package"`
+	SavedAt time.Time `json:"saved_at"`
+}
+
+// stale checks if the package is saved more than ttl ago, zero ttl means it never is
+func (r *dbRecord) stale(ttl time.Duration) bool {
+	return ttl > 0 && time.Since(r.SavedAt) > ttl
+}
+
+// NewDB creates a new instance of DB in the cache DB, creating its bucket if it doesn't exist yet.
+// Packages saved more than ttl ago are stale, zero ttl means they never are.
+func NewDB(cache *db.DB, ttl time.Duration) (*DB, error) {
+	if err := cache.CreateBucket(packagesBucket); err != nil {
+		return nil, fmt.Errorf("unable to open package DB: %w", err)
+	}
+	return &DB{cache: cache, ttl: ttl}, nil
+}
+
+// packageKey returns the DB key of the package
+func packageKey(p gapps.Platform, a gapps.Android, v gapps.Variant, date string) string {
+	return p.String() + "/" + a.String() + "/" + v.String() + "/" + date
+}
+
+// Get returns the package of the release date from the DB.
+// ErrPackageNotFound is returned if it's missing, and ErrPackageStale if it's saved too long ago.
+func (d *DB) Get(p gapps.Platform, a gapps.Android, v gapps.Variant, date string) (*Package, error) {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	if d.closed {
+		return nil, ErrDBClosed
+	}
+
+	key := packageKey(p, a, v, date)
+	body, err := d.cache.BucketGet(packagesBucket, key)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrPackageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var r dbRecord
+	if err = json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal package %s: %w", key, err)
+	}
+	if r.Package == nil {
+		return nil, ErrPackageNotFound
+	}
+	if r.stale(d.ttl) {
+		return nil, fmt.Errorf("%w: %s is saved at %s", ErrPackageStale, key, r.SavedAt.Format(time.RFC3339))
+	}
+	return r.Package, nil
+}
+
+// Put saves the packages to the DB in one transaction
+func (d *DB) Put(packages ...*Package) error {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	if d.closed {
+		return ErrDBClosed
+	}
+
+	now := time.Now()
+	values := make(map[string][]byte, len(packages))
+	for _, p := range packages {
+		body, err := json.Marshal(&dbRecord{Package: p, SavedAt: now})
+		if err != nil {
+			return fmt.Errorf("unable to marshal package %s: %w", p.Name, err)
+		}
+		values[packageKey(p.Platform, p.Android, p.Variant, p.Date)] = body
+	}
+	return d.cache.BucketPut(packagesBucket, values)
+}
+
+// Delete removes the packages from the DB in one transaction
+func (d *DB) Delete(packages ...*Package) error {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	if d.closed {
+		return ErrDBClosed
+	}
+
+	keys := make([]string, 0, len(packages))
+	for _, p := range packages {
+		keys = append(keys, packageKey(p.Platform, p.Android, p.Variant, p.Date))
+	}
+	return d.cache.BucketDelete(packagesBucket, keys...)
+}
+
+// List returns all the packages from the DB in the key order, including the stale ones
+func (d *DB) List() ([]*Package, error) {
+	records, err := d.records()
+	if err != nil {
+		return nil, err
+	}
+
+	packages := make([]*Package, 0, len(records))
+	for _, r := range records {
+		packages = append(packages, r.Package)
+	}
+	return packages, nil
+}
+
+// records returns all the package records from the DB in the key order
+func (d *DB) records() ([]*dbRecord, error) {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	if d.closed {
+		return nil, ErrDBClosed
+	}
+
+	var records []*dbRecord
+	err := d.cache.BucketScan(packagesBucket, "", func(key string, body []byte) error {
+		r := &dbRecord{}
+		if err := json.Unmarshal(body, r); err != nil || r.Package == nil {
+			log.WithField("key", key).Warnf("Unable to unmarshal package from DB: %v", err)
+			return nil
+		}
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Close waits for the DB writes in progress and flushes the DB to the disk.
+// The cache DB itself is left open, and the DB can't be used after it's closed.
+func (d *DB) Close() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.closed {
+		return nil
+	}
+
+	d.closed = true
+	log.Debug("Closing the package DB")
+	return d.cache.Sync()
+}
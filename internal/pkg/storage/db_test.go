@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+)
+
+// testPackage returns the package of the release date
+func testPackage(p gapps.Platform, a gapps.Android, v gapps.Variant, date string) *Package {
+	return &Package{
+		Name:     "open_gapps-" + p.String() + "-" + a.HumanString() + "-" + v.String() + "-" + date + ".zip",
+		Date:     date,
+		Platform: p,
+		Android:  a,
+		Variant:  v,
+	}
+}
+
+// putRecord saves the package to the DB as if it was saved at the time
+func putRecord(t *testing.T, d *DB, p *Package, savedAt time.Time) {
+	t.Helper()
+	body, err := json.Marshal(&dbRecord{Package: p, SavedAt: savedAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := packageKey(p.Platform, p.Android, p.Variant, p.Date)
+	if err = d.cache.BucketPut(packagesBucket, map[string][]byte{key: body}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDBGet(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		age     time.Duration
+		date    string
+		wantErr error
+	}{
+		{name: "found", ttl: time.Hour, age: time.Minute, date: "20200101"},
+		{name: "zero ttl never stale", ttl: 0, age: 1000 * time.Hour, date: "20200101"},
+		{name: "stale", ttl: time.Hour, age: 2 * time.Hour, date: "20200101", wantErr: ErrPackageStale},
+		{name: "other date", ttl: time.Hour, age: time.Minute, date: "20200102", wantErr: ErrPackageNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, cleanup := newTestDB(t)
+			defer cleanup()
+			d, err := NewDB(cache, tt.ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := testPackage(gapps.PlatformArm64, gapps.Android100, gapps.VariantNano, "20200101")
+			putRecord(t, d, p, time.Now().Add(-tt.age))
+
+			got, err := d.Get(gapps.PlatformArm64, gapps.Android100, gapps.VariantNano, tt.date)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Get() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && got.Name != p.Name {
+				t.Errorf("Get() = %s, want %s", got.Name, p.Name)
+			}
+		})
+	}
+}
+
+func TestDBPutListDelete(t *testing.T) {
+	cache, cleanup := newTestDB(t)
+	defer cleanup()
+	d, err := NewDB(cache, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packages := []*Package{
+		testPackage(gapps.PlatformArm64, gapps.Android100, gapps.VariantNano, "20200102"),
+		testPackage(gapps.PlatformArm, gapps.Android90, gapps.VariantPico, "20200101"),
+		testPackage(gapps.PlatformArm64, gapps.Android100, gapps.VariantNano, "20200101"),
+	}
+	packages[0].SetTag(PinnedTag, "true")
+	if err = d.Put(packages...); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.Get(gapps.PlatformArm64, gapps.Android100, gapps.VariantNano, "20200102")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := got.Tag(PinnedTag); v != "true" {
+		t.Errorf("Get() pinned tag = %q, want %q", v, "true")
+	}
+
+	list, err := d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != len(packages) {
+		t.Fatalf("List() returned %d packages, want %d", len(list), len(packages))
+	}
+
+	if err = d.Delete(packages[0], packages[1]); err != nil {
+		t.Fatal(err)
+	}
+	list, err = d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != packages[2].Name {
+		t.Errorf("List() after Delete() = %v, want only %s", list, packages[2].Name)
+	}
+	if _, err = d.Get(gapps.PlatformArm, gapps.Android90, gapps.VariantPico, "20200101"); !errors.Is(err, ErrPackageNotFound) {
+		t.Errorf("Get() of deleted package error = %v, want %v", err, ErrPackageNotFound)
+	}
+}
+
+func TestDBClose(t *testing.T) {
+	cache, cleanup := newTestDB(t)
+	defer cleanup()
+	d, err := NewDB(cache, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := testPackage(gapps.PlatformArm64, gapps.Android100, gapps.VariantNano, "20200101")
+	if err = d.Put(p); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+
+	if _, err = d.Get(p.Platform, p.Android, p.Variant, p.Date); !errors.Is(err, ErrDBClosed) {
+		t.Errorf("Get() error = %v, want %v", err, ErrDBClosed)
+	}
+	if err = d.Put(p); !errors.Is(err, ErrDBClosed) {
+		t.Errorf("Put() error = %v, want %v", err, ErrDBClosed)
+	}
+	if _, err = d.List(); !errors.Is(err, ErrDBClosed) {
+		t.Errorf("List() error = %v, want %v", err, ErrDBClosed)
+	}
+
+	// the flushed package is kept in the cache DB
+	reopened, err := NewDB(cache, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reopened.Get(p.Platform, p.Android, p.Variant, p.Date); err != nil {
+		t.Errorf("Get() after reopen error = %v", err)
+	}
+}
+
+func TestGlobalStorageRestore(t *testing.T) {
+	tests := []struct {
+		name   string
+		date   string
+		ages   []time.Duration
+		noDB   bool
+		wantOK bool
+	}{
+		{name: "restored", date: "20200101", ages: []time.Duration{time.Minute, time.Hour}, wantOK: true},
+		{name: "missing date", date: "20200102", ages: []time.Duration{time.Minute}},
+		{name: "stale package", date: "20200101", ages: []time.Duration{time.Minute, 48 * time.Hour}},
+		{name: "current key", date: CurrentStorageKey, ages: []time.Duration{time.Minute}},
+		{name: "no DB", date: "20200101", ages: []time.Duration{time.Minute}, noDB: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, cleanup := newTestDB(t)
+			defer cleanup()
+			d, err := NewDB(cache, 24*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			variants := []gapps.Variant{gapps.VariantNano, gapps.VariantPico}
+			for i, age := range tt.ages {
+				p := testPackage(gapps.PlatformArm64, gapps.Android100, variants[i], "20200101")
+				putRecord(t, d, p, time.Now().Add(-age))
+			}
+
+			gs := NewGlobalStorage(cache)
+			if !tt.noDB {
+				gs.SetDB(d)
+			}
+			s, ok := gs.Restore(tt.date)
+			if ok != tt.wantOK {
+				t.Fatalf("Restore() ok = %t, want %t", ok, tt.wantOK)
+			}
+			if !ok {
+				if _, found := gs.Get(tt.date); found && tt.date != CurrentStorageKey {
+					t.Errorf("storage %s is added on failed Restore()", tt.date)
+				}
+				return
+			}
+
+			if s.Count != len(tt.ages) {
+				t.Errorf("Restore() count = %d, want %d", s.Count, len(tt.ages))
+			}
+			if since := time.Since(s.ScannedAt); since < tt.ages[len(tt.ages)-1] {
+				t.Errorf("Restore() scanned %s ago, want the oldest package save time", since)
+			}
+			if got, found := gs.Get(tt.date); !found || got != s {
+				t.Errorf("restored storage %s isn't added", tt.date)
+			}
+		})
+	}
+}
+
+func TestStorageSaveIndexPurge(t *testing.T) {
+	arm := gapps.PlatformArm
+	tests := []struct {
+		name     string
+		platform *gapps.Platform
+		want     int
+	}{
+		{name: "all", platform: nil, want: 0},
+		{name: "platform", platform: &arm, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, cleanup := newTestDB(t)
+			defer cleanup()
+			d, err := NewDB(cache, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gs := NewGlobalStorage(cache)
+			gs.SetDB(d)
+
+			for _, date := range []string{"20200101", "20200102"} {
+				s := &Storage{}
+				s.Add(testPackage(gapps.PlatformArm64, gapps.Android100, gapps.VariantNano, date))
+				s.Add(testPackage(gapps.PlatformArm, gapps.Android90, gapps.VariantPico, date))
+				gs.Add(date, s)
+				if err = s.Save(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// the evicted release packages are left in the DB only
+			gs.Evict(1)
+
+			list, err := d.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != 4 {
+				t.Fatalf("List() after Save() returned %d packages, want 4", len(list))
+			}
+
+			if _, err = gs.Purge(tt.platform); err != nil {
+				t.Fatal(err)
+			}
+			if list, err = d.List(); err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != tt.want {
+				t.Fatalf("List() after Purge() returned %d packages, want %d", len(list), tt.want)
+			}
+			for _, p := range list {
+				if p.Platform == arm {
+					t.Errorf("package %s isn't purged from DB", p.Name)
+				}
+			}
+		})
+	}
+}
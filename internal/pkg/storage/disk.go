@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// PinnedTag is the package tag which protects its mirror from pruning
+const PinnedTag = "pinned"
+
+// Local storage resource errors
+var (
+	// ErrOutOfInodes is returned when the local storage filesystem has not enough free inodes
+	ErrOutOfInodes = errors.New("out of inodes")
+	// ErrNotEnoughSpace is returned when the local storage filesystem has not enough free space for the package
+	ErrNotEnoughSpace = errors.New("not enough disk space")
+)
+
+var errDiskStatsUnsupported = errors.New("filesystem stats are not supported on this platform")
+
+// diskInfo describes the filesystem stats
+type diskInfo struct {
+	FreeBytes   uint64
+	FreeInodes  uint64
+	TotalInodes uint64
+}
+
+// diskFree returns the number of bytes available on the filesystem of the path
+func diskFree(path string) (uint64, error) {
+	info, err := diskStats(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.FreeBytes, nil
+}
+
+// checkDisk checks that the local storage has enough resources to store the package of the size,
+// keeping at least gapps.min_free_bytes free after that.
+// The check is skipped if the platform or filesystem doesn't report the stats.
+func checkDisk(cfg *viper.Viper, localPath string, size int64) error {
+	info, err := diskStats(localPath)
+	if errors.Is(err, errDiskStatsUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if minInodes := cfg.GetInt64("gapps.min_free_inodes"); minInodes > 0 && info.TotalInodes > 0 && info.FreeInodes < uint64(minInodes) {
+		return fmt.Errorf("%w: %d free, %d required", ErrOutOfInodes, info.FreeInodes, minInodes)
+	}
+
+	required := uint64(cfg.GetInt64("gapps.min_free_bytes"))
+	if size > 0 {
+		required += uint64(size)
+	}
+	if info.FreeBytes < required {
+		return fmt.Errorf("%w: %s free, %s required", ErrNotEnoughSpace, HumanBytes(int64(info.FreeBytes)), HumanBytes(int64(required)))
+	}
+	return nil
+}
+
+// DiskUsage describes the local storage files
+type DiskUsage struct {
+	Files int
+	Bytes int64
+}
+
+// DiskUsageByPlatform returns the size of the local storage files by platform
+func DiskUsageByPlatform(cfg *viper.Viper) (map[gapps.Platform]int64, error) {
+	stats, err := DiskStatsByPlatform(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[gapps.Platform]int64, len(stats))
+	for platform, u := range stats {
+		usage[platform] = u.Bytes
+	}
+	return usage, nil
+}
+
+// DiskStatsByPlatform returns the number and the size of the local storage files by platform
+func DiskStatsByPlatform(cfg *viper.Viper) (map[gapps.Platform]DiskUsage, error) {
+	root := cfg.GetString("gapps.local_path")
+	if root == "" {
+		return nil, errors.New("local storage is not configured")
+	}
+
+	stats := make(map[gapps.Platform]DiskUsage, len(gapps.PlatformValues()))
+	for _, platform := range gapps.PlatformValues() {
+		var u DiskUsage
+		err := filepath.Walk(root+platform.String(), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() && !isLockFile(info.Name()) {
+				u.Files++
+				u.Bytes += info.Size()
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("unable to walk local storage for platform %s: %w", platform, err)
+		}
+		stats[platform] = u
+	}
+	return stats, nil
+}
+
+// PruneLargest removes the largest local mirrors until the local storage has
+// at least targetFree bytes available. Pinned packages are never removed.
+// Returns the number of removed mirrors.
+func (gs *GlobalStorage) PruneLargest(cfg *viper.Viper, targetFree uint64) (int, error) {
+	root := cfg.GetString("gapps.local_path")
+	if root == "" {
+		return 0, errors.New("local storage is not configured")
+	}
+
+	free, err := diskFree(root)
+	if err != nil {
+		return 0, err
+	}
+	if free >= targetFree {
+		return 0, nil
+	}
+
+	// collect the unpinned local mirrors, largest first
+	var candidates []*Package
+	seen := make(map[*Package]bool)
+	gs.mtx.RLock()
+	for _, s := range gs.storages {
+		for _, p := range s.List() {
+			localURL, _ := p.mirrorURLs()
+			if _, pinned := p.Tag(PinnedTag); localURL != "" && !pinned && !seen[p] {
+				seen[p] = true
+				candidates = append(candidates, p)
+			}
+		}
+	}
+	gs.mtx.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Size > candidates[j].Size })
+
+	var count int
+	for _, p := range candidates {
+		if free >= targetFree {
+			break
+		}
+
+		path := p.localPath(root)
+		unlock, err := lockPath(cfg, path)
+		if err != nil {
+			log.Errorf("Unable to lock mirror %s: %v", path, err)
+			continue
+		}
+		err = os.Remove(path)
+		unlock()
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Unable to remove mirror %s: %v", path, err)
+			continue
+		}
+		p.dropLocal()
+		count++
+		log.WithField("path", path).WithField("size", p.Size).Info("Mirror pruned")
+
+		if free, err = diskFree(root); err != nil {
+			return count, err
+		}
+	}
+	gs.Save()
+
+	if free < targetFree {
+		return count, fmt.Errorf("unable to free enough space: %d bytes available, %d wanted", free, targetFree)
+	}
+	return count, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package storage
+
+// diskStats is not supported on this platform
+func diskStats(path string) (diskInfo, error) {
+	return diskInfo{}, errDiskStatsUnsupported
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package storage
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// diskStats returns the filesystem stats for the path
+func diskStats(path string) (diskInfo, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return diskInfo{}, fmt.Errorf("unable to get filesystem stats: %w", err)
+	}
+	return diskInfo{
+		FreeBytes:   uint64(st.Bavail) * uint64(st.Bsize),
+		FreeInodes:  uint64(st.Ffree),
+		TotalInodes: uint64(st.Files),
+	}, nil
+}
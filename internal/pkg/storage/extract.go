@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Archive errors
+var (
+	ErrEntryNotFound = errors.New("entry not found")
+	ErrBadArchive    = errors.New("invalid package archive")
+)
+
+// installerEntries are the entries one of which is present in every OpenGApps package
+var installerEntries = []string{"installer.sh", "META-INF/com/google/android/update-binary"}
+
+// ExtractEntry streams a single named entry of the package archive to the writer.
+// Local mirror is used if it's available, otherwise the remote file is read
+// with HTTP range requests, so that only the required parts are downloaded.
+// The range requests are cancelled along with ctx.
+func (p *Package) ExtractEntry(ctx context.Context, cfg *viper.Viper, entry string, w io.Writer) error {
+	var (
+		r    io.ReaderAt
+		size int64
+	)
+
+	if file, info, ok := p.openLocal(cfg); ok {
+		defer file.Close()
+		r, size = file, info.Size()
+	} else {
+		_, url := p.mirrorURLs()
+		if url == "" {
+			url = p.OriginURL
+		}
+		r, size = &httpReaderAt{ctx: ctx, url: url, size: int64(p.Size)}, int64(p.Size)
+	}
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("unable to read package archive: %w", err)
+	}
+
+	for _, f := range zr.File {
+		if f.Name != entry {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("unable to open entry %s: %w", entry, err)
+		}
+		defer rc.Close()
+
+		if _, err = io.Copy(w, rc); err != nil {
+			return fmt.Errorf("unable to extract entry %s: %w", entry, err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrEntryNotFound, entry)
+}
+
+// openLocal opens the local mirror file, if the package has one.
+// It reports false if the file is missing or unreadable, so that the remote one is used instead.
+func (p *Package) openLocal(cfg *viper.Viper) (*os.File, os.FileInfo, bool) {
+	localPath := cfg.GetString("gapps.local_path")
+	if localURL, _ := p.mirrorURLs(); localPath == "" || localURL == "" {
+		return nil, nil, false
+	}
+
+	path := p.localPath(localPath)
+	file, err := os.Open(path)
+	if err != nil {
+		log.WithField("path", path).Warnf("Unable to open the local mirror, reading the remote one: %v", err)
+		return nil, nil, false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		log.WithField("path", path).Warnf("Unable to stat the local mirror, reading the remote one: %v", err)
+		return nil, nil, false
+	}
+	return file, info, true
+}
+
+// verifyArchive checks that the package file is a readable zip archive
+// with the OpenGApps installer and the core apps in it
+func verifyArchive(path string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadArchive, err)
+	}
+	defer zr.Close()
+
+	var installer, core bool
+	for _, f := range zr.File {
+		for _, entry := range installerEntries {
+			installer = installer || f.Name == entry
+		}
+		core = core || strings.HasPrefix(f.Name, "Core/")
+	}
+	switch {
+	case !installer:
+		return fmt.Errorf("%w: no installer found", ErrBadArchive)
+	case !core:
+		return fmt.Errorf("%w: no Core directory found", ErrBadArchive)
+	}
+	return nil
+}
+
+const (
+	// httpChunkSize is the size of the byte range requested by httpReaderAt at once,
+	// so that the small reads of the zip and flate readers don't make a request each
+	httpChunkSize = 1 << 20
+	// httpChunksCached is the number of the last chunks kept by httpReaderAt,
+	// e.g. the central directory and the entry data ones
+	httpChunksCached = 2
+)
+
+// httpReaderAt reads the remote file of the known size with HTTP range requests.
+// The file is read by the aligned chunks of httpChunkSize, and the last of them are cached.
+// ctx is kept for the requests, since io.ReaderAt doesn't accept one.
+type httpReaderAt struct {
+	ctx    context.Context
+	url    string
+	size   int64
+	chunks []httpChunk
+	mtx    sync.Mutex
+}
+
+// httpChunk is the cached part of the remote file from the offset
+type httpChunk struct {
+	off  int64
+	data []byte
+}
+
+func (h *httpReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	var n int
+	for n < len(b) {
+		pos := off + int64(n)
+		if pos >= h.size {
+			return n, io.EOF
+		}
+		chunk, err := h.chunk(pos - pos%httpChunkSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(b[n:], chunk.data[pos-chunk.off:])
+	}
+	return n, nil
+}
+
+// chunk returns the cached chunk from the offset, or requests it and caches it instead of the oldest one
+func (h *httpReaderAt) chunk(off int64) (httpChunk, error) {
+	for _, c := range h.chunks {
+		if c.off == off {
+			return c, nil
+		}
+	}
+
+	end := off + httpChunkSize
+	if end > h.size {
+		end = h.size
+	}
+	req, err := http.NewRequestWithContext(h.ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return httpChunk{}, fmt.Errorf("unable to create request: %w", err)
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(off, 10)+"-"+strconv.FormatInt(end-1, 10))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return httpChunk{}, fmt.Errorf("unable to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return httpChunk{}, fmt.Errorf("range requests are not supported: %s", resp.Status)
+	}
+
+	c := httpChunk{off: off, data: make([]byte, end-off)}
+	if _, err = io.ReadFull(resp.Body, c.data); err != nil {
+		return httpChunk{}, fmt.Errorf("unable to read the range: %w", err)
+	}
+
+	if len(h.chunks) >= httpChunksCached {
+		h.chunks = h.chunks[1:]
+	}
+	h.chunks = append(h.chunks, c)
+	return c, nil
+}
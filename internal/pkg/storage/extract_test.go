@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+
+	"github.com/spf13/viper"
+)
+
+// testArchive returns the zip archive with the entries of the sizes, filled with the random bytes
+func testArchive(t *testing.T, entries map[string]int) ([]byte, map[string][]byte) {
+	t.Helper()
+	var (
+		buf      bytes.Buffer
+		contents = make(map[string][]byte, len(entries))
+		rnd      = rand.New(rand.NewSource(1))
+	)
+	zw := zip.NewWriter(&buf)
+	for name, size := range entries {
+		content := make([]byte, size)
+		rnd.Read(content)
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		contents[name] = content
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), contents
+}
+
+func TestExtractEntry(t *testing.T) {
+	archive, contents := testArchive(t, map[string]int{
+		"installer.sh":         1 << 10,
+		"Core/gmscore.tar.lz":  5 << 20,
+		"GApps/youtube.tar.lz": 3 << 20,
+	})
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		http.ServeContent(w, r, "package.zip", time.Time{}, bytes.NewReader(archive))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := viper.New()
+	// the local mirror is missing, so the remote one is read
+	cfg.Set("gapps.local_path", dir+"/")
+
+	p := &Package{Name: "open_gapps-arm64-10.0-nano-20200101.zip", Date: "20200101", Size: len(archive),
+		Platform: gapps.PlatformArm64, LocalURL: "https://local.mirror/package.zip", RemoteURL: srv.URL}
+
+	tests := []struct {
+		entry       string
+		wantErr     error
+		maxRequests int64
+	}{
+		// the central directory and the entry are at most 2 chunks each
+		{entry: "installer.sh", maxRequests: 2},
+		{entry: "Core/gmscore.tar.lz", maxRequests: 8},
+		{entry: "Optional/unknown.tar.lz", wantErr: ErrEntryNotFound, maxRequests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			atomic.StoreInt64(&requests, 0)
+			var buf bytes.Buffer
+			err := p.ExtractEntry(context.Background(), cfg, tt.entry, &buf)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ExtractEntry() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && !bytes.Equal(buf.Bytes(), contents[tt.entry]) {
+				t.Error("ExtractEntry() content doesn't match")
+			}
+			if got := atomic.LoadInt64(&requests); got > tt.maxRequests {
+				t.Errorf("ExtractEntry() made %d requests, want at most %d", got, tt.maxRequests)
+			}
+		})
+	}
+}
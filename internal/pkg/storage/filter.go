@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+
+	"github.com/spf13/viper"
+)
+
+// errFiltered is returned for the packages which are skipped by the config filters
+var errFiltered = errors.New("package is filtered out")
+
+// filterPackage checks if the package passes the config filters
+func filterPackage(cfg *viper.Viper, p *Package) error {
+	if !androidInRange(cfg, p.Android) {
+		return errFiltered
+	}
+	return nil
+}
+
+// androidInRange checks if the Android version is within the
+// gapps.min_android and gapps.max_android bounds (both are optional)
+func androidInRange(cfg *viper.Viper, a gapps.Android) bool {
+	if min, ok := configAndroid(cfg, "gapps.min_android"); ok && a.Less(min) {
+		return false
+	}
+	if max, ok := configAndroid(cfg, "gapps.max_android"); ok && max.Less(a) {
+		return false
+	}
+	return true
+}
+
+func configAndroid(cfg *viper.Viper, key string) (gapps.Android, bool) {
+	value := cfg.GetString(key)
+	if value == "" {
+		return 0, false
+	}
+	a, err := gapps.AndroidString(strings.Replace(value, ".", "", -1))
+	if err != nil {
+		return 0, false
+	}
+	return a, true
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Mirror freshness statuses
+const (
+	FreshnessCurrent = "current"
+	FreshnessBehind  = "behind"
+)
+
+// Freshness describes how current the mirror is compared to the upstream
+type Freshness struct {
+	Local     string        `json:"local"`
+	Upstream  string        `json:"upstream"`
+	CheckedAt time.Time     `json:"checked_at"`
+	Lag       time.Duration `json:"lag"`
+	Status    string        `json:"status"`
+}
+
+// setUpstream saves the latest upstream release date
+func (gs *GlobalStorage) setUpstream(date string) {
+	gs.mtx.Lock()
+	gs.upstream, gs.upstreamCheckedAt = date, time.Now()
+	gs.mtx.Unlock()
+}
+
+// Freshness compares the current storage release against the latest upstream one,
+// which was seen on the last AddLatestStorage call, so no extra API calls are made.
+// Mirror is behind if the lag between the releases is greater than gapps.max_lag.
+func (gs *GlobalStorage) Freshness(cfg *viper.Viper) (Freshness, error) {
+	gs.mtx.RLock()
+	f := Freshness{Upstream: gs.upstream, CheckedAt: gs.upstreamCheckedAt}
+	gs.mtx.RUnlock()
+	if f.Upstream == "" {
+		return f, errors.New("upstream release is not checked yet")
+	}
+
+	s, ok := gs.Get(CurrentStorageKey)
+	if !ok {
+		return f, errors.New("no current storage")
+	}
+	f.Local = s.Date
+
+	timeFormat := cfg.GetString("gapps.time_format")
+	local, err := time.Parse(timeFormat, f.Local)
+	if err != nil {
+		return f, fmt.Errorf("unable to parse local release date: %w", err)
+	}
+	upstream, err := time.Parse(timeFormat, f.Upstream)
+	if err != nil {
+		return f, fmt.Errorf("unable to parse upstream release date: %w", err)
+	}
+
+	if f.Lag = upstream.Sub(local); f.Lag < 0 {
+		f.Lag = 0
+	}
+	f.Status = FreshnessCurrent
+	if f.Local != f.Upstream && f.Lag > cfg.GetDuration("gapps.max_lag") {
+		f.Status = FreshnessBehind
+	}
+	return f, nil
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/spf13/viper"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+const gcsURLFormat = "https://storage.googleapis.com/%s/%s"
+
+// gcsProvider uploads the files to the Google Cloud Storage bucket,
+// using the application default credentials
+type gcsProvider struct {
+	bucket  string
+	public  bool
+	maxSize int64
+
+	// gcs is created on the first request and reused by the later ones
+	once   sync.Once
+	gcs    *storage.Client
+	gcsErr error
+}
+
+func newGCSProvider(cfg *viper.Viper) *gcsProvider {
+	return &gcsProvider{
+		bucket:  cfg.GetString("gapps.gcs.bucket"),
+		public:  cfg.GetBool("gapps.gcs.public"),
+		maxSize: providerMaxSize(cfg, "gapps.gcs.max_size"),
+	}
+}
+
+func (g *gcsProvider) Name() string {
+	return "gcs"
+}
+
+func (g *gcsProvider) MaxSize() int64 {
+	return g.maxSize
+}
+
+func (g *gcsProvider) Upload(ctx context.Context, p *Package, file *os.File) (string, error) {
+	return g.put(ctx, p, file)
+}
+
+func (g *gcsProvider) Stream(ctx context.Context, p *Package, body io.Reader, _ int64) (string, error) {
+	return g.put(ctx, p, body)
+}
+
+// Delete deletes the package object from the bucket
+func (g *gcsProvider) Delete(ctx context.Context, p *Package) error {
+	client, err := g.client()
+	if err != nil {
+		return err
+	}
+
+	key := p.localPath("")
+	if err = client.Bucket(g.bucket).Object(key).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("unable to delete the object %s from bucket %s: %w", key, g.bucket, err)
+	}
+	return nil
+}
+
+// client returns the GCS client which uses the storage HTTP transport authorized
+// with the application default credentials. It's created once, so the context
+// of the first request doesn't limit the credentials refresh for the later ones.
+func (g *gcsProvider) client() (*storage.Client, error) {
+	g.once.Do(func() {
+		base := httpClient.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		transport, err := htransport.NewTransport(context.Background(), base, option.WithScopes(storage.ScopeFullControl))
+		if err != nil {
+			g.gcsErr = fmt.Errorf("unable to create GCS transport: %w", err)
+			return
+		}
+		if g.gcs, err = storage.NewClient(context.Background(), option.WithHTTPClient(&http.Client{Transport: transport})); err != nil {
+			g.gcsErr = fmt.Errorf("unable to create GCS client: %w", err)
+		}
+	})
+	return g.gcs, g.gcsErr
+}
+
+// put uploads the package under the Platform/Date/Name key and returns the object URL
+func (g *gcsProvider) put(ctx context.Context, p *Package, body io.Reader) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	client, err := g.client()
+	if err != nil {
+		return "", err
+	}
+
+	key := p.localPath("")
+	w := client.Bucket(g.bucket).Object(key).NewWriter(ctx)
+	w.ContentType = "application/zip"
+	if g.public {
+		w.PredefinedACL = "publicRead"
+	}
+
+	if _, err = io.Copy(w, body); err != nil {
+		// cancelling the context aborts the upload, so that the partial object is not created
+		cancel()
+		w.Close()
+		return "", fmt.Errorf("unable to write the object %s to bucket %s: %w", key, g.bucket, err)
+	}
+	if err = w.Close(); err != nil {
+		return "", fmt.Errorf("unable to put the object %s to bucket %s: %w", key, g.bucket, err)
+	}
+
+	return fmt.Sprintf(gcsURLFormat, g.bucket, key), nil
+}
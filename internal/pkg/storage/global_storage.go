@@ -4,9 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/db"
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/events"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
 	"github.com/nezorflame/opengapps-mirror-bot/pkg/net"
 
 	"github.com/google/go-github/v29/github"
@@ -18,7 +22,15 @@ import (
 type GlobalStorage struct {
 	storages map[string]*Storage
 	cache    *db.DB
+	index    *DB
 	mtx      sync.RWMutex
+
+	// latest upstream release, used for the freshness check
+	upstream          string
+	upstreamCheckedAt time.Time
+
+	// request counts not saved to the cache yet
+	requests requestCounter
 }
 
 // NewGlobalStorage creates a new GlobalStorage instance
@@ -29,23 +41,96 @@ func NewGlobalStorage(cache *db.DB) *GlobalStorage {
 	}
 }
 
+// SetDB sets the package DB for the storages, which keeps the packages of the saved ones,
+// so that the evicted release can be restored without Github
+func (gs *GlobalStorage) SetDB(index *DB) {
+	gs.mtx.Lock()
+	defer gs.mtx.Unlock()
+	gs.index = index
+	for _, s := range gs.storages {
+		s.mtx.Lock()
+		s.index = index
+		s.mtx.Unlock()
+	}
+}
+
+// Restore adds the release storage of the date with its packages from the package DB.
+// It reports false if the DB has no packages of the release or any of them is stale,
+// so that the release is fetched from Github instead.
+func (gs *GlobalStorage) Restore(date string) (*Storage, bool) {
+	gs.mtx.RLock()
+	index := gs.index
+	gs.mtx.RUnlock()
+	if index == nil || date == CurrentStorageKey {
+		return nil, false
+	}
+
+	records, err := index.records()
+	if err != nil {
+		log.Errorf("Unable to list the packages from DB: %v", err)
+		return nil, false
+	}
+
+	s := &Storage{
+		Date:     date,
+		Packages: make(map[gapps.Platform]map[gapps.Android]map[gapps.Variant]*Package, len(gapps.PlatformValues())),
+	}
+	for _, r := range records {
+		if r.Package.Date != date {
+			continue
+		}
+		if r.stale(index.ttl) {
+			log.WithField("release_date", date).WithField("package", r.Package.Name).Debug("Package in DB is stale")
+			return nil, false
+		}
+		if s.ScannedAt.IsZero() || r.SavedAt.Before(s.ScannedAt) {
+			s.ScannedAt = r.SavedAt
+		}
+		s.add(r.Package)
+	}
+	if s.Count == 0 {
+		return nil, false
+	}
+
+	log.WithField("release_date", date).WithField("count", s.Count).Info("Release restored from DB")
+	gs.Add(date, s)
+	return s, true
+}
+
 // AddLatestStorage adds the latest Storage to the storages
 func (gs *GlobalStorage) AddLatestStorage(ctx context.Context, ghClient *github.Client, dq *net.DownloadQueue, cfg *viper.Viper) error {
-	releaseDate, err := GetLatestReleaseDate(ctx, ghClient, cfg.GetString("github.repo"))
+	releaseDate, err := GetLatestReleaseDate(ctx, ghClient, cfg, tagPattern(cfg))
 	if err != nil {
 		return fmt.Errorf("unable to get latest release date: %w", err)
 	}
 	logger := log.WithField("release_date", releaseDate)
 	logger.Debugf("Got the newest release date")
+	gs.setUpstream(releaseDate)
 
 	// check if the current package is in cache and is up-to-date
 	// get it if it's not
 	s, ok := gs.Get(releaseDate)
+	if ok && s.Stale(cfg.GetDuration("gapps.cache_ttl")) {
+		logger.Info("Storage is stale, rescanning the release")
+		count, err := s.rescan(ctx, ghClient, dq, cfg, releaseDate)
+		if err != nil {
+			return fmt.Errorf("unable to rescan current package storage: %w", err)
+		}
+		logger.WithField("count", count).Info("Release rescanned, new packages discovered")
+		if err = s.Save(); err != nil {
+			return fmt.Errorf("unable to save rescanned storage: %w", err)
+		}
+	}
 	if !ok {
 		logger.Info("Storage not found, creating a new one")
-		if s, err = GetPackageStorage(ctx, ghClient, dq, cfg, releaseDate); err != nil {
+		var summary ScanSummary
+		if s, summary, err = GetPackageStorage(ctx, ghClient, dq, cfg, releaseDate); err != nil {
 			return fmt.Errorf("unable to get current package storage: %w", err)
 		}
+		logger.WithField("found", summary.Found).WithField("added", summary.Added).
+			WithField("skipped", summary.Skipped).WithField("unparsed", summary.Unparsed).WithField("failed", summary.Failed).
+			WithField("bytes", summary.Bytes).WithField("duration", summary.Duration).
+			Info("Release scanned")
 		logger.Debug("Saving the storage")
 		gs.Add(s.Date, s)
 		if err = s.Save(); err != nil {
@@ -56,6 +141,7 @@ func (gs *GlobalStorage) AddLatestStorage(ctx context.Context, ghClient *github.
 
 	logger.Debug("Setting storage as current")
 	gs.Add(CurrentStorageKey, s)
+	gs.Evict(cfg.GetInt("cache.max_releases"))
 	return nil
 }
 
@@ -68,8 +154,15 @@ func (gs *GlobalStorage) Add(date string, s *Storage) {
 	if s.cache == nil {
 		s.cache = gs.cache
 	}
+	if s.index == nil {
+		s.index = gs.index
+	}
 	gs.storages[date] = s
 	gs.mtx.Unlock()
+
+	for _, p := range s.List() {
+		knownChecksums.add(p)
+	}
 }
 
 // Get safely gets a Storage from the storages
@@ -83,6 +176,132 @@ func (gs *GlobalStorage) Get(date string) (*Storage, bool) {
 	return s, ok
 }
 
+// Evict removes the oldest storages from the GlobalStorage and the cache,
+// keeping no more than limit of them. Current storage and the storages with any pinned package
+// are always kept, and aren't counted against the limit. Mirrored files are not touched.
+// Non-positive limit means no limit.
+func (gs *GlobalStorage) Evict(limit int) {
+	if limit <= 0 {
+		return
+	}
+
+	gs.mtx.Lock()
+	defer gs.mtx.Unlock()
+
+	var currentDate string
+	if current, ok := gs.storages[CurrentStorageKey]; ok {
+		currentDate = current.Date
+	}
+
+	dates := make([]string, 0, len(gs.storages))
+	for k, s := range gs.storages {
+		if k != CurrentStorageKey && k != currentDate && !s.Pinned() {
+			dates = append(dates, k)
+		}
+	}
+	if len(dates) <= limit {
+		return
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+	for _, date := range dates[limit:] {
+		delete(gs.storages, date)
+		if err := gs.cache.Delete(date); err != nil {
+			log.Errorf("Unable to delete storage %s from cache: %v", date, err)
+			continue
+		}
+		log.WithField("release_date", date).Info("Storage evicted from cache")
+		events.Emit(events.StorageEvicted, events.Fields{"release_date": date})
+	}
+}
+
+// Dates returns the dates of all the storages, newest first
+func (gs *GlobalStorage) Dates() []string {
+	gs.mtx.RLock()
+	defer gs.mtx.RUnlock()
+
+	dates := make([]string, 0, len(gs.storages))
+	for k := range gs.storages {
+		if k != CurrentStorageKey {
+			dates = append(dates, k)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+	return dates
+}
+
+// FindNearest returns the package from the newest release on or before the date,
+// along with its Storage. Dates are compared as gapps.time_format times.
+// It reports false if no such release with the package is known.
+func (gs *GlobalStorage) FindNearest(cfg *viper.Viper, p gapps.Platform, a gapps.Android, v gapps.Variant, date string) (*Storage, *Package, bool) {
+	timeFormat := cfg.GetString("gapps.time_format")
+	target, err := time.Parse(timeFormat, date)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	var (
+		nearest     *Storage
+		nearestPkg  *Package
+		nearestTime time.Time
+	)
+	gs.mtx.RLock()
+	defer gs.mtx.RUnlock()
+	for k, s := range gs.storages {
+		if k == CurrentStorageKey {
+			continue
+		}
+		t, err := time.Parse(timeFormat, k)
+		if err != nil || t.After(target) || nearest != nil && !t.After(nearestTime) {
+			continue
+		}
+		if pkg, ok := s.Get(p, a, v); ok {
+			nearest, nearestPkg, nearestTime = s, pkg, t
+		}
+	}
+	if nearest != nil && nearest.cache == nil {
+		nearest.cache = gs.cache
+	}
+	return nearest, nearestPkg, nearest != nil
+}
+
+// LocalChecksum returns the MD5 checksum of the package which local mirror is at the path
+// relative to gapps.local_path, like "arm64/20200101/open_gapps-arm64-10.0-nano-20200101.zip".
+// It returns an empty string if no loaded package has the mirror or its checksum is not known.
+func (gs *GlobalStorage) LocalChecksum(path string) string {
+	gs.mtx.RLock()
+	defer gs.mtx.RUnlock()
+	for _, s := range gs.storages {
+		for _, p := range s.List() {
+			if p.localPath("") != path {
+				continue
+			}
+			if md5sum, unverified := p.checksum(); md5sum != "" && !unverified {
+				return md5sum
+			}
+		}
+	}
+	return ""
+}
+
+// Counts returns the number of the releases in the cache and the number of the packages
+// in all the loaded storages. Current storage is counted once.
+func (gs *GlobalStorage) Counts() (releases int, packages int, err error) {
+	keys, err := gs.cache.Keys()
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to get storage list from cache: %w", err)
+	}
+
+	gs.mtx.RLock()
+	defer gs.mtx.RUnlock()
+	for k, s := range gs.storages {
+		if k != CurrentStorageKey {
+			packages += len(s.List())
+		}
+	}
+	return len(keys), packages, nil
+}
+
 // Save saves the GlobalStorage to the cache
 func (gs *GlobalStorage) Save() {
 	gs.mtx.RLock()
@@ -106,7 +325,6 @@ func (gs *GlobalStorage) Load() error {
 	}
 	log.Debug("Got the release keys: ", cachedStorageList)
 
-	s := &Storage{}
 	var sBody []byte
 	for _, k := range cachedStorageList {
 		if sBody, err = gs.cache.Get(k); err != nil {
@@ -114,6 +332,7 @@ func (gs *GlobalStorage) Load() error {
 			continue
 		}
 
+		s := &Storage{}
 		if err = json.Unmarshal(sBody, s); err != nil {
 			log.Warnf("Unable to unmarshal storage from cache for package '%s': %v", k, err)
 			continue
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/db"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+)
+
+// newTestDB opens the DB in the temp dir and returns the function which closes and removes it
+func newTestDB(t *testing.T) (*db.DB, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := db.NewDB(filepath.Join(dir, "bolt.db"), 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return cache, func() {
+		cache.Close(false)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGlobalStorageEvict(t *testing.T) {
+	tests := []struct {
+		name    string
+		dates   []string
+		current string
+		pinned  []string
+		limit   int
+		want    []string
+	}{
+		{
+			name:  "no limit",
+			dates: []string{"20200101", "20200102", "20200103"},
+			limit: 0,
+			want:  []string{"20200103", "20200102", "20200101"},
+		},
+		{
+			name:  "oldest evicted",
+			dates: []string{"20200101", "20200102", "20200103"},
+			limit: 2,
+			want:  []string{"20200103", "20200102"},
+		},
+		{
+			name:    "current kept",
+			dates:   []string{"20200101", "20200102", "20200103"},
+			current: "20200101",
+			limit:   1,
+			want:    []string{"20200103", "20200101"},
+		},
+		{
+			name:   "pinned kept",
+			dates:  []string{"20200101", "20200102", "20200103", "20200104"},
+			pinned: []string{"20200101"},
+			limit:  2,
+			want:   []string{"20200104", "20200103", "20200101"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, cleanup := newTestDB(t)
+			defer cleanup()
+			gs := NewGlobalStorage(cache)
+			for _, date := range tt.dates {
+				s := &Storage{}
+				p := &Package{Name: "open_gapps-arm64-10.0-nano-" + date + ".zip", Date: date,
+					Platform: gapps.PlatformArm64, Android: gapps.Android100, Variant: gapps.VariantNano}
+				for _, pinned := range tt.pinned {
+					if pinned == date {
+						p.SetTag(PinnedTag, "true")
+					}
+				}
+				s.Add(p)
+				gs.Add(date, s)
+				if err := s.Save(); err != nil {
+					t.Fatal(err)
+				}
+				if date == tt.current {
+					gs.Add(CurrentStorageKey, s)
+				}
+			}
+
+			gs.Evict(tt.limit)
+
+			got := gs.Dates()
+			if !equalStrings(got, tt.want) {
+				t.Errorf("Dates() = %v, want %v", got, tt.want)
+			}
+			keys, err := gs.cache.Keys()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append([]string(nil), tt.want...)
+			sort.Strings(want)
+			if !equalStrings(keys, want) {
+				t.Errorf("cache keys = %v, want %v", keys, want)
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Import walks the directory with the existing mirror files and adds them to the GlobalStorage.
+// Files are moved to the local storage layout, if they're not there yet.
+// Files which can't be parsed as packages are skipped.
+// Returns the number of imported packages.
+func (gs *GlobalStorage) Import(dir string, cfg *viper.Viper) (int, error) {
+	localPath := cfg.GetString("gapps.local_path")
+	if localPath == "" {
+		return 0, errors.New("local storage is not configured")
+	}
+
+	var (
+		count    int
+		touched  = make(map[string]*Storage)
+		imported = make(map[string]bool)
+	)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || packageExtension(cfg, info.Name()) == "" {
+			return nil
+		}
+
+		if imported[filepath.Clean(path)] {
+			return nil // already moved here during this import
+		}
+
+		p, err := parseName(cfg, info.Name())
+		if err != nil {
+			log.Warnf("Skipping file %s: %v", path, err)
+			return nil
+		}
+		p.Size = int(info.Size())
+		if p.MD5, err = hashFile(path); err != nil {
+			log.Warnf("Skipping file %s: %v", path, err)
+			return nil
+		}
+
+		destPath := p.localPath(localPath)
+		if filepath.Clean(path) != filepath.Clean(destPath) {
+			if destPath, err = p.move(cfg, path, cfg.GetString("gapps.collision_strategy")); err != nil {
+				log.Warnf("Skipping file %s: %v", path, err)
+				return nil
+			}
+		}
+		p.setLocalURL(cfg, destPath)
+		imported[filepath.Clean(destPath)] = true
+
+		s := gs.getOrCreate(p.Date)
+		if existing, ok := s.Get(p.Platform, p.Android, p.Variant); ok {
+			existing.mtx.Lock()
+			existing.LocalURL, existing.MD5 = p.LocalURL, p.MD5
+			existing.mtx.Unlock()
+		} else {
+			s.Add(p)
+		}
+		touched[p.Date] = s
+		count++
+		log.WithField("package", p.Name).Debug("Package imported")
+		return nil
+	})
+	if err != nil {
+		return count, fmt.Errorf("unable to walk the import dir: %w", err)
+	}
+
+	for date, s := range touched {
+		if err = s.Save(); err != nil {
+			return count, fmt.Errorf("unable to save storage %s: %w", date, err)
+		}
+	}
+	return count, nil
+}
+
+// getOrCreate safely gets a Storage from the storages or creates an empty one
+func (gs *GlobalStorage) getOrCreate(date string) *Storage {
+	if s, ok := gs.Get(date); ok {
+		return s
+	}
+
+	s := &Storage{
+		Date:     date,
+		Packages: make(map[gapps.Platform]map[gapps.Android]map[gapps.Variant]*Package, len(gapps.PlatformValues())),
+	}
+	gs.Add(date, s)
+	return s
+}
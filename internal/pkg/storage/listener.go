@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MirrorListener is notified about each mirror created successfully, e.g. to send it to a chat.
+// Nothing is notified until the listeners are added with AddMirrorListener.
+type MirrorListener interface {
+	OnMirror(p *Package)
+}
+
+// MirrorListenerFunc allows to use the function as MirrorListener
+type MirrorListenerFunc func(p *Package)
+
+// OnMirror calls f(p)
+func (f MirrorListenerFunc) OnMirror(p *Package) {
+	f(p)
+}
+
+var (
+	listeners   []MirrorListener
+	listenerMtx sync.RWMutex
+)
+
+// AddMirrorListener adds the listener for the created mirrors
+func AddMirrorListener(l MirrorListener) {
+	listenerMtx.Lock()
+	listeners = append(listeners, l)
+	listenerMtx.Unlock()
+}
+
+// notifyMirror notifies the listeners about the created mirror in the background,
+// so that the slow or panicking listeners don't affect the mirror result
+func notifyMirror(p *Package) {
+	listenerMtx.RLock()
+	defer listenerMtx.RUnlock()
+
+	for _, l := range listeners {
+		go func(l MirrorListener) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.WithField("package", p.Name).Errorf("Mirror listener panicked: %v", r)
+				}
+			}()
+			l.OnMirror(p)
+		}(l)
+	}
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+const lockExtension = ".lock"
+
+// pathLocks serializes the local file operations of this process by path
+var pathLocks = keyedMutex{locks: make(map[string]*keyedLock)}
+
+type keyedLock struct {
+	mtx  sync.Mutex
+	refs int
+}
+
+// keyedMutex is the set of mutexes by key, which are removed once they're not used
+type keyedMutex struct {
+	locks map[string]*keyedLock
+	mtx   sync.Mutex
+}
+
+// lock locks the mutex for the key and returns the function to unlock it
+func (k *keyedMutex) lock(key string) func() {
+	k.mtx.Lock()
+	l := k.locks[key]
+	if l == nil {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mtx.Unlock()
+
+	l.mtx.Lock()
+	return func() {
+		l.mtx.Unlock()
+		k.mtx.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mtx.Unlock()
+	}
+}
+
+// lockPath locks the local file path for writing or removal and returns the function to unlock it.
+// The path is always locked within the process. If gapps.lock_files is set, it's also locked
+// with the advisory flock of the hidden lock file next to it, so that several bot instances
+// can share the same gapps.local_path. On the platforms without flock only the process lock is used.
+func lockPath(cfg *viper.Viper, path string) (func(), error) {
+	path = filepath.Clean(path)
+	unlock := pathLocks.lock(path)
+	if !cfg.GetBool("gapps.lock_files") {
+		return unlock, nil
+	}
+
+	funlock, err := flock(lockFilePath(path))
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return func() {
+		funlock()
+		unlock()
+	}, nil
+}
+
+// lockFilePath returns the path of the hidden lock file for the path
+func lockFilePath(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, "."+name+lockExtension)
+}
+
+// isLockFile checks if the file name is the one of the lock file
+func isLockFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, lockExtension)
+}
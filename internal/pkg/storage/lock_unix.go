@@ -0,0 +1,43 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// flock acquires the exclusive advisory lock of the file, creating it if needed,
+// and returns the function which releases the lock and removes the file.
+// If the file is removed by another holder while waiting for the lock, the lock is acquired again.
+func flock(path string) (func(), error) {
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open lock file: %w", err)
+		}
+		if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("unable to lock file %s: %w", path, err)
+		}
+
+		// the file we've locked should still be the one at the path
+		locked, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("unable to stat lock file: %w", err)
+		}
+		if current, err := os.Stat(path); err != nil || !os.SameFile(locked, current) {
+			file.Close()
+			continue
+		}
+
+		return func() {
+			os.Remove(path)
+			syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+			file.Close()
+		}, nil
+	}
+}
@@ -1,144 +1,921 @@
 package storage
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/events"
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/metrics"
 	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
 	"github.com/nezorflame/opengapps-mirror-bot/pkg/net"
 
 	"github.com/google/go-github/v29/github"
 	log "github.com/sirupsen/logrus"
+	"github.com/skip2/go-qrcode"
 	"github.com/spf13/viper"
 )
 
-const gappsSeparator = "-"
+const (
+	gappsSeparator = "-"
+	scanAttempts   = 3
+	qrCodeSize     = 256
+)
+
+// File collision strategies for the local storage
+const (
+	CollisionOverwrite = "overwrite"
+	CollisionSkip      = "skip"
+	CollisionVerify    = "verify-then-overwrite"
+)
+
+var (
+	md5Regexp    = regexp.MustCompile(`\b[0-9a-fA-F]{32}\b`)
+	md5BSDRegexp = regexp.MustCompile(`^MD5 ?\((.*)\) ?= ?([0-9a-fA-F]{32})$`)
+)
+
+var sizeUnits = []string{"KiB", "MiB", "GiB", "TiB"}
+
+// Package errors
+var (
+	ErrEmptyChecksum   = errors.New("empty checksum")
+	ErrInvalidChecksum = errors.New("invalid checksum")
+	ErrBadExtension    = errors.New("incorrect package extension")
+	ErrBadPackageName  = errors.New("unrecognized package name")
+	ErrMirrorPartial   = errors.New("mirror is created partially")
+)
+
+// NameError describes the package name which can't be parsed into its parts.
+// It matches ErrBadPackageName and the wrapped gapps parsing error, like gapps.ErrBadAndroid.
+type NameError struct {
+	Name string
+	Err  error
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("%v %s: %v", ErrBadPackageName, e.Name, e.Err)
+}
+
+func (e *NameError) Unwrap() error {
+	return e.Err
+}
+
+// Is allows to match the error with ErrBadPackageName
+func (e *NameError) Is(target error) bool {
+	return target == ErrBadPackageName
+}
+
+// MirrorError describes the mirror creation failure and the steps completed before it
+type MirrorError struct {
+	// LocalDone is set if the package file is moved to the local storage
+	LocalDone bool
+	// RemoteDone is set if the streamed package has failed the verification,
+	// but is kept on the remote provider as unverified
+	RemoteDone bool
+	Err        error
+}
+
+func (e *MirrorError) Error() string {
+	if e.LocalDone || e.RemoteDone {
+		return fmt.Sprintf("%v (local: %t, remote: %t): %v", ErrMirrorPartial, e.LocalDone, e.RemoteDone, e.Err)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *MirrorError) Unwrap() error {
+	return e.Err
+}
+
+// Is allows to match the error with ErrMirrorPartial if any of the mirrors is done
+func (e *MirrorError) Is(target error) bool {
+	return target == ErrMirrorPartial && (e.LocalDone || e.RemoteDone)
+}
 
 // Package describes the OpenGApps package
 type Package struct {
-	Name      string         `json:"name"`
-	Date      string         `json:"date"`
-	OriginURL string         `json:"origin_url"`
-	LocalURL  string         `json:"local_url"`
-	RemoteURL string         `json:"remote_url"`
-	MD5       string         `json:"md5"`
-	Size      int            `json:"size"`
-	Platform  gapps.Platform `json:"platform"`
-	Android   gapps.Android  `json:"android"`
-	Variant   gapps.Variant  `json:"variant"`
-}
-
-// CreateMirror creates a new mirror for the package
-func (p *Package) CreateMirror(dq *net.DownloadQueue, cfg *viper.Viper) error {
-	if cfg.GetString("gapps.local_url") != "" && p.LocalURL != "" ||
-		cfg.GetString("gapps.remote_url") != "" && p.RemoteURL != "" {
+	Name       string            `json:"name"`
+	Date       string            `json:"date"`
+	Release    string            `json:"release,omitempty"`
+	Suffix     string            `json:"suffix,omitempty"`
+	OriginURL  string            `json:"origin_url"`
+	MD5URL     string            `json:"md5_url,omitempty"`
+	LocalURL   string            `json:"local_url"`
+	RemoteURL  string            `json:"remote_url"`
+	RemoteBy   string            `json:"remote_by,omitempty"`
+	MD5        string            `json:"md5"`
+	Unverified bool              `json:"unverified,omitempty"`
+	Size       int               `json:"size"`
+	Platform   gapps.Platform    `json:"platform"`
+	Android    gapps.Android     `json:"android"`
+	Variant    gapps.Variant     `json:"variant"`
+	Tags       map[string]string `json:"tags,omitempty"`
+
+	// Stats of the last mirror creation, which are not persisted
+	Stats MirrorStats `json:"-"`
+
+	// mtx guards LocalURL, RemoteURL, RemoteBy, MD5, Unverified, Tags and Stats,
+	// which are changed while the package is shared with the readers
+	mtx      sync.RWMutex
+	progress net.Progress
+}
+
+// packageJSON is the Package without its methods, to encode it in MarshalJSON
+type packageJSON Package
+
+// MarshalJSON implements the json.Marshaler interface, so that the package is encoded
+// consistently while its mirror is created
+func (p *Package) MarshalJSON() ([]byte, error) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return json.Marshal((*packageJSON)(p))
+}
+
+// Copy returns the copy of the package, which is safe to read while its mirror is created
+func (p *Package) Copy() *Package {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	c := &Package{
+		Name:       p.Name,
+		Date:       p.Date,
+		Release:    p.Release,
+		Suffix:     p.Suffix,
+		OriginURL:  p.OriginURL,
+		MD5URL:     p.MD5URL,
+		LocalURL:   p.LocalURL,
+		RemoteURL:  p.RemoteURL,
+		RemoteBy:   p.RemoteBy,
+		MD5:        p.MD5,
+		Unverified: p.Unverified,
+		Size:       p.Size,
+		Platform:   p.Platform,
+		Android:    p.Android,
+		Variant:    p.Variant,
+		Stats:      p.Stats,
+	}
+	if p.Tags != nil {
+		c.Tags = make(map[string]string, len(p.Tags))
+		for k, v := range p.Tags {
+			c.Tags[k] = v
+		}
+	}
+	return c
+}
+
+// mirrorURLs safely returns the local and remote mirror URLs of the package
+func (p *Package) mirrorURLs() (localURL, remoteURL string) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.LocalURL, p.RemoteURL
+}
+
+// checksum safely returns the package MD5 checksum and whether the mirror doesn't match it
+func (p *Package) checksum() (md5sum string, unverified bool) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.MD5, p.Unverified
+}
+
+// setRemote safely sets the remote mirror of the package
+func (p *Package) setRemote(remoteURL, remoteBy string) {
+	p.mtx.Lock()
+	p.RemoteURL, p.RemoteBy = remoteURL, remoteBy
+	p.mtx.Unlock()
+}
+
+// dropLocal safely forgets the local mirror of the package, when its file is removed
+func (p *Package) dropLocal() {
+	p.mtx.Lock()
+	p.LocalURL = ""
+	p.mtx.Unlock()
+}
+
+// MirrorStats describes the durations of the package network transfers during the mirror creation.
+// Streamed upload is counted as the download, as they're done at once.
+type MirrorStats struct {
+	DownloadDuration time.Duration
+	UploadDuration   time.Duration
+	Bytes            int64
+}
+
+// Duration returns the total duration of the transfers
+func (s MirrorStats) Duration() time.Duration {
+	return s.DownloadDuration + s.UploadDuration
+}
+
+// Speed returns the effective transfer speed in bytes per second, or 0 if it's unknown
+func (s MirrorStats) Speed() int64 {
+	if s.Duration() <= 0 {
+		return 0
+	}
+	return int64(float64(s.Bytes) / s.Duration().Seconds())
+}
+
+// SetTag sets the custom metadata tag for the package
+func (p *Package) SetTag(key, value string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.Tags == nil {
+		p.Tags = make(map[string]string)
+	}
+	p.Tags[key] = value
+}
+
+// Tag returns the custom metadata tag value for the package
+func (p *Package) Tag(key string) (string, bool) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	value, ok := p.Tags[key]
+	return value, ok
+}
+
+// DeleteTag removes the custom metadata tag from the package
+func (p *Package) DeleteTag(key string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.Tags, key)
+}
+
+// Mirrored checks if the package already has the configured mirrors
+func (p *Package) Mirrored(cfg *viper.Viper) bool {
+	localURL, remoteURL := p.mirrorURLs()
+	return cfg.GetString("gapps.local_url") != "" && localURL != "" ||
+		len(remoteProviders(cfg)) > 0 && remoteURL != ""
+}
+
+// BestURL returns the preferred download URL for the package: local, remote or origin one
+func (p *Package) BestURL() string {
+	localURL, remoteURL := p.mirrorURLs()
+	switch {
+	case localURL != "":
+		return localURL
+	case remoteURL != "":
+		return remoteURL
+	default:
+		return p.OriginURL
+	}
+}
+
+// Link kinds
+const (
+	LinkOrigin = "origin"
+	LinkLocal  = "local"
+	LinkRemote = "remote"
+)
+
+// Link describes a single download source of the package
+type Link struct {
+	Kind  string
+	Label string
+	URL   string
+	MD5   string
+	Size  string
+}
+
+// Links returns all the available download sources of the package: origin, local and remote ones.
+// Mirrors are labeled with gapps.local_host and gapps.remote_host, or with their URL hosts.
+func (p *Package) Links(cfg *viper.Viper) []Link {
+	localURL, remoteURL := p.mirrorURLs()
+	md5sum, _ := p.checksum()
+	sources := []struct{ kind, label, url string }{
+		{LinkOrigin, "Github", p.OriginURL},
+		{LinkLocal, cfg.GetString("gapps.local_host"), localURL},
+		{LinkRemote, cfg.GetString("gapps.remote_host"), remoteURL},
+	}
+
+	var links []Link
+	for _, s := range sources {
+		if s.url == "" {
+			continue
+		}
+		if s.label == "" {
+			if u, err := url.Parse(s.url); err == nil {
+				s.label = u.Hostname()
+			}
+		}
+		links = append(links, Link{Kind: s.kind, Label: s.label, URL: s.url, MD5: md5sum, Size: p.HumanSize()})
+	}
+	return links
+}
+
+// HumanSize returns the package size like "123.4 MiB", or "unknown" if it's not known
+func (p *Package) HumanSize() string {
+	if p.Size <= 0 {
+		return "unknown"
+	}
+	return HumanBytes(int64(p.Size))
+}
+
+// HumanBytes returns the number of bytes like "123.4 MiB"
+func HumanBytes(n int64) string {
+	if n < 1<<10 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	// switch to the next unit before the value is rounded up to 1024.0
+	size, unit := float64(n)/(1<<10), 0
+	for ; size >= 1<<10-0.05 && unit < len(sizeUnits)-1; unit++ {
+		size /= 1 << 10
+	}
+	return fmt.Sprintf("%.1f %s", size, sizeUnits[unit])
+}
+
+// QRCode returns the PNG image of the QR code with the package BestURL
+func (p *Package) QRCode() ([]byte, error) {
+	url := p.BestURL()
+	if url == "" {
+		return nil, fmt.Errorf("package %s has no download URL", p.Name)
+	}
+
+	png, err := qrcode.Encode(url, qrcode.Medium, qrCodeSize)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode QR code: %w", err)
+	}
+	return png, nil
+}
+
+// CheckResult describes the package availability reported by Check
+type CheckResult struct {
+	Size int64
+	MD5  string
+}
+
+// Check checks that the package and its MD5 file are available, without downloading the package.
+// It returns the package size reported by the origin and its official MD5 checksum.
+// Neither the package nor the local and remote mirrors are modified.
+func (p *Package) Check(ctx context.Context, dq *net.DownloadQueue, cfg *viper.Viper) (CheckResult, error) {
+	size, err := dq.Head(ctx, p.OriginURL)
+	if err != nil {
+		return CheckResult{}, fmt.Errorf("package is unavailable: %w", err)
+	}
+	if size < 0 {
+		size = int64(p.Size)
+	} else if p.Size > 0 && size != int64(p.Size) {
+		return CheckResult{}, fmt.Errorf("package size %d doesn't match the release asset size %d", size, p.Size)
+	}
+
+	result := CheckResult{Size: size}
+	result.MD5, _ = p.checksum()
+	if p.MD5URL != "" {
+		if result.MD5, err = getMD5(ctx, dq, cfg, p.MD5URL, ""); err != nil {
+			return CheckResult{}, fmt.Errorf("MD5 file is unavailable: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// CreateMirror creates a new mirror for the package.
+// Mirroring is aborted if ctx is cancelled, and is not started after StopMirrors.
+// If progress is not nil, it receives the package download progress.
+func (p *Package) CreateMirror(ctx context.Context, dq *net.DownloadQueue, cfg *viper.Viper, progress net.ProgressFunc) error {
+	if p.Mirrored(cfg) {
 		return nil
 	}
+	return p.mirror(ctx, dq, cfg, progress, cfg.GetString("gapps.collision_strategy"))
+}
 
-	// download the file
-	filePath, err := dq.AddMultiple(p.OriginURL, p.MD5, 20, p.Size)
+// Remirror recreates the package mirrors even if they already exist,
+// e.g. when the local file is corrupted or the remote link has expired.
+// The package is downloaded again and verified against its MD5 checksum,
+// then the local file is overwritten regardless of gapps.collision_strategy and uploaded again.
+func (p *Package) Remirror(ctx context.Context, dq *net.DownloadQueue, cfg *viper.Viper, progress net.ProgressFunc) error {
+	p.mtx.Lock()
+	p.LocalURL, p.RemoteURL, p.RemoteBy, p.Unverified = "", "", "", false
+	p.mtx.Unlock()
+	return p.mirror(ctx, dq, cfg, progress, CollisionOverwrite)
+}
+
+// mirror tracks the mirror creation and reports its result
+func (p *Package) mirror(ctx context.Context, dq *net.DownloadQueue, cfg *viper.Viper, progress net.ProgressFunc, collision string) (err error) {
+	if !tracker.start() {
+		return ErrShuttingDown
+	}
+	defer func() { tracker.finish(err) }()
+
+	if err = p.createMirror(ctx, dq, cfg, progress, collision); err != nil {
+		events.Emit(events.MirrorFailed, events.Fields{"package": p.Name, "error": err.Error()})
+		metrics.MirrorFailed(failureReason(err))
+		return err
+	}
+
+	c := p.Copy()
+	events.Emit(events.MirrorCreated, events.Fields{"package": c.Name, "local_url": c.LocalURL, "remote_url": c.RemoteURL,
+		"download_duration": c.Stats.DownloadDuration, "upload_duration": c.Stats.UploadDuration})
+	metrics.MirrorCreated(c.Size)
+	notifyMirror(c)
+	return nil
+}
+
+// failureReason returns the short mirror failure reason for the metrics
+func failureReason(err error) string {
+	var uploadErr *UploadError
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "cancelled"
+	case errors.Is(err, ErrMirrorPartial), errors.As(err, &uploadErr):
+		return "upload"
+	case errors.Is(err, net.ErrChecksumMismatch), errors.Is(err, ErrEmptyChecksum), errors.Is(err, ErrInvalidChecksum):
+		return "checksum"
+	case errors.Is(err, net.ErrShortDownload), errors.Is(err, net.ErrLongDownload):
+		return "size"
+	case errors.Is(err, net.ErrBadContentType):
+		return "content_type"
+	case errors.Is(err, ErrBadArchive):
+		return "archive"
+	default:
+		return "other"
+	}
+}
+
+func (p *Package) createMirror(ctx context.Context, dq *net.DownloadQueue, cfg *viper.Viper, progress net.ProgressFunc, collision string) error {
+	// if we don't have the MD5 yet, get it concurrently with the file,
+	// and stop it if the mirror creation is over before the file is downloaded
+	var (
+		md5sum, _ = p.checksum()
+		md5Err    error
+		wg        sync.WaitGroup
+		md5Once   sync.Once
+	)
+	fetchMD5 := md5sum == "" && p.MD5URL != ""
+	md5Ctx, cancelMD5 := context.WithCancel(ctx)
+	defer func() {
+		cancelMD5()
+		wg.Wait()
+	}()
+	startMD5 := func() {
+		if !fetchMD5 {
+			return
+		}
+		md5Once.Do(func() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				md5sum, md5Err = getMD5(md5Ctx, dq, cfg, p.MD5URL, "")
+			}()
+		})
+	}
+
+	// MD5 mismatch is tolerated for the grace hosts, so we verify the file ourselves
+	grace := md5GraceHost(cfg, p.OriginURL)
+	expectedMD5 := md5sum
+	if fetchMD5 || grace {
+		expectedMD5 = ""
+	}
+
+	// the stats are published when the mirror creation is over
+	stats := MirrorStats{Bytes: int64(p.Size)}
+	defer func() {
+		p.mtx.Lock()
+		p.Stats = stats
+		p.mtx.Unlock()
+	}()
+
+	// stream the package right to the remote provider, if it's possible
+	if pr, ok := p.streamProvider(cfg); ok {
+		startMD5()
+		start := time.Now()
+		remoteURL, sum, err := p.stream(ctx, dq, pr, progress)
+		stats.DownloadDuration = time.Since(start)
+		switch {
+		case err == nil:
+			wg.Wait()
+			if md5sum != "" || md5Err != nil {
+				if err = p.verifyChecksum(sum, md5sum, md5Err, grace); err != nil {
+					return p.discardStream(ctx, pr, remoteURL, err)
+				}
+			}
+			p.setRemote(remoteURL, pr.Name())
+			log.Debugf("File streamed, remote URL is %s", remoteURL)
+			return nil
+		case ctx.Err() != nil:
+			return fmt.Errorf("unable to stream to %s: %w", pr.Name(), err)
+		default:
+			log.Warnf("Unable to stream package %s to %s, falling back to the temp file: %v", p.Name, pr.Name(), err)
+		}
+	}
+
+	// check the local storage before the download, so that the disk is not filled with the partial file
+	if localPath := cfg.GetString("gapps.local_path"); localPath != "" {
+		if err := checkDisk(cfg, localPath, int64(p.Size)); err != nil {
+			return fmt.Errorf("unable to store the package locally: %w", err)
+		}
+	}
+
+	// download the file, in segments if it's large enough
+	segments := cfg.GetInt("net.segments")
+	if int64(p.Size) < cfg.GetInt64("net.segment_min_size") {
+		segments = 1
+	}
+	startMD5()
+	start := time.Now()
+	filePath, sum, err := dq.AddMultiple(ctx, p.OriginURL, expectedMD5, segments, p.Size, progress)
+	stats.DownloadDuration = time.Since(start)
 	if err != nil {
 		return fmt.Errorf("unable to read file body: %w", err)
 	}
+	wg.Wait()
 	log.Debugf("Package downloaded to %s", filePath)
 
+	if fetchMD5 || grace {
+		if err = p.verifyChecksum(sum, md5sum, md5Err, grace); err != nil {
+			os.Remove(filePath)
+			return err
+		}
+	}
+
+	// MD5 can be stale, so check that the package can be opened at all
+	if cfg.GetBool("gapps.verify_zip") {
+		if err = verifyArchive(filePath); err != nil {
+			os.Remove(filePath)
+			return fmt.Errorf("unable to verify package %s: %w", p.Name, err)
+		}
+	}
+
 	// if we have local_path set, save the file there
+	var movedLocal bool
 	if localPath := cfg.GetString("gapps.local_path"); localPath != "" {
-		if filePath, err = p.move(filePath, localPath); err != nil {
+		if filePath, err = p.move(cfg, filePath, collision); err != nil {
 			return fmt.Errorf("unable to move the file to storage: %w", err)
 		}
+		movedLocal = true
 		log.Debugf("Package moved to %s", filePath)
 
 		// if we have local_url set, provide the local server URL
-		if localURL := cfg.GetString("gapps.local_url"); localURL != "" {
-			relPath := strings.TrimPrefix(filePath, localPath)
-			p.LocalURL = fmt.Sprintf(localURL, relPath)
-			log.Debugf("Local URL is %s", p.LocalURL)
-		}
+		p.setLocalURL(cfg, filePath)
 	} else {
 		// delete the file in the end otherwise
 		log.Debug("Temp file will be deleted")
 		defer os.Remove(filePath)
 	}
 
-	// if we have remote_url set, send the file to remote URL
-	if remoteURL := cfg.GetString("gapps.remote_url"); remoteURL != "" {
-		tmpFile, err := os.Open(filePath)
+	// if we have remote providers set, send the file to the first suitable one that works
+	if providers := remoteProviders(cfg); len(providers) > 0 {
+		start = time.Now()
+		err = p.upload(ctx, providers, filePath)
+		stats.UploadDuration = time.Since(start)
 		if err != nil {
-			return fmt.Errorf("unable to create temp file: %w", err)
+			return &MirrorError{LocalDone: movedLocal, Err: err}
 		}
-		defer tmpFile.Close()
+	}
 
-		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf(remoteURL, p.Name), tmpFile)
-		if err != nil {
-			return fmt.Errorf("unable to create upload request: %w", err)
+	return nil
+}
+
+// upload sends the package file to the suitable remote providers in order until one of them succeeds.
+// If all of them fail, UploadError with every failure is returned.
+// The upload is aborted without trying the next providers if ctx is cancelled.
+func (p *Package) upload(ctx context.Context, providers []provider, filePath string) error {
+	suitable := suitableProviders(providers, int64(p.Size))
+	if len(suitable) == 0 {
+		return fmt.Errorf("no remote provider accepts the file of size %d", p.Size)
+	}
+
+	tmpFile, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("unable to create temp file: %w", err)
+	}
+	defer tmpFile.Close()
+
+	uploadErr := &UploadError{}
+	for _, pr := range suitable {
+		log.Infof("Uploading package %s to %s", p.Name, pr.Name())
+		// the previous attempt has consumed the file
+		if _, err = tmpFile.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("unable to rewind temp file: %w", err)
 		}
-		req.Header.Set("Content-Type", "application/zip")
-		req.Header.Set("Max-Days", "7")
 
-		resp, err := http.DefaultClient.Do(req)
+		remoteURL, err := pr.Upload(ctx, p, tmpFile)
+		if err != nil && ctx.Err() != nil {
+			return fmt.Errorf("upload to %s is aborted: %w", pr.Name(), ctx.Err())
+		}
 		if err != nil {
-			return fmt.Errorf("unable to make upload request: %w", err)
+			log.Warnf("Unable to upload package %s to %s: %v", p.Name, pr.Name(), err)
+			uploadErr.add(pr.Name(), err)
+			continue
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("unable to make upload request: %v", resp.Status)
-		}
+		p.setRemote(remoteURL, pr.Name())
+		log.Debugf("File uploaded to %s, remote URL is %s", pr.Name(), remoteURL)
+		return nil
+	}
+	return uploadErr
+}
 
-		result, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("unable to read mirror response body: %w", err)
+// streamProvider returns the provider to stream the package to.
+// Streaming is possible only if it's enabled, there's no local storage,
+// the package archive isn't verified, the package size is known and the chosen provider supports it.
+func (p *Package) streamProvider(cfg *viper.Viper) (streamProvider, bool) {
+	if !cfg.GetBool("gapps.stream_upload") || cfg.GetString("gapps.local_path") != "" || cfg.GetBool("gapps.verify_zip") || p.Size <= 0 {
+		return nil, false
+	}
+
+	pr, err := selectProvider(remoteProviders(cfg), int64(p.Size))
+	if err != nil {
+		return nil, false
+	}
+	sp, ok := pr.(streamProvider)
+	if !ok {
+		log.Debugf("Provider %s doesn't support streaming, using the temp file", pr.Name())
+	}
+	return sp, ok
+}
+
+// stream uploads the package from the origin to the provider, computing its MD5 on the fly
+func (p *Package) stream(ctx context.Context, dq *net.DownloadQueue, pr streamProvider, progress net.ProgressFunc) (string, string, error) {
+	log.Infof("Streaming package %s to %s", p.Name, pr.Name())
+	body, err := dq.Stream(ctx, p.OriginURL, int64(p.Size))
+	if err != nil {
+		return "", "", fmt.Errorf("unable to open the origin: %w", err)
+	}
+	defer body.Close()
+
+	var streamed net.Progress
+	streamed.SetTotal(int64(p.Size))
+	if progress != nil {
+		stop := streamed.Report(progress)
+		defer stop()
+	}
+
+	hash := md5.New()
+	remoteURL, err := pr.Stream(ctx, p, io.TeeReader(streamed.Reader(body), hash), int64(p.Size))
+	if err != nil {
+		return "", "", err
+	}
+	return remoteURL, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// discardStream deletes the streamed package which has failed the verification from the provider.
+// If the provider can't delete it, the mirror is kept but marked as unverified,
+// and the MirrorError with the remote mirror done is returned.
+func (p *Package) discardStream(ctx context.Context, pr streamProvider, remoteURL string, verifyErr error) error {
+	if d, ok := pr.(deleter); ok {
+		err := d.Delete(ctx, p)
+		if err == nil {
+			log.Warnf("Streamed package %s has failed the verification and is deleted from %s", p.Name, pr.Name())
+			return fmt.Errorf("streamed package is deleted from %s: %w", pr.Name(), verifyErr)
 		}
+		log.Errorf("Unable to delete the streamed package %s from %s: %v", p.Name, pr.Name(), err)
+	}
+
+	log.Warnf("Streamed package %s has failed the verification and is kept on %s as unverified", p.Name, pr.Name())
+	p.mtx.Lock()
+	p.RemoteURL, p.RemoteBy, p.Unverified = remoteURL, pr.Name(), true
+	p.mtx.Unlock()
+	return &MirrorError{RemoteDone: true, Err: fmt.Errorf("streamed package is kept on %s as unverified: %w", pr.Name(), verifyErr)}
+}
+
+// verifyChecksum checks the computed MD5 sum of the package against the official one
+func (p *Package) verifyChecksum(sum, md5sum string, md5Err error, grace bool) error {
+	if md5Err != nil {
+		return fmt.Errorf("unable to download md5: %w", md5Err)
+	}
 
-		p.RemoteURL = string(result)
-		log.Debugf("File uploaded, remote URL is %s", p.RemoteURL)
+	var unverified bool
+	switch {
+	case sum == md5sum:
+	case grace:
+		log.Warnf("Checksum mismatch for package %s from the grace host, the mirror will be unverified", p.Name)
+		unverified = true
+	default:
+		return &net.ChecksumError{Got: sum, Want: md5sum}
 	}
 
+	p.mtx.Lock()
+	p.MD5, p.Unverified = md5sum, unverified
+	p.mtx.Unlock()
+	knownChecksums.add(p)
 	return nil
 }
 
-func (p *Package) move(origin, destFolder string) (string, error) {
-	path := destFolder + p.Platform.String() + "/" + p.Date
-	if err := os.MkdirAll(path, 0755); err != nil {
+// md5GraceHost checks if the URL host is in the gapps.md5_grace_hosts list
+func md5GraceHost(cfg *viper.Viper, rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	for _, host := range cfg.GetStringSlice("gapps.md5_grace_hosts") {
+		if strings.EqualFold(u.Hostname(), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// setLocalURL sets the local server URL for the file in local storage, if we have local_url set
+func (p *Package) setLocalURL(cfg *viper.Viper, filePath string) {
+	if localURL := cfg.GetString("gapps.local_url"); localURL != "" {
+		relPath := strings.TrimPrefix(filePath, cfg.GetString("gapps.local_path"))
+		localURL = fmt.Sprintf(localURL, relPath)
+		p.mtx.Lock()
+		p.LocalURL = localURL
+		p.mtx.Unlock()
+		log.Debugf("Local URL is %s", localURL)
+	}
+}
+
+// localPath returns the package file path in the local storage
+func (p *Package) localPath(root string) string {
+	return root + p.Platform.String() + "/" + p.Date + "/" + p.Name
+}
+
+// move moves the package file to the local storage.
+// If the file already exists there, the collision strategy is applied.
+// The destination path is locked with lockPath while it's written, so that it's not
+// replaced or removed concurrently by the retention cleaner or another bot instance.
+func (p *Package) move(cfg *viper.Viper, origin, collision string) (string, error) {
+	path := p.localPath(cfg.GetString("gapps.local_path"))
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(cfg.GetUint32("gapps.dir_mode"))); err != nil {
 		return "", fmt.Errorf("unable to create folder: %w", err)
 	}
 
-	path += "/" + p.Name
-	if err := os.Rename(origin, path); err != nil {
+	unlock, err := lockPath(cfg, path)
+	if err != nil {
+		return "", fmt.Errorf("unable to lock the file: %w", err)
+	}
+	defer unlock()
+
+	var replace bool
+	replace, err = p.resolveCollision(collision, origin, path)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve file collision: %w", err)
+	}
+	if !replace {
+		log.Debugf("Keeping the existing file %s", path)
+		if err = os.Remove(origin); err != nil {
+			return "", fmt.Errorf("unable to remove the new file: %w", err)
+		}
+		return path, nil
+	}
+
+	mode := os.FileMode(cfg.GetUint32("gapps.file_mode"))
+	if err := os.Rename(origin, path); errors.Is(err, syscall.EXDEV) {
+		// temp dir and local_path are on the different filesystems
+		log.Debugf("Unable to rename %s, copying it instead", origin)
+		if err = moveFile(origin, path, mode); err != nil {
+			return "", fmt.Errorf("unable to copy file: %w", err)
+		}
+	} else if err != nil {
 		return "", fmt.Errorf("unable to move file: %w", err)
 	}
 
-	if err := os.Chmod(path, 0755); err != nil {
+	if err := os.Chmod(path, mode); err != nil {
 		return "", fmt.Errorf("unable to set file permissions: %w", err)
 	}
 
+	events.Emit(events.PackageMoved, events.Fields{"package": p.Name, "path": path})
 	return path, nil
 }
 
-func formPackage(dq *net.DownloadQueue, cfg *viper.Viper, zipAsset, md5Asset github.ReleaseAsset) (*Package, error) {
-	md5sum, err := getMD5(dq, md5Asset.GetBrowserDownloadURL())
+// moveFile copies the file to the temp one next to the destination, renames it to the destination
+// and removes the source, so that the partially copied file never appears in its place
+func moveFile(src, dest string, mode os.FileMode) error {
+	source, err := os.Open(src)
 	if err != nil {
-		return nil, fmt.Errorf("unable to download md5: %w", err)
+		return fmt.Errorf("unable to open source file: %w", err)
 	}
+	defer source.Close()
 
-	p, err := parseAsset(cfg, zipAsset, md5sum)
+	tmpPath := dest + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return fmt.Errorf("unable to create destination file: %w", err)
+	}
+	if _, err = io.Copy(tmpFile, source); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("unable to write destination file: %w", err)
+	}
+	if err = tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("unable to write destination file: %w", err)
+	}
+
+	if err = os.Rename(tmpPath, dest); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("unable to rename destination file: %w", err)
+	}
+	if err = os.Remove(src); err != nil {
+		log.Warnf("Unable to remove the source file %s: %v", src, err)
+	}
+	return nil
+}
+
+// resolveCollision checks if the new file should replace the existing one
+func (p *Package) resolveCollision(strategy, newPath, existingPath string) (bool, error) {
+	if _, err := os.Stat(existingPath); os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to stat the existing file: %w", err)
+	}
+
+	switch strategy {
+	case CollisionSkip:
+		return false, nil
+	case CollisionVerify:
+		md5sum, unverified := p.checksum()
+		if md5sum == "" || unverified {
+			return false, nil
+		}
+		newSum, err := hashFile(newPath)
+		if err != nil {
+			return false, err
+		}
+		if newSum != md5sum {
+			log.Warnf("New file for package %s doesn't match MD5, keeping the existing one", p.Name)
+			return false, nil
+		}
+		existingSum, err := hashFile(existingPath)
+		if err != nil {
+			return false, err
+		}
+		return existingSum != newSum, nil
+	default:
+		return true, nil
+	}
+}
+
+func formPackage(ctx context.Context, dq *net.DownloadQueue, cfg *viper.Viper, releaseTag string, zipAsset, md5Asset github.ReleaseAsset, checksums map[string]string, budget *net.RetryBudget) (*Package, error) {
+	p, err := parseAsset(cfg, releaseTag, zipAsset)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create package: %w", err)
 	}
 
+	// if we have the checksum aggregate, the MD5 file must be listed in it
+	var md5FileSum string
+	if checksums != nil {
+		var ok bool
+		if md5FileSum, ok = checksums[md5Asset.GetName()]; !ok {
+			return nil, fmt.Errorf("MD5 file %s is missing from the checksum aggregate", md5Asset.GetName())
+		}
+	}
+
+	if err = filterPackage(cfg, p); err != nil {
+		return nil, err
+	}
+
+	// the mislabeled or corrupted asset is only reported, unless it has to be rejected
+	if err = checkSizeBounds(cfg, p); err != nil {
+		if cfg.GetBool("gapps.size_bounds_reject") {
+			return nil, err
+		}
+		log.WithField("package", p.Name).Warn(err)
+	}
+
+	if md5Asset.GetBrowserDownloadURL() == "" {
+		return nil, fmt.Errorf("no MD5 file available for package %s", p.Name)
+	}
+
+	// MD5 is downloaded on mirroring concurrently with the package,
+	// unless it has to be verified against the checksum aggregate now
+	p.MD5URL = md5Asset.GetBrowserDownloadURL()
+	if sum, ok := knownChecksums.get(p.MD5URL); ok {
+		log.Debugf("MD5 for package %s is cached", p.Name)
+		p.MD5 = sum
+		return p, nil
+	}
+	if checksums == nil {
+		return p, nil
+	}
+	err = budget.RetryIf(scanAttempts, func(err error) bool { return retryableMD5(ctx, err) }, func() (mErr error) {
+		p.MD5, mErr = getMD5(ctx, dq, cfg, p.MD5URL, md5FileSum)
+		return mErr
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to download md5: %w", err)
+	}
+
 	return p, nil
 }
 
-func getMD5(dq *net.DownloadQueue, url string) (string, error) {
-	filePath, err := dq.AddSingle(url)
+// retryableMD5 reports if getMD5 can be retried after the error: the MD5 file download failures are,
+// but the downloaded file with no valid checksum or the one not matching the aggregate is not
+func retryableMD5(ctx context.Context, err error) bool {
+	var checksumErr *net.ChecksumError
+	return ctx.Err() == nil && !errors.Is(err, ErrEmptyChecksum) && !errors.Is(err, ErrInvalidChecksum) && !errors.As(err, &checksumErr)
+}
+
+// getMD5 downloads the MD5 file and returns the checksum from it.
+// If fileSum is not empty, the MD5 file itself is verified against it first.
+func getMD5(ctx context.Context, dq *net.DownloadQueue, cfg *viper.Viper, rawURL, fileSum string) (string, error) {
+	filePath, err := dq.AddSingle(ctx, rawURL)
 	if err != nil {
 		return "", fmt.Errorf("unable to download MD5 file: %w", err)
 	}
+	defer os.Remove(filePath)
 
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -151,45 +928,182 @@ func getMD5(dq *net.DownloadQueue, url string) (string, error) {
 		return "", fmt.Errorf("unable to read MD5 file: %w", err)
 	}
 
-	return strings.Split(string(result), "  ")[0], nil
+	if fileSum != "" {
+		if sum := fmt.Sprintf("%x", md5.Sum(result)); sum != fileSum {
+			return "", fmt.Errorf("MD5 file doesn't match the checksum aggregate: %w", &net.ChecksumError{Got: sum, Want: fileSum})
+		}
+	}
+
+	var separator string
+	if u, err := url.Parse(rawURL); err == nil {
+		separator = cfg.GetStringMapString("gapps.md5_separators")[strings.ToLower(u.Hostname())]
+	}
+
+	checksum := parseChecksum(string(result), separator)
+	if err = validateMD5(checksum); err != nil {
+		return "", err
+	}
+	return checksum, nil
 }
 
-// Package name format is as follows:
-// open_gapps-Platform-Android-Variant-Date.zip
-func parseAsset(cfg *viper.Viper, asset github.ReleaseAsset, md5Sum string) (*Package, error) {
-	name := asset.GetName()
-	parts := strings.Split(strings.TrimPrefix(name, cfg.GetString("gapps.prefix")+gappsSeparator), ".")
-	if len(parts) != 3 {
-		return nil, fmt.Errorf("incorrect package name: %s", name)
+// parseChecksum extracts the checksum from the MD5 file body.
+// If the separator is set and found in the body, the checksum is the part before it, if it's valid.
+// Otherwise the first md5sum-like or BSD-style line is used, and the first 32-char hex token
+// is the last resort, so the garbage around the checksum doesn't break it.
+func parseChecksum(body, separator string) string {
+	body = strings.TrimSpace(body)
+	if separator != "" && strings.Contains(body, separator) {
+		if checksum := strings.ToLower(strings.TrimSpace(strings.Split(body, separator)[0])); validateMD5(checksum) == nil {
+			return checksum
+		}
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if checksum, _, ok := parseChecksumLine(line); ok {
+			return checksum
+		}
 	}
+	return strings.ToLower(md5Regexp.FindString(body))
+}
 
-	path, ext := parts[0]+parts[1], parts[2]
-	if ext != "zip" {
-		return nil, fmt.Errorf("incorrect package extension: %s", ext)
+// parseChecksumLine parses the checksum and the file name from the line in md5sum format,
+// with one or two spaces and optional '*' binary mark before the name, or in BSD format:
+// "checksum  name", "checksum *name", "checksum name" or "MD5 (name) = checksum".
+// File name is empty if the line has only the checksum.
+func parseChecksumLine(line string) (checksum, name string, ok bool) {
+	line = strings.TrimSpace(line)
+	if m := md5BSDRegexp.FindStringSubmatch(line); m != nil {
+		return strings.ToLower(m[2]), m[1], true
 	}
 
-	parts = strings.Split(path, gappsSeparator)
-	if len(parts) != 4 {
-		return nil, fmt.Errorf("incorrect package name: %s", name)
+	fields := strings.SplitN(line, " ", 2)
+	if validateMD5(strings.ToLower(fields[0])) != nil {
+		return "", "", false
+	}
+	if len(fields) == 2 {
+		name = strings.TrimPrefix(strings.TrimLeft(fields[1], " "), "*")
 	}
+	return strings.ToLower(fields[0]), name, true
+}
 
-	platform, android, variant, err := gapps.ParsePackageParts(parts[:3])
+// validateMD5 checks that the checksum is a proper 32-char hex string
+func validateMD5(checksum string) error {
+	if checksum == "" {
+		return ErrEmptyChecksum
+	}
+	if len(checksum) != 2*md5.Size {
+		return fmt.Errorf("%w: bad length %d", ErrInvalidChecksum, len(checksum))
+	}
+	if _, err := hex.DecodeString(checksum); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidChecksum, err)
+	}
+	return nil
+}
+
+// getChecksumAggregate downloads the checksum aggregate file and parses it
+// into the map of file names and their MD5 checksums.
+// Aggregate format is the same as the md5sum output: one "checksum  filename" per line,
+// BSD-style lines are supported as well.
+func getChecksumAggregate(ctx context.Context, dq *net.DownloadQueue, url string) (map[string]string, error) {
+	filePath, err := dq.AddSingle(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download checksum aggregate: %w", err)
+	}
+	defer os.Remove(filePath)
+
+	body, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read checksum aggregate: %w", err)
+	}
+
+	checksums := make(map[string]string)
+	for _, line := range strings.Split(string(body), "\n") {
+		if checksum, name, ok := parseChecksumLine(line); ok && name != "" {
+			checksums[name] = checksum
+		}
+	}
+	if len(checksums) == 0 {
+		return nil, errors.New("checksum aggregate is empty")
+	}
+
+	return checksums, nil
+}
+
+// parseAsset creates the package from the asset of the release with the tag
+func parseAsset(cfg *viper.Viper, releaseTag string, asset github.ReleaseAsset) (*Package, error) {
+	p, err := parseName(cfg, asset.GetName())
 	if err != nil {
 		return nil, err
 	}
 
+	p.Release = releaseTag
+	p.OriginURL = asset.GetBrowserDownloadURL()
+	p.Size = asset.GetSize()
+	return p, nil
+}
+
+// Package name format is as follows:
+// open_gapps-Platform-Android-Variant-Date.ext
+// Community builds may have the suffix after the date, like open_gapps-Platform-Android-Variant-Date-beta.ext
+func parseName(cfg *viper.Viper, name string) (*Package, error) {
+	ext := packageExtension(cfg, name)
+	if ext == "" {
+		return nil, fmt.Errorf("%w: %s", ErrBadExtension, name)
+	}
+
+	// unknown platforms, Android versions or variants, which are newer
+	// than the gapps enums, are reported with ErrBadPackageName to be skipped,
+	// along with the wrapped gapps parsing error
+	prefix := packagePrefix(cfg, name)
+	if prefix == "" {
+		return nil, fmt.Errorf("%w: %s", ErrBadPackageName, name)
+	}
+	path := strings.TrimSuffix(strings.TrimPrefix(name, prefix+gappsSeparator), "."+ext)
+	parts := strings.Split(path, gappsSeparator)
+	if len(parts) < 4 {
+		return nil, fmt.Errorf("%w: %s", ErrBadPackageName, name)
+	}
+	parts[1] = strings.Replace(parts[1], ".", "", -1)
+
+	platform, android, variant, err := gapps.ParsePackageParts(parts[:3])
+	if err != nil {
+		return nil, &NameError{Name: name, Err: err}
+	}
+
 	if _, err = time.Parse(cfg.GetString("gapps.time_format"), parts[3]); err != nil {
-		return nil, fmt.Errorf("unable to parse time: %w", err)
+		return nil, fmt.Errorf("%w %s: unable to parse time: %v", ErrBadPackageName, name, err)
 	}
 
 	return &Package{
-		Name:      name,
-		Date:      parts[3],
-		OriginURL: asset.GetBrowserDownloadURL(),
-		MD5:       md5Sum,
-		Size:      asset.GetSize(),
-		Platform:  platform,
-		Android:   android,
-		Variant:   variant,
+		Name:     name,
+		Date:     parts[3],
+		Suffix:   strings.Join(parts[4:], gappsSeparator),
+		Platform: platform,
+		Android:  android,
+		Variant:  variant,
 	}, nil
 }
+
+// packagePrefix returns the longest package name prefix, gapps.prefix or the one from the gapps.extra_prefixes list,
+// which the name has, like "open_gapps-unofficial" rather than "open_gapps", or an empty string if it has none of them
+func packagePrefix(cfg *viper.Viper, name string) string {
+	var result string
+	prefixes := append([]string{cfg.GetString("gapps.prefix")}, cfg.GetStringSlice("gapps.extra_prefixes")...)
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(name, prefix+gappsSeparator) && len(prefix) > len(result) {
+			result = prefix
+		}
+	}
+	return result
+}
+
+// packageExtension returns the longest package file extension from the gapps.extensions list
+// which the file has, like "tar.gz" rather than "gz", or an empty string if it has none of them
+func packageExtension(cfg *viper.Viper, name string) string {
+	var result string
+	for _, ext := range cfg.GetStringSlice("gapps.extensions") {
+		if strings.HasSuffix(name, "."+ext) && len(ext) > len(result) {
+			result = ext
+		}
+	}
+	return result
+}
@@ -0,0 +1,752 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/net"
+
+	"github.com/google/go-github/v29/github"
+	"github.com/spf13/viper"
+)
+
+// testConfig returns the config with the default package name settings
+func testConfig() *viper.Viper {
+	cfg := viper.New()
+	cfg.Set("gapps.prefix", "open_gapps")
+	cfg.Set("gapps.time_format", "20060102")
+	cfg.Set("gapps.extensions", []string{"zip"})
+	return cfg
+}
+
+func TestParseAssetExtensions(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions []string
+		asset      string
+		wantErr    error
+		wantDate   string
+	}{
+		{
+			name:     "default zip",
+			asset:    "open_gapps-arm64-10.0-nano-20200101.zip",
+			wantDate: "20200101",
+		},
+		{
+			name:    "tar.gz is not allowed by default",
+			asset:   "open_gapps-arm64-10.0-nano-20200101.tar.gz",
+			wantErr: ErrBadExtension,
+		},
+		{
+			name:    "MD5 file of the zip",
+			asset:   "open_gapps-arm64-10.0-nano-20200101.zip.md5",
+			wantErr: ErrBadExtension,
+		},
+		{
+			name:       "tar.gz allowed",
+			extensions: []string{"zip", "tar.gz"},
+			asset:      "open_gapps-arm64-10.0-nano-20200101.tar.gz",
+			wantDate:   "20200101",
+		},
+		{
+			name:       "longest extension wins",
+			extensions: []string{"gz", "tar.gz"},
+			asset:      "open_gapps-arm64-10.0-nano-20200101.tar.gz",
+			wantDate:   "20200101",
+		},
+		{
+			name:       "only the last extension allowed",
+			extensions: []string{"gz"},
+			asset:      "open_gapps-arm64-10.0-nano-20200101.tar.gz",
+			wantErr:    ErrBadPackageName,
+		},
+		{
+			name:       "MD5 file with md5 not allowed",
+			extensions: []string{"zip", "tar.gz"},
+			asset:      "open_gapps-arm64-10.0-nano-20200101.tar.gz.md5",
+			wantErr:    ErrBadExtension,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			if tt.extensions != nil {
+				cfg.Set("gapps.extensions", tt.extensions)
+			}
+			asset := github.ReleaseAsset{
+				Name:               github.String(tt.asset),
+				BrowserDownloadURL: github.String("https://github.com/download/" + tt.asset),
+				Size:               github.Int(1024),
+			}
+
+			p, err := parseAsset(cfg, "20200101", asset)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseAsset() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if p.Date != tt.wantDate || p.Name != tt.asset || p.Size != 1024 || p.OriginURL != asset.GetBrowserDownloadURL() {
+				t.Errorf("parseAsset() = %+v", p)
+			}
+			if p.Platform != gapps.PlatformArm64 || p.Android != gapps.Android100 || p.Variant != gapps.VariantNano {
+				t.Errorf("parseAsset() parts = %s %s %s", p.Platform, p.Android, p.Variant)
+			}
+		})
+	}
+}
+
+const (
+	testMD5      = "0123456789abcdef0123456789abcdef"
+	testOtherMD5 = "fedcba9876543210fedcba9876543210"
+)
+
+func TestParseChecksumLine(t *testing.T) {
+	tests := []struct {
+		name         string
+		line         string
+		wantOK       bool
+		wantChecksum string
+		wantName     string
+	}{
+		{"md5sum text", testMD5 + "  open_gapps.zip", true, testMD5, "open_gapps.zip"},
+		{"md5sum binary", testMD5 + " *open_gapps.zip", true, testMD5, "open_gapps.zip"},
+		{"single space", testMD5 + " open_gapps.zip", true, testMD5, "open_gapps.zip"},
+		{"upper case", strings.ToUpper(testMD5) + "  open_gapps.zip", true, testMD5, "open_gapps.zip"},
+		{"surrounding spaces", "  " + testMD5 + "  open_gapps.zip\r", true, testMD5, "open_gapps.zip"},
+		{"checksum only", testMD5, true, testMD5, ""},
+		{"BSD", "MD5 (open_gapps.zip) = " + testMD5, true, testMD5, "open_gapps.zip"},
+		{"short checksum", testMD5[:31] + "  open_gapps.zip", false, "", ""},
+		{"not hex", "z" + testMD5[1:] + "  open_gapps.zip", false, "", ""},
+		{"garbage", "<html>Not Found</html>", false, "", ""},
+		{"empty", "", false, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checksum, name, ok := parseChecksumLine(tt.line)
+			if ok != tt.wantOK || checksum != tt.wantChecksum || name != tt.wantName {
+				t.Errorf("parseChecksumLine(%q) = %q, %q, %t, want %q, %q, %t",
+					tt.line, checksum, name, ok, tt.wantChecksum, tt.wantName, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		separator string
+		want      string
+	}{
+		{"md5sum", testMD5 + "  open_gapps.zip\n", "", testMD5},
+		{"md5sum binary", testMD5 + " *open_gapps.zip\n", "", testMD5},
+		{"BSD", "MD5 (open_gapps.zip) = " + testMD5 + "\n", "", testMD5},
+		{"checksum only", testMD5 + "\n", "", testMD5},
+		{"CRLF lines", "# comment\r\n" + testMD5 + "  open_gapps.zip\r\n", "", testMD5},
+		{"separator", testMD5 + "|open_gapps.zip", "|", testMD5},
+		{"separator not found", testMD5 + "  open_gapps.zip", "|", testMD5},
+		{"separator with invalid checksum", "bad|" + testMD5, "|", testMD5},
+		{"separator before the md5sum line", testMD5 + ":a.zip\n" + testOtherMD5 + "  b.zip", ":", testMD5},
+		{"md5sum line without separator", testMD5 + ":a.zip\n" + testOtherMD5 + "  b.zip", "", testOtherMD5},
+		{"garbage around", "<pre>md5: " + testMD5 + "</pre>", "", testMD5},
+		{"no checksum", "<html>Not Found</html>", "", ""},
+		{"empty", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseChecksum(tt.body, tt.separator); got != tt.want {
+				t.Errorf("parseChecksum(%q, %q) = %q, want %q", tt.body, tt.separator, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetMD5Separator(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMD5+":open_gapps.zip\n"+testOtherMD5+"  open_gapps.zip.md5\n")
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		separators map[string]string
+		want       string
+	}{
+		{"no separator", nil, testOtherMD5},
+		{"separator of the other host", map[string]string{"example.com": ":"}, testOtherMD5},
+		{"separator of the host", map[string]string{u.Hostname(): ":"}, testMD5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Set("gapps.md5_separators", tt.separators)
+
+			got, err := getMD5(context.Background(), net.NewQueue(1), cfg, srv.URL+"/open_gapps.zip.md5", "")
+			if err != nil {
+				t.Fatalf("getMD5() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("getMD5() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateMirrorStreamMismatch(t *testing.T) {
+	content := []byte(strings.Repeat("gapps", 1024))
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content)
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		name         string
+		deleteStatus int
+		wantDeleted  bool
+	}{
+		{"deleted", http.StatusNoContent, true},
+		{"already missing", http.StatusNotFound, true},
+		{"kept unverified", http.StatusForbidden, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deletes int32
+			dav := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.Method {
+				case "MKCOL":
+					w.WriteHeader(http.StatusCreated)
+				case http.MethodPut:
+					io.Copy(ioutil.Discard, r.Body)
+					w.WriteHeader(http.StatusCreated)
+				case http.MethodDelete:
+					atomic.AddInt32(&deletes, 1)
+					w.WriteHeader(tt.deleteStatus)
+				default:
+					w.WriteHeader(http.StatusMethodNotAllowed)
+				}
+			}))
+			defer dav.Close()
+
+			cfg := testConfig()
+			cfg.Set("gapps.stream_upload", true)
+			cfg.Set("gapps.webdav.url", dav.URL)
+			p := &Package{
+				Name:      "open_gapps-arm64-10.0-nano-20200101.zip",
+				Date:      "20200101",
+				OriginURL: origin.URL + "/open_gapps-arm64-10.0-nano-20200101.zip",
+				MD5:       testMD5,
+				Size:      len(content),
+				Platform:  gapps.PlatformArm64,
+				Android:   gapps.Android100,
+				Variant:   gapps.VariantNano,
+			}
+
+			err := p.createMirror(context.Background(), net.NewQueue(1), cfg, nil, CollisionOverwrite)
+			if !errors.Is(err, net.ErrChecksumMismatch) {
+				t.Fatalf("createMirror() error = %v, want %v", err, net.ErrChecksumMismatch)
+			}
+			if atomic.LoadInt32(&deletes) != 1 {
+				t.Errorf("got %d delete requests, want 1", deletes)
+			}
+			if partial := errors.Is(err, ErrMirrorPartial); partial == tt.wantDeleted {
+				t.Errorf("createMirror() error = %v, partial = %t", err, partial)
+			}
+			if tt.wantDeleted && (p.RemoteURL != "" || p.Unverified) {
+				t.Errorf("deleted package has remote URL %q, unverified %t", p.RemoteURL, p.Unverified)
+			}
+			if !tt.wantDeleted && (p.RemoteURL == "" || p.RemoteBy != "webdav" || !p.Unverified) {
+				t.Errorf("kept package has remote URL %q by %q, unverified %t", p.RemoteURL, p.RemoteBy, p.Unverified)
+			}
+		})
+	}
+}
+
+func TestPackageConcurrentMirror(t *testing.T) {
+	content := []byte(strings.Repeat("gapps", 4096))
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "open_gapps.zip", time.Time{}, bytes.NewReader(content))
+	}))
+	defer origin.Close()
+
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig()
+	cfg.Set("net.segments", 2)
+	cfg.Set("gapps.local_path", dir+"/")
+	cfg.Set("gapps.local_url", "https://mirror.local/%s")
+	cfg.Set("gapps.dir_mode", 0755)
+	cfg.Set("gapps.file_mode", 0644)
+	p := &Package{
+		Name:      "open_gapps-arm64-10.0-nano-20200101.zip",
+		Date:      "20200101",
+		OriginURL: origin.URL + "/open_gapps-arm64-10.0-nano-20200101.zip",
+		MD5:       fmt.Sprintf("%x", md5.Sum(content)),
+		Size:      len(content),
+		Platform:  gapps.PlatformArm64,
+		Android:   gapps.Android100,
+		Variant:   gapps.VariantNano,
+	}
+
+	// the mirror is created repeatedly while the package is read, encoded and pruned
+	done := make(chan error)
+	go func() {
+		defer close(done)
+		dq := net.NewQueue(2, net.WithTempDir(dir))
+		for i := 0; i < 5; i++ {
+			if err := p.createMirror(context.Background(), dq, cfg, nil, CollisionOverwrite); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case err, ok := <-done:
+			if ok {
+				t.Fatalf("createMirror() error = %v", err)
+			}
+			running = false
+		default:
+		}
+
+		c := p.Copy()
+		if c.Name != p.Name || c.Size != p.Size {
+			t.Fatalf("Copy() = %+v", c)
+		}
+		if _, err := json.Marshal(p); err != nil {
+			t.Fatalf("json.Marshal() error = %v", err)
+		}
+		p.Mirrored(cfg)
+		p.BestURL()
+		p.Links(cfg)
+		p.SetTag(PinnedTag, "")
+		p.Tag(PinnedTag)
+		p.DeleteTag(PinnedTag)
+		p.dropLocal()
+	}
+
+	p.setLocalURL(cfg, p.localPath(dir+"/"))
+	if !p.Mirrored(cfg) || p.Copy().Stats.Bytes != int64(len(content)) {
+		t.Errorf("package is not mirrored: %+v", p.Copy())
+	}
+}
+
+func TestMirrorErrorLocalDone(t *testing.T) {
+	content := []byte(strings.Repeat("gapps", 1024))
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "open_gapps.zip", time.Time{}, bytes.NewReader(content))
+	}))
+	defer origin.Close()
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer remote.Close()
+
+	tests := []struct {
+		name          string
+		localPath     bool
+		localURL      string
+		wantLocalDone bool
+	}{
+		{"no local storage", false, "", false},
+		{"local storage", true, "https://mirror.local/%s", true},
+		{"local storage without URL", true, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "mirror")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			cfg := testConfig()
+			cfg.Set("net.segments", 1)
+			cfg.Set("gapps.remote_url", remote.URL+"/%s")
+			cfg.Set("gapps.dir_mode", 0755)
+			cfg.Set("gapps.file_mode", 0644)
+			if tt.localPath {
+				cfg.Set("gapps.local_path", dir+"/")
+				cfg.Set("gapps.local_url", tt.localURL)
+			}
+			p := &Package{
+				Name:      "open_gapps-arm64-10.0-nano-20200101.zip",
+				Date:      "20200101",
+				OriginURL: origin.URL + "/open_gapps-arm64-10.0-nano-20200101.zip",
+				MD5:       fmt.Sprintf("%x", md5.Sum(content)),
+				Size:      len(content),
+				Platform:  gapps.PlatformArm64,
+			}
+
+			dq := net.NewQueue(1, net.WithTempDir(dir))
+			err = p.createMirror(context.Background(), dq, cfg, nil, CollisionOverwrite)
+			var mirrorErr *MirrorError
+			if !errors.As(err, &mirrorErr) {
+				t.Fatalf("createMirror() error = %v, want MirrorError", err)
+			}
+			if mirrorErr.LocalDone != tt.wantLocalDone || mirrorErr.RemoteDone {
+				t.Errorf("MirrorError = %+v, want local done %t", mirrorErr, tt.wantLocalDone)
+			}
+			if errors.Is(err, ErrMirrorPartial) != tt.wantLocalDone {
+				t.Errorf("createMirror() error = %v, partial = %t", err, !tt.wantLocalDone)
+			}
+		})
+	}
+}
+
+func TestFormPackageMD5Retries(t *testing.T) {
+	const name = "open_gapps-arm64-10.0-nano-20200101.zip"
+	tests := []struct {
+		name         string
+		failures     int
+		body         string
+		aggregate    string
+		wantAttempts int32
+		wantFail     bool
+		wantErr      error
+		wantMD5      string
+	}{
+		{name: "deferred to mirroring", body: testMD5 + "  " + name, wantAttempts: 0},
+		{name: "valid", body: testMD5 + "  " + name, aggregate: fmt.Sprintf("%x", md5.Sum([]byte(testMD5+"  "+name))), wantAttempts: 1, wantMD5: testMD5},
+		{name: "transport errors", failures: 2, body: testMD5 + "  " + name, aggregate: fmt.Sprintf("%x", md5.Sum([]byte(testMD5+"  "+name))), wantAttempts: 3, wantMD5: testMD5},
+		{name: "transport errors persist", failures: scanAttempts, aggregate: testOtherMD5, wantAttempts: scanAttempts, wantFail: true},
+		{name: "empty checksum", body: "<html>Not Found</html>", aggregate: fmt.Sprintf("%x", md5.Sum([]byte("<html>Not Found</html>"))), wantAttempts: 1, wantErr: ErrEmptyChecksum},
+		{name: "aggregate mismatch", body: testMD5 + "  " + name, aggregate: testOtherMD5, wantAttempts: 1, wantErr: net.ErrChecksumMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempts, 1) <= int32(tt.failures) {
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+
+			cfg := testConfig()
+			zipAsset := github.ReleaseAsset{Name: github.String(name), BrowserDownloadURL: github.String(srv.URL + "/" + name)}
+			md5Asset := github.ReleaseAsset{Name: github.String(name + md5Extension), BrowserDownloadURL: github.String(srv.URL + "/" + name + md5Extension)}
+			var checksums map[string]string
+			if tt.aggregate != "" {
+				checksums = map[string]string{md5Asset.GetName(): tt.aggregate}
+			}
+
+			p, err := formPackage(context.Background(), net.NewQueue(1), cfg, "20200101", zipAsset, md5Asset, checksums, net.NewRetryBudget(10))
+			if got := atomic.LoadInt32(&attempts); got != tt.wantAttempts {
+				t.Errorf("got %d MD5 file requests, want %d", got, tt.wantAttempts)
+			}
+			switch {
+			case tt.wantFail && err == nil, !tt.wantFail && !errors.Is(err, tt.wantErr):
+				t.Fatalf("formPackage() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && p.MD5 != tt.wantMD5 {
+				t.Errorf("formPackage() MD5 = %q, want %q", p.MD5, tt.wantMD5)
+			}
+		})
+	}
+}
+
+// TestCreateMirrorMD5Joined checks that the MD5 file is downloaded on mirroring only along with the package,
+// and that its download is stopped when the package one fails
+func TestCreateMirrorMD5Joined(t *testing.T) {
+	tests := []struct {
+		name         string
+		noDisk       bool
+		wantRequests int32
+	}{
+		{name: "no disk space", noDisk: true, wantRequests: 0},
+		{name: "download failed", wantRequests: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				md5Requests int32
+				md5Once     sync.Once
+			)
+			md5Started, done := make(chan struct{}), make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, md5Extension) {
+					atomic.AddInt32(&md5Requests, 1)
+					md5Once.Do(func() { close(md5Started) })
+					<-done
+					return
+				}
+				// the package download fails while the MD5 file one is in flight
+				select {
+				case <-md5Started:
+				case <-done:
+				}
+				http.NotFound(w, r)
+			}))
+			defer srv.Close()
+			defer close(done)
+
+			dir, err := ioutil.TempDir("", "mirror")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			cfg := testConfig()
+			cfg.Set("gapps.local_path", dir)
+			if tt.noDisk {
+				cfg.Set("gapps.min_free_bytes", int64(1)<<62)
+			}
+			p := &Package{
+				Name:      "open_gapps-arm64-10.0-nano-20200101.zip",
+				Date:      "20200101",
+				OriginURL: srv.URL + "/open_gapps-arm64-10.0-nano-20200101.zip",
+				MD5URL:    srv.URL + "/open_gapps-arm64-10.0-nano-20200101.zip" + md5Extension,
+				Size:      1024,
+				Platform:  gapps.PlatformArm64,
+				Android:   gapps.Android100,
+				Variant:   gapps.VariantNano,
+			}
+
+			dq := net.NewQueue(2)
+			if err = p.createMirror(context.Background(), dq, cfg, nil, CollisionOverwrite); err == nil {
+				t.Fatal("createMirror() error = nil")
+			}
+			if tt.noDisk && !errors.Is(err, ErrNotEnoughSpace) {
+				t.Errorf("createMirror() error = %v, want %v", err, ErrNotEnoughSpace)
+			}
+			if got := atomic.LoadInt32(&md5Requests); got != tt.wantRequests {
+				t.Errorf("got %d MD5 file requests, want %d", got, tt.wantRequests)
+			}
+
+			// the MD5 file download leaves the queue once createMirror is over
+			deadline := time.Now().Add(5 * time.Second)
+			for active, waiting := dq.Depth(); active != 0 || waiting != 0; active, waiting = dq.Depth() {
+				if time.Now().After(deadline) {
+					t.Fatalf("Depth() = %d, %d after createMirror(), want 0, 0", active, waiting)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1, "1 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{1048575, "1.0 MiB"},
+		{1048576, "1.0 MiB"},
+		{1 << 30, "1.0 GiB"},
+	}
+
+	for _, tt := range tests {
+		if got := HumanBytes(tt.n); got != tt.want {
+			t.Errorf("HumanBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPackageHumanSize(t *testing.T) {
+	tests := []struct {
+		size int
+		want string
+	}{
+		{-1, "unknown"},
+		{0, "unknown"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1048576, "1.0 MiB"},
+	}
+
+	for _, tt := range tests {
+		p := &Package{Size: tt.size}
+		if got := p.HumanSize(); got != tt.want {
+			t.Errorf("HumanSize() of %d bytes = %q, want %q", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	content := []byte("open_gapps package")
+	tests := []struct {
+		name     string
+		existing bool
+		noSource bool
+		noDir    bool
+		wantErr  bool
+	}{
+		{name: "copied"},
+		{name: "destination replaced", existing: true},
+		{name: "missing source", noSource: true, wantErr: true},
+		{name: "missing destination dir", noDir: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "storage")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			src, dest := filepath.Join(dir, "src.zip"), filepath.Join(dir, "dest.zip")
+			if tt.noDir {
+				dest = filepath.Join(dir, "missing", "dest.zip")
+			}
+			if !tt.noSource {
+				if err = ioutil.WriteFile(src, content, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.existing {
+				if err = ioutil.WriteFile(dest, []byte("old"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = moveFile(src, dest, 0644)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("moveFile() error = %v, want error %t", err, tt.wantErr)
+			}
+			if _, statErr := os.Stat(dest + ".tmp"); !os.IsNotExist(statErr) {
+				t.Errorf("temp file is left: %v", statErr)
+			}
+			if tt.wantErr {
+				if _, statErr := os.Stat(src); !tt.noSource && statErr != nil {
+					t.Errorf("source is removed on failure: %v", statErr)
+				}
+				return
+			}
+
+			got, err := ioutil.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("destination content = %q, want %q", got, content)
+			}
+			info, err := os.Stat(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the mode is limited by umask
+			if info.Mode().Perm()&^0644 != 0 {
+				t.Errorf("destination mode = %v, want at most %v", info.Mode().Perm(), os.FileMode(0644))
+			}
+			if _, err = os.Stat(src); !os.IsNotExist(err) {
+				t.Errorf("source isn't removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseNameSuffix(t *testing.T) {
+	tests := []struct {
+		name       string
+		file       string
+		wantDate   string
+		wantSuffix string
+		wantErr    error
+	}{
+		{name: "standard", file: "open_gapps-arm64-10.0-nano-20200101.zip", wantDate: "20200101"},
+		{name: "suffix", file: "open_gapps-arm64-10.0-nano-20200101-beta.zip", wantDate: "20200101", wantSuffix: "beta"},
+		{name: "multipart suffix", file: "open_gapps-arm64-10.0-nano-20200101-UNOFFICIAL-test.zip", wantDate: "20200101", wantSuffix: "UNOFFICIAL-test"},
+		{name: "suffix instead of date", file: "open_gapps-arm64-10.0-nano-beta-20200101.zip", wantErr: ErrBadPackageName},
+		{name: "missing date", file: "open_gapps-arm64-10.0-nano.zip", wantErr: ErrBadPackageName},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parseName(testConfig(), tt.file)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseName(%q) error = %v, want %v", tt.file, err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if p.Date != tt.wantDate || p.Suffix != tt.wantSuffix {
+				t.Errorf("parseName(%q) date = %q, suffix = %q, want %q, %q", tt.file, p.Date, p.Suffix, tt.wantDate, tt.wantSuffix)
+			}
+			if p.Platform != gapps.PlatformArm64 || p.Android != gapps.Android100 || p.Variant != gapps.VariantNano {
+				t.Errorf("parseName(%q) = %s %s %s", tt.file, p.Platform, p.Android, p.Variant)
+			}
+		})
+	}
+}
+
+func TestParseNamePrefixes(t *testing.T) {
+	tests := []struct {
+		name    string
+		extra   []string
+		file    string
+		wantErr error
+	}{
+		{name: "main prefix", file: "open_gapps-arm64-10.0-nano-20200101.zip"},
+		{name: "extra prefix", extra: []string{"nikgapps", "bitgapps"}, file: "bitgapps-arm64-10.0-nano-20200101.zip"},
+		{name: "main prefix with extra ones", extra: []string{"nikgapps"}, file: "open_gapps-arm64-10.0-nano-20200101.zip"},
+		{name: "longest prefix", extra: []string{"open_gapps-unofficial"}, file: "open_gapps-unofficial-arm64-10.0-nano-20200101.zip"},
+		{name: "no matching prefix", extra: []string{"nikgapps"}, file: "mindthegapps-arm64-10.0-nano-20200101.zip", wantErr: ErrBadPackageName},
+		{name: "prefix without separator", file: "open_gappsx-arm64-10.0-nano-20200101.zip", wantErr: ErrBadPackageName},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Set("gapps.extra_prefixes", tt.extra)
+
+			p, err := parseName(cfg, tt.file)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseName(%q) error = %v, want %v", tt.file, err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if p.Platform != gapps.PlatformArm64 || p.Android != gapps.Android100 || p.Variant != gapps.VariantNano || p.Date != "20200101" {
+				t.Errorf("parseName(%q) = %s %s %s %s", tt.file, p.Platform, p.Android, p.Variant, p.Date)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const defaultPrewarmWorkers = 2
+
+// Prewarm creates the mirrors for the packages from gapps.prewarm list in the current storage.
+// Errors are only logged, so it's safe to run it in the background.
+func (gs *GlobalStorage) Prewarm(ctx context.Context, dq *net.DownloadQueue, cfg *viper.Viper) {
+	descriptors := cfg.GetStringSlice("gapps.prewarm")
+	if len(descriptors) == 0 {
+		return
+	}
+
+	s, ok := gs.Get(CurrentStorageKey)
+	if !ok {
+		log.Error("Unable to prewarm the mirrors: no current storage")
+		return
+	}
+
+	workers := cfg.GetInt("gapps.prewarm_workers")
+	if workers <= 0 {
+		workers = defaultPrewarmWorkers
+	}
+
+	log.WithField("count", len(descriptors)).Info("Prewarming the mirrors")
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for d := range queue {
+				if err := prewarmPackage(ctx, s, dq, cfg, d); err != nil {
+					log.Errorf("Unable to prewarm the mirror for '%s': %v", d, err)
+				}
+			}
+		}()
+	}
+
+	for _, d := range descriptors {
+		queue <- d
+	}
+	close(queue)
+	wg.Wait()
+	log.Info("Mirrors prewarmed")
+}
+
+func prewarmPackage(ctx context.Context, s *Storage, dq *net.DownloadQueue, cfg *viper.Viper, descriptor string) error {
+	platform, android, variant, err := gapps.ParseDescriptor(descriptor)
+	if err != nil {
+		return err
+	}
+
+	if _, err = s.GetOrMirror(ctx, platform, android, variant, dq, cfg, nil); err != nil {
+		return fmt.Errorf("unable to get package from storage %s: %w", s.Date, err)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// provider describes the remote mirror provider
+type provider interface {
+	// Name returns the provider name
+	Name() string
+	// MaxSize returns the max file size accepted by the provider, 0 means no limit
+	MaxSize() int64
+	// Upload uploads the package file and returns its remote URL
+	Upload(ctx context.Context, p *Package, file *os.File) (string, error)
+}
+
+// streamProvider describes the remote mirror provider which doesn't need
+// a seekable file, so the package can be uploaded right from the origin
+type streamProvider interface {
+	provider
+	// Stream uploads the package file of the exact size from body and returns its remote URL
+	Stream(ctx context.Context, p *Package, body io.Reader, size int64) (string, error)
+}
+
+// deleter describes the remote mirror provider which can delete the uploaded package,
+// e.g. the streamed one which doesn't match its checksum
+type deleter interface {
+	// Delete deletes the package file from the provider
+	Delete(ctx context.Context, p *Package) error
+}
+
+// httpClient is used for the uploads and the other storage requests
+var httpClient = http.DefaultClient
+
+// SetHTTPClient sets the HTTP client for the uploads and the other storage requests, e.g. to use a proxy
+func SetHTTPClient(client *http.Client) {
+	httpClient = client
+}
+
+// remoteProviders returns all the remote providers enabled in config, in the failover order:
+// S3 storage if gapps.s3.bucket is set, Google Cloud Storage if gapps.gcs.bucket is set,
+// WebDAV share if gapps.webdav.url is set, and then the transfer.sh-like servers.
+// Each of them has its own max file size, so the large packages go to the ones which accept them.
+func remoteProviders(cfg *viper.Viper) []provider {
+	var providers []provider
+	if cfg.GetString("gapps.s3.bucket") != "" {
+		providers = append(providers, newS3Provider(cfg))
+	}
+	if cfg.GetString("gapps.gcs.bucket") != "" {
+		providers = append(providers, newGCSProvider(cfg))
+	}
+	if cfg.GetString("gapps.webdav.url") != "" {
+		providers = append(providers, newWebDAVProvider(cfg))
+	}
+	maxSizes := cfg.GetIntSlice("gapps.remote_max_sizes")
+	for i, remoteURL := range remoteURLs(cfg) {
+		maxSize := cfg.GetInt64("gapps.remote_max_size")
+		if i < len(maxSizes) {
+			maxSize = int64(maxSizes[i])
+		}
+		providers = append(providers, &transferProvider{
+			url:     remoteURL,
+			maxSize: maxSize,
+			maxDays: cfg.GetInt("gapps.remote_max_days"),
+		})
+	}
+	return providers
+}
+
+// providerMaxSize returns the max file size of the provider from its key,
+// or gapps.remote_max_size if the key is not set
+func providerMaxSize(cfg *viper.Viper, key string) int64 {
+	if cfg.IsSet(key) {
+		return cfg.GetInt64(key)
+	}
+	return cfg.GetInt64("gapps.remote_max_size")
+}
+
+// remoteURLs returns the transfer.sh-like server URLs from gapps.remote_urls,
+// or the single gapps.remote_url if the list is not set
+func remoteURLs(cfg *viper.Viper) []string {
+	if urls := cfg.GetStringSlice("gapps.remote_urls"); len(urls) > 0 {
+		return urls
+	}
+	if remoteURL := cfg.GetString("gapps.remote_url"); remoteURL != "" {
+		return []string{remoteURL}
+	}
+	return nil
+}
+
+// selectProvider returns the first provider which accepts the file of the provided size
+func selectProvider(providers []provider, size int64) (provider, error) {
+	suitable := suitableProviders(providers, size)
+	if len(suitable) == 0 {
+		return nil, fmt.Errorf("no remote provider accepts the file of size %d", size)
+	}
+	log.Debugf("Provider %s is chosen: file size %d fits its limit %d", suitable[0].Name(), size, suitable[0].MaxSize())
+	return suitable[0], nil
+}
+
+// suitableProviders returns the providers which accept the file of the provided size
+func suitableProviders(providers []provider, size int64) []provider {
+	var suitable []provider
+	for _, pr := range providers {
+		if max := pr.MaxSize(); max > 0 && size > max {
+			log.Debugf("Provider %s is skipped: file size %d exceeds its limit %d", pr.Name(), size, max)
+			continue
+		}
+		suitable = append(suitable, pr)
+	}
+	return suitable
+}
+
+// UploadError describes the failed upload to every remote provider
+type UploadError struct {
+	Errs map[string]error
+	// Order keeps the provider names in the order they were tried
+	Order []string
+}
+
+func (e *UploadError) add(name string, err error) {
+	if e.Errs == nil {
+		e.Errs = make(map[string]error)
+	}
+	e.Errs[name] = err
+	e.Order = append(e.Order, name)
+}
+
+func (e *UploadError) Error() string {
+	failures := make([]string, 0, len(e.Order))
+	for _, name := range e.Order {
+		failures = append(failures, fmt.Sprintf("%s: %v", name, e.Errs[name]))
+	}
+	return "unable to upload to any remote provider: " + strings.Join(failures, "; ")
+}
+
+// transferProvider uploads the files to transfer.sh-like server with HTTP PUT
+type transferProvider struct {
+	url     string
+	maxSize int64
+	maxDays int
+}
+
+func (t *transferProvider) Name() string {
+	if u, err := url.Parse(t.url); err == nil && u.Host != "" {
+		return "transfer.sh (" + u.Host + ")"
+	}
+	return "transfer.sh"
+}
+
+func (t *transferProvider) MaxSize() int64 {
+	return t.maxSize
+}
+
+func (t *transferProvider) Upload(ctx context.Context, p *Package, file *os.File) (string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("unable to stat the file: %w", err)
+	}
+	return t.put(ctx, p, file, info.Size())
+}
+
+func (t *transferProvider) Stream(ctx context.Context, p *Package, body io.Reader, size int64) (string, error) {
+	return t.put(ctx, p, body, size)
+}
+
+func (t *transferProvider) put(ctx context.Context, p *Package, body io.Reader, size int64) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf(t.url, p.Name), body)
+	if err != nil {
+		return "", fmt.Errorf("unable to create upload request: %w", err)
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/zip")
+	if t.maxDays > 0 {
+		req.Header.Set("Max-Days", strconv.Itoa(t.maxDays))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to make upload request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to make upload request: %v", resp.Status)
+	}
+
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("unable to read mirror response body: %w", err)
+	}
+
+	return string(result), nil
+}
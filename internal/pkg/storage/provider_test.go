@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+
+	"github.com/spf13/viper"
+)
+
+func TestTransferProviderMaxDays(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxDays int
+		want    string
+	}{
+		{"week", 7, "7"},
+		{"month", 30, "30"},
+		{"zero", 0, ""},
+		{"negative", -1, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				header  string
+				present bool
+				body    string
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, present = r.Header["Max-Days"]
+				header = r.Header.Get("Max-Days")
+				b, _ := ioutil.ReadAll(r.Body)
+				body = string(b)
+				w.Write([]byte("https://transfer.sh/abc/" + r.URL.Path[1:]))
+			}))
+			defer srv.Close()
+
+			cfg := viper.New()
+			cfg.Set("gapps.remote_url", srv.URL+"/%s")
+			cfg.Set("gapps.remote_max_days", tt.maxDays)
+			providers := remoteProviders(cfg)
+			if len(providers) != 1 {
+				t.Fatalf("got %d providers, want 1", len(providers))
+			}
+			pr, ok := providers[0].(streamProvider)
+			if !ok {
+				t.Fatalf("provider %s doesn't support streaming", providers[0].Name())
+			}
+
+			remoteURL, err := pr.Stream(context.Background(), &Package{Name: "open_gapps.zip"}, strings.NewReader("gapps"), 5)
+			if err != nil {
+				t.Fatalf("Stream() error = %v", err)
+			}
+			if remoteURL != "https://transfer.sh/abc/open_gapps.zip" || body != "gapps" {
+				t.Errorf("Stream() = %s, body %q", remoteURL, body)
+			}
+			if header != tt.want || present != (tt.want != "") {
+				t.Errorf("Max-Days = %q (present: %t), want %q", header, present, tt.want)
+			}
+		})
+	}
+}
+
+// TestProviderStreamCancel checks that the upload in progress is aborted along with its ctx
+func TestProviderStreamCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"transfer.sh", "gapps.remote_url"},
+		{"webdav", "gapps.webdav.url"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started, done := make(chan struct{}, 1), make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPut {
+					w.WriteHeader(http.StatusCreated)
+					return
+				}
+				ioutil.ReadAll(r.Body)
+				started <- struct{}{}
+				// the response is never sent, so only the cancelled ctx ends the upload
+				<-done
+			}))
+			defer srv.Close()
+			defer close(done)
+
+			cfg := viper.New()
+			cfg.Set(tt.key, srv.URL+"/%s")
+			if tt.key == "gapps.webdav.url" {
+				cfg.Set(tt.key, srv.URL)
+			}
+			pr, ok := remoteProviders(cfg)[0].(streamProvider)
+			if !ok {
+				t.Fatalf("provider %s doesn't support streaming", tt.name)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-started
+				cancel()
+			}()
+			p := &Package{Name: "open_gapps.zip", Date: "20200101", Platform: gapps.PlatformArm64}
+			if _, err := pr.Stream(ctx, p, strings.NewReader("gapps"), 5); !errors.Is(err, context.Canceled) {
+				t.Errorf("Stream() error = %v, want %v", err, context.Canceled)
+			}
+		})
+	}
+}
+
+func TestRemoteProvidersMaxSize(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("gapps.s3.bucket", "gapps")
+	cfg.Set("gapps.s3.endpoint", "s3.local")
+	cfg.Set("gapps.s3.max_size", 100)
+	cfg.Set("gapps.gcs.bucket", "gapps")
+	cfg.Set("gapps.gcs.max_size", 200)
+	cfg.Set("gapps.webdav.url", "https://dav.local")
+	cfg.Set("gapps.remote_urls", []string{"https://one.local/%s", "https://two.local/%s"})
+	cfg.Set("gapps.remote_max_sizes", []int{500})
+	cfg.Set("gapps.remote_max_size", 1000)
+
+	providers := remoteProviders(cfg)
+	var names []string
+	for _, pr := range providers {
+		names = append(names, pr.Name())
+	}
+	wantNames := []string{"s3", "gcs", "webdav", "transfer.sh", "transfer.sh"}
+	if strings.Join(names, ",") != strings.Join(wantNames, ",") {
+		t.Fatalf("remoteProviders() = %v, want %v", names, wantNames)
+	}
+
+	tests := []struct {
+		size    int64
+		want    string
+		wantErr bool
+	}{
+		{size: 50, want: "s3"},
+		{size: 150, want: "gcs"},
+		{size: 300, want: "webdav"},
+		{size: 1000, want: "webdav"},
+		{size: 1001, wantErr: true},
+	}
+	for _, tt := range tests {
+		pr, err := selectProvider(providers, tt.size)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("selectProvider(%d) error = %v, want error %t", tt.size, err, tt.wantErr)
+		}
+		if err == nil && pr.Name() != tt.want {
+			t.Errorf("selectProvider(%d) = %s, want %s", tt.size, pr.Name(), tt.want)
+		}
+	}
+
+	wantSizes := []int64{100, 200, 1000, 500, 1000}
+	for i, pr := range providers {
+		if pr.MaxSize() != wantSizes[i] {
+			t.Errorf("%s MaxSize() = %d, want %d", pr.Name(), pr.MaxSize(), wantSizes[i])
+		}
+	}
+}
+
+// TestUploadSkipsSmallProvider checks that the package is uploaded to the next provider
+// if the first one doesn't accept its size, without trying the first one
+func TestUploadSkipsSmallProvider(t *testing.T) {
+	var davRequests int32
+	dav := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&davRequests, 1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer dav.Close()
+	transfer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("https://transfer.local" + r.URL.Path))
+	}))
+	defer transfer.Close()
+
+	cfg := viper.New()
+	cfg.Set("gapps.webdav.url", dav.URL)
+	cfg.Set("gapps.webdav.max_size", 10)
+	cfg.Set("gapps.remote_url", transfer.URL+"/%s")
+
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "open_gapps.zip")
+	if err = ioutil.WriteFile(path, []byte(strings.Repeat("g", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Package{Name: "open_gapps.zip", Date: "20200101", Platform: gapps.PlatformArm64, Size: 100}
+	if err = p.upload(context.Background(), remoteProviders(cfg), path); err != nil {
+		t.Fatalf("upload() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&davRequests); got != 0 {
+		t.Errorf("small provider got %d requests, want 0", got)
+	}
+	if _, remoteURL := p.mirrorURLs(); remoteURL != "https://transfer.local/open_gapps.zip" || p.RemoteBy != "transfer.sh" {
+		t.Errorf("package is uploaded to %s by %s", remoteURL, p.RemoteBy)
+	}
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/events"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/net"
+
+	"github.com/google/go-github/v29/github"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// PackageCount returns the number of the cached packages, only of the platform if it's not nil
+func (gs *GlobalStorage) PackageCount(platform *gapps.Platform) int {
+	gs.mtx.RLock()
+	defer gs.mtx.RUnlock()
+
+	var count int
+	for k, s := range gs.storages {
+		if k == CurrentStorageKey {
+			continue
+		}
+		for _, p := range s.List() {
+			if platform == nil || p.Platform == *platform {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// Purge removes the cached packages from the storages and the DB, along with their mirror URLs,
+// so that they're fetched from Github and mirrored again on the next lookups.
+// If the platform is nil, the storages are removed completely, otherwise only the platform packages are.
+// Local mirror files are kept. Returns the number of the removed packages.
+func (gs *GlobalStorage) Purge(platform *gapps.Platform) (int, error) {
+	gs.mtx.Lock()
+	defer gs.mtx.Unlock()
+
+	var count int
+	for k, s := range gs.storages {
+		if k == CurrentStorageKey {
+			continue
+		}
+
+		if platform == nil {
+			count += len(s.List())
+			delete(gs.storages, k)
+			if err := gs.cache.Delete(k); err != nil {
+				return count, fmt.Errorf("unable to delete storage %s from cache: %w", k, err)
+			}
+			continue
+		}
+
+		for _, p := range s.List() {
+			if p.Platform == *platform {
+				s.Delete(p)
+				count++
+			}
+		}
+		if err := s.Save(); err != nil {
+			return count, fmt.Errorf("unable to save purged storage: %w", err)
+		}
+	}
+	if platform == nil {
+		delete(gs.storages, CurrentStorageKey)
+	}
+	if err := gs.purgeIndex(platform); err != nil {
+		return count, err
+	}
+
+	events.Emit(events.StoragePurged, events.Fields{"platform": platformName(platform), "count": count})
+	return count, nil
+}
+
+// purgeIndex removes the packages from the package DB, if it's set, including the evicted releases ones.
+// Only the platform packages are removed if it's not nil.
+func (gs *GlobalStorage) purgeIndex(platform *gapps.Platform) error {
+	if gs.index == nil {
+		return nil
+	}
+
+	packages, err := gs.index.List()
+	if err != nil {
+		return fmt.Errorf("unable to list packages from DB: %w", err)
+	}
+	purged := packages[:0]
+	for _, p := range packages {
+		if platform == nil || p.Platform == *platform {
+			purged = append(purged, p)
+		}
+	}
+	if len(purged) == 0 {
+		return nil
+	}
+	if err = gs.index.Delete(purged...); err != nil {
+		return fmt.Errorf("unable to delete packages from DB: %w", err)
+	}
+	return nil
+}
+
+// platformName returns the platform name, or "all" if it's nil
+func platformName(platform *gapps.Platform) string {
+	if platform == nil {
+		return "all"
+	}
+	return platform.String()
+}
+
+// HasPlatform checks if the Storage has any packages of the platform
+func (s *Storage) HasPlatform(platform gapps.Platform) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	for _, variants := range s.Packages[platform] {
+		if len(variants) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ScanPlatform scans the platform release of the Storage date again and adds its new packages,
+// e.g. after the platform is purged or its release was unavailable during the scan.
+// Returns the number of the added packages.
+func (s *Storage) ScanPlatform(ctx context.Context, ghClient *github.Client, dq *net.DownloadQueue, cfg *viper.Viper, platform gapps.Platform) (int, error) {
+	release, err := getRelease(ctx, ghClient, cfg, platform, s.Date, tagPattern(cfg))
+	if err != nil {
+		return 0, fmt.Errorf("unable to get release from Github: %w", err)
+	}
+
+	summary := ScanSummary{ReleaseDate: s.Date}
+	rescanned := &Storage{ScannedAt: time.Now()}
+	if err = rescanned.scanRelease(ctx, dq, cfg, release.RepositoryRelease, net.NewRetryBudget(cfg.GetInt("net.retry_budget")), &summary); err != nil {
+		return 0, err
+	}
+
+	count := s.Merge(rescanned)
+	log.WithField("release_date", s.Date).WithField("platform", platform).WithField("count", count).Info("Platform release scanned")
+	if err = s.Save(); err != nil {
+		return count, fmt.Errorf("unable to save storage: %w", err)
+	}
+	return count, nil
+}
@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/metrics"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/net"
+
+	"github.com/google/go-github/v29/github"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// AddRelease adds the packages of the published platform release to the storage of its date.
+// Unknown release is scanned fully for all the platforms, so that its storage is complete,
+// and becomes the current one if it's newer. Returns the storage and the release packages.
+func (gs *GlobalStorage) AddRelease(ctx context.Context, ghClient *github.Client, dq *net.DownloadQueue, cfg *viper.Viper, platform gapps.Platform, release *github.RepositoryRelease) (*Storage, []*Package, error) {
+	date := release.GetTagName()
+	if pattern := tagPattern(cfg); pattern != nil && !pattern.MatchString(date) {
+		return nil, nil, fmt.Errorf("release tag %s doesn't match the tag pattern %s", date, pattern)
+	}
+	logger := log.WithField("release_date", date).WithField("platform", platform)
+
+	s, ok := gs.Get(date)
+	if ok {
+		rescanned := &Storage{ScannedAt: time.Now()}
+		var summary ScanSummary
+		if err := rescanned.scanRelease(ctx, dq, cfg, release, net.NewRetryBudget(cfg.GetInt("net.retry_budget")), &summary); err != nil {
+			return nil, nil, fmt.Errorf("unable to scan release: %w", err)
+		}
+		logger.WithField("count", s.Merge(rescanned)).Info("Release scanned, new packages discovered")
+	} else {
+		var (
+			summary ScanSummary
+			err     error
+		)
+		if s, summary, err = GetPackageStorage(ctx, ghClient, dq, cfg, date); err != nil {
+			return nil, nil, fmt.Errorf("unable to get package storage: %w", err)
+		}
+		logger.WithField("found", summary.Found).WithField("added", summary.Added).Info("Release scanned")
+		gs.Add(s.Date, s)
+		if current, ok := gs.Get(CurrentStorageKey); !ok || current.Date < s.Date {
+			logger.Info("Setting storage as current")
+			gs.Add(CurrentStorageKey, s)
+		}
+	}
+	if err := s.Save(); err != nil {
+		return nil, nil, fmt.Errorf("unable to save storage: %w", err)
+	}
+	gs.Evict(cfg.GetInt("cache.max_releases"))
+
+	var packages []*Package
+	for _, p := range s.List() {
+		if p.Platform == platform && p.Release == date {
+			packages = append(packages, p)
+		}
+	}
+	return s, packages, nil
+}
+
+const (
+	// mirrorProgressInterval is the period of the batch mirroring progress reports between the finished packages
+	mirrorProgressInterval = time.Second
+	// defaultReleaseWorkers is the number of the packages mirrored at once if gapps.release_workers is not set
+	defaultReleaseWorkers = 2
+)
+
+// MirrorSummary is the result of the batch mirroring, or its progress so far
+type MirrorSummary struct {
+	Created  int
+	Existing int
+	Failed   int
+	// Total is the number of the packages to process
+	Total int
+	// BytesDone is the size of the processed packages along with the downloaded bytes of the ones in progress.
+	// BytesTotal is the size of all the packages, or 0 if any of them is unknown.
+	BytesDone  int64
+	BytesTotal int64
+	// ETA is the estimated time left, based on the throughput if the sizes are known,
+	// or the rate of the processed packages otherwise. It's 0 until the first estimate.
+	ETA time.Duration
+}
+
+// Done returns the number of the processed packages
+func (m MirrorSummary) Done() int {
+	return m.Created + m.Existing + m.Failed
+}
+
+// mirrorProgress aggregates the progress of the packages mirrored in a batch
+type mirrorProgress struct {
+	summary MirrorSummary
+	start   time.Time
+	// bytes of the new mirrors and the number of the processed packages which weren't mirrored before,
+	// the existing mirrors take no time and don't count for the throughput
+	transferred int64
+	processed   int
+	inflight    map[*Package]int64
+}
+
+func newMirrorProgress(packages []*Package) *mirrorProgress {
+	mp := &mirrorProgress{
+		summary:  MirrorSummary{Total: len(packages)},
+		start:    time.Now(),
+		inflight: make(map[*Package]int64),
+	}
+	for _, p := range packages {
+		if p.Size <= 0 {
+			mp.summary.BytesTotal = 0
+			break
+		}
+		mp.summary.BytesTotal += int64(p.Size)
+	}
+	return mp
+}
+
+// download sets the downloaded bytes of the package in progress
+func (mp *mirrorProgress) download(p *Package, done int64) {
+	mp.inflight[p] = done
+}
+
+// finish counts the processed package
+func (mp *mirrorProgress) finish(p *Package, existing bool, err error) {
+	delete(mp.inflight, p)
+	switch {
+	case err != nil:
+		mp.summary.Failed++
+	case existing:
+		mp.summary.Existing++
+	default:
+		mp.summary.Created++
+	}
+	mp.summary.BytesDone += int64(p.Size)
+	if !existing {
+		mp.transferred += int64(p.Size)
+		mp.processed++
+	}
+}
+
+// report returns the summary so far with the estimated time left
+func (mp *mirrorProgress) report() MirrorSummary {
+	summary := mp.summary
+	var inflight int64
+	for _, done := range mp.inflight {
+		inflight += done
+	}
+	summary.BytesDone += inflight
+	if summary.BytesTotal > 0 && summary.BytesDone > summary.BytesTotal {
+		// the retried downloads may count some bytes twice
+		summary.BytesDone = summary.BytesTotal
+	}
+
+	elapsed := time.Since(mp.start)
+	switch {
+	case summary.BytesTotal > 0 && mp.transferred+inflight > 0:
+		perByte := float64(elapsed) / float64(mp.transferred+inflight)
+		summary.ETA = time.Duration(perByte * float64(summary.BytesTotal-summary.BytesDone))
+	case summary.BytesTotal == 0 && mp.processed > 0:
+		summary.ETA = elapsed / time.Duration(mp.processed) * time.Duration(summary.Total-summary.Done())
+	}
+	if summary.ETA < 0 {
+		summary.ETA = 0
+	}
+	return summary
+}
+
+// MirrorRelease adds the published platform release and creates the mirrors for all of its packages.
+// Errors are only logged, so it's safe to run it in the background.
+func (gs *GlobalStorage) MirrorRelease(ctx context.Context, ghClient *github.Client, dq *net.DownloadQueue, cfg *viper.Viper, platform gapps.Platform, release *github.RepositoryRelease) {
+	logger := log.WithField("release_date", release.GetTagName()).WithField("platform", platform)
+	s, packages, err := gs.AddRelease(ctx, ghClient, dq, cfg, platform, release)
+	if err != nil {
+		logger.Errorf("Unable to add the release: %v", err)
+		return
+	}
+
+	logger.WithField("count", len(packages)).Info("Mirroring the release")
+	summary := s.MirrorPackages(ctx, packages, dq, cfg, nil)
+	logger.WithField("created", summary.Created).WithField("existing", summary.Existing).
+		WithField("failed", summary.Failed).Info("Release mirrored")
+}
+
+// MirrorPackages creates the mirrors for the storage packages which don't have them yet,
+// using gapps.release_workers at once, while the downloads are still limited by the download queue.
+// The packages left are skipped once the context is done. If progress is set, it's called
+// with the summary so far and its ETA after each package and every mirrorProgressInterval,
+// one call at a time. The progress is also exposed as the release mirror metrics.
+// Errors are only logged and counted in the summary.
+func (s *Storage) MirrorPackages(ctx context.Context, packages []*Package, dq *net.DownloadQueue, cfg *viper.Viper, progress func(MirrorSummary)) MirrorSummary {
+	workers := cfg.GetInt("gapps.release_workers")
+	if workers <= 0 {
+		workers = defaultReleaseWorkers
+	}
+
+	var (
+		mp  = newMirrorProgress(packages)
+		mtx sync.Mutex
+		wg  sync.WaitGroup
+	)
+	// reportProgress must be called with mtx held
+	reportProgress := func() {
+		summary := mp.report()
+		var bytesLeft int64
+		if summary.BytesTotal > 0 {
+			bytesLeft = summary.BytesTotal - summary.BytesDone
+		}
+		metrics.ReleaseMirrorProgress(s.Date, bytesLeft, summary.Total-summary.Done(), summary.ETA)
+		if progress != nil {
+			progress(summary)
+		}
+	}
+	defer metrics.ReleaseMirrorDone(s.Date)
+
+	stop := make(chan struct{})
+	ticker := time.NewTicker(mirrorProgressInterval)
+	defer ticker.Stop()
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				mtx.Lock()
+				reportProgress()
+				mtx.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	queue := make(chan *Package)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				existing := p.Mirrored(cfg)
+				_, err := s.GetOrMirror(ctx, p.Platform, p.Android, p.Variant, dq, cfg, func(done, _ int64) {
+					mtx.Lock()
+					mp.download(p, done)
+					mtx.Unlock()
+				})
+				if err != nil {
+					log.WithField("release_date", s.Date).Errorf("Unable to mirror the package %s: %v", p.Name, err)
+				}
+
+				mtx.Lock()
+				mp.finish(p, existing, err)
+				reportProgress()
+				mtx.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, p := range packages {
+		select {
+		case queue <- p:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	// the ticker goroutine may be reporting, so the summary is taken after it's stopped
+	stop <- struct{}{}
+	mtx.Lock()
+	defer mtx.Unlock()
+	return mp.report()
+}
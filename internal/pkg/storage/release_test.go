@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMirrorProgressReport(t *testing.T) {
+	tests := []struct {
+		name          string
+		sizes         []int
+		existing      []bool
+		finished      int
+		inflight      int64
+		wantBytesDone int64
+		wantTotal     int64
+		wantETA       time.Duration
+	}{
+		{
+			name:  "nothing done",
+			sizes: []int{100, 100}, existing: []bool{false, false},
+			wantTotal: 200,
+		},
+		{
+			name:  "bytes throughput",
+			sizes: []int{100, 100, 200}, existing: []bool{false, false, false},
+			finished: 1, inflight: 100,
+			wantBytesDone: 200, wantTotal: 400, wantETA: 10 * time.Second,
+		},
+		{
+			name:  "existing mirrors don't count for throughput",
+			sizes: []int{1000, 100, 100}, existing: []bool{true, false, false},
+			finished:      2,
+			wantBytesDone: 1100, wantTotal: 1200, wantETA: 10 * time.Second,
+		},
+		{
+			name:  "unknown sizes use package counts",
+			sizes: []int{100, 0, 100, 100}, existing: []bool{false, false, false, false},
+			finished: 2, inflight: 50,
+			wantBytesDone: 150, wantETA: 10 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packages := make([]*Package, len(tt.sizes))
+			for i, size := range tt.sizes {
+				packages[i] = &Package{Name: "package" + strconv.Itoa(i), Size: size}
+			}
+			mp := newMirrorProgress(packages)
+			mp.start = time.Now().Add(-10 * time.Second)
+			for i := 0; i < tt.finished; i++ {
+				mp.download(packages[i], int64(tt.sizes[i]))
+				mp.finish(packages[i], tt.existing[i], nil)
+			}
+			if tt.inflight > 0 {
+				mp.download(packages[tt.finished], tt.inflight)
+			}
+
+			got := mp.report()
+			if got.Total != len(packages) || got.Done() != tt.finished {
+				t.Errorf("report() = %d of %d packages, want %d of %d", got.Done(), got.Total, tt.finished, len(packages))
+			}
+			if got.BytesDone != tt.wantBytesDone || got.BytesTotal != tt.wantTotal {
+				t.Errorf("report() = %d of %d bytes, want %d of %d", got.BytesDone, got.BytesTotal, tt.wantBytesDone, tt.wantTotal)
+			}
+			if diff := got.ETA - tt.wantETA; diff < -time.Second || diff > time.Second {
+				t.Errorf("report() ETA = %s, want about %s", got.ETA, tt.wantETA)
+			}
+		})
+	}
+}
+
+func TestMirrorProgressFinish(t *testing.T) {
+	packages := []*Package{{Name: "created", Size: 10}, {Name: "existing", Size: 10}, {Name: "failed", Size: 10}}
+	mp := newMirrorProgress(packages)
+	mp.finish(packages[0], false, nil)
+	mp.finish(packages[1], true, nil)
+	mp.finish(packages[2], false, errors.New("upload failed"))
+
+	got := mp.report()
+	if got.Created != 1 || got.Existing != 1 || got.Failed != 1 {
+		t.Errorf("report() = %+v, want 1 created, 1 existing and 1 failed", got)
+	}
+	if got.ETA != 0 || got.BytesDone != got.BytesTotal {
+		t.Errorf("report() of the finished batch = %d of %d bytes, ETA %s", got.BytesDone, got.BytesTotal, got.ETA)
+	}
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RequestCount is the number of requests of the package combination
+type RequestCount struct {
+	Platform gapps.Platform
+	Android  gapps.Android
+	Variant  gapps.Variant
+	Count    uint64
+}
+
+// requestCounter keeps the request counts which are not saved to the DB yet
+type requestCounter struct {
+	pending map[string]uint64
+	mtx     sync.Mutex
+}
+
+// CountRequest counts the request of the package combination.
+// The count is only kept in memory until FlushRequests, so it never waits for the DB.
+func (gs *GlobalStorage) CountRequest(p gapps.Platform, a gapps.Android, v gapps.Variant) {
+	gs.requests.mtx.Lock()
+	if gs.requests.pending == nil {
+		gs.requests.pending = make(map[string]uint64)
+	}
+	gs.requests.pending[requestKey(p, a, v)]++
+	gs.requests.mtx.Unlock()
+}
+
+// FlushRequests adds the pending request counts to the DB.
+// On failure the counts are kept pending until the next flush.
+func (gs *GlobalStorage) FlushRequests() error {
+	gs.requests.mtx.Lock()
+	pending := gs.requests.pending
+	gs.requests.pending = nil
+	gs.requests.mtx.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := gs.cache.AddCounters(pending); err != nil {
+		gs.requests.mtx.Lock()
+		if gs.requests.pending == nil {
+			gs.requests.pending = make(map[string]uint64)
+		}
+		for key, count := range pending {
+			gs.requests.pending[key] += count
+		}
+		gs.requests.mtx.Unlock()
+		return fmt.Errorf("unable to save request counts: %w", err)
+	}
+	log.WithField("count", len(pending)).Debug("Request counts saved")
+	return nil
+}
+
+// PopularRequests returns up to limit most requested package combinations, the pending counts included
+func (gs *GlobalStorage) PopularRequests(limit int) ([]RequestCount, error) {
+	counters, err := gs.cache.Counters()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get request counts: %w", err)
+	}
+	gs.requests.mtx.Lock()
+	for key, count := range gs.requests.pending {
+		counters[key] += count
+	}
+	gs.requests.mtx.Unlock()
+
+	result := make([]RequestCount, 0, len(counters))
+	for key, count := range counters {
+		p, a, v, err := gapps.ParseDescriptor(key)
+		if err != nil {
+			log.Warnf("Unknown request counter '%s' is skipped: %v", key, err)
+			continue
+		}
+		result = append(result, RequestCount{Platform: p, Android: a, Variant: v, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Descriptor() < result[j].Descriptor()
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// Descriptor returns the package descriptor of the combination, like "arm64-10.0-nano"
+func (r RequestCount) Descriptor() string {
+	return requestKey(r.Platform, r.Android, r.Variant)
+}
+
+func requestKey(p gapps.Platform, a gapps.Android, v gapps.Variant) string {
+	return fmt.Sprintf("%s-%s-%s", p, a.HumanString(), v)
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// PruneExpired removes the local mirror files which are older than gapps.local_retention_days,
+// along with the date folders left empty. Pinned packages and the ones being mirrored are kept.
+// Returns the number of removed files.
+func (gs *GlobalStorage) PruneExpired(cfg *viper.Viper) (int, error) {
+	root, days := cfg.GetString("gapps.local_path"), cfg.GetInt("gapps.local_retention_days")
+	if root == "" {
+		return 0, errors.New("local storage is not configured")
+	}
+	if days <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+
+	// index the local mirrors by their paths
+	packages := make(map[string]*Package)
+	gs.mtx.RLock()
+	for _, s := range gs.storages {
+		for _, p := range s.List() {
+			if localURL, _ := p.mirrorURLs(); localURL != "" {
+				packages[p.localPath(root)] = p
+			}
+		}
+	}
+	gs.mtx.RUnlock()
+
+	var count int
+	for _, platform := range gapps.PlatformValues() {
+		dates, err := ioutil.ReadDir(root + platform.String())
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return count, fmt.Errorf("unable to read local storage for platform %s: %w", platform, err)
+		}
+
+		for _, date := range dates {
+			if !date.IsDir() {
+				continue
+			}
+			dir := filepath.Join(root+platform.String(), date.Name())
+			n, err := gs.pruneDir(cfg, dir, cutoff, packages)
+			count += n
+			if err != nil {
+				return count, err
+			}
+		}
+	}
+
+	if count > 0 {
+		gs.Save()
+	}
+	return count, nil
+}
+
+// pruneDir removes the expired files from the date folder, and the folder itself if it's left empty.
+// Each file is locked with lockPath and checked again before the removal, so that the fresh mirror
+// written concurrently to the same path is kept.
+func (gs *GlobalStorage) pruneDir(cfg *viper.Viper, dir string, cutoff time.Time, packages map[string]*Package) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read local storage folder %s: %w", dir, err)
+	}
+
+	var count, kept int
+	for _, info := range files {
+		path := filepath.Join(dir, info.Name())
+		p, pinned := packages[path], false
+		if p != nil {
+			_, pinned = p.Tag(PinnedTag)
+		}
+		switch {
+		case !info.Mode().IsRegular(), !info.ModTime().Before(cutoff), pinned, mirrors.Running(info.Name()), isLockFile(info.Name()):
+			kept++
+			continue
+		}
+
+		if err = removeExpired(cfg, path, cutoff); err != nil {
+			log.Errorf("Unable to remove expired mirror %s: %v", path, err)
+			kept++
+			continue
+		}
+		if p != nil {
+			p.dropLocal()
+		}
+		count++
+		log.WithField("path", path).WithField("modified", info.ModTime()).Info("Expired mirror removed")
+	}
+
+	if kept == 0 {
+		if err = os.Remove(dir); err != nil {
+			log.Errorf("Unable to remove empty folder %s: %v", dir, err)
+		} else {
+			log.WithField("path", dir).Debug("Empty folder removed")
+		}
+	}
+	return count, nil
+}
+
+// removeExpired locks the file and removes it if it's still older than the cutoff
+func removeExpired(cfg *viper.Viper, path string, cutoff time.Time) error {
+	unlock, err := lockPath(cfg, path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().Before(cutoff) {
+		return errors.New("file was modified")
+	}
+	return os.Remove(path)
+}
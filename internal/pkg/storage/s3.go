@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v6"
+	"github.com/spf13/viper"
+)
+
+// s3Provider uploads the files to the S3-compatible storage (AWS S3, MinIO etc.)
+type s3Provider struct {
+	endpoint  string
+	bucket    string
+	accessKey string
+	secretKey string
+	useSSL    bool
+	maxSize   int64
+}
+
+func newS3Provider(cfg *viper.Viper) *s3Provider {
+	return &s3Provider{
+		endpoint:  cfg.GetString("gapps.s3.endpoint"),
+		bucket:    cfg.GetString("gapps.s3.bucket"),
+		accessKey: cfg.GetString("gapps.s3.access_key"),
+		secretKey: cfg.GetString("gapps.s3.secret_key"),
+		useSSL:    cfg.GetBool("gapps.s3.use_ssl"),
+		maxSize:   providerMaxSize(cfg, "gapps.s3.max_size"),
+	}
+}
+
+func (s *s3Provider) Name() string {
+	return "s3"
+}
+
+func (s *s3Provider) MaxSize() int64 {
+	return s.maxSize
+}
+
+func (s *s3Provider) Upload(ctx context.Context, p *Package, file *os.File) (string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("unable to stat the file: %w", err)
+	}
+	return s.put(ctx, p, file, info.Size())
+}
+
+func (s *s3Provider) Stream(ctx context.Context, p *Package, body io.Reader, size int64) (string, error) {
+	return s.put(ctx, p, body, size)
+}
+
+// Delete removes the package object from the bucket
+func (s *s3Provider) Delete(ctx context.Context, p *Package) error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	key := p.localPath("")
+	if err = client.RemoveObject(s.bucket, key); err != nil {
+		return fmt.Errorf("unable to remove the object %s from bucket %s: %w", key, s.bucket, err)
+	}
+	return nil
+}
+
+// client creates the S3 client which uses the storage HTTP transport
+func (s *s3Provider) client() (*minio.Client, error) {
+	client, err := minio.New(s.endpoint, s.accessKey, s.secretKey, s.useSSL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create S3 client: %w", err)
+	}
+	if httpClient.Transport != nil {
+		client.SetCustomTransport(httpClient.Transport)
+	}
+	return client, nil
+}
+
+// put uploads the package under the Platform/Date/Name key and returns the object URL
+func (s *s3Provider) put(ctx context.Context, p *Package, body io.Reader, size int64) (string, error) {
+	client, err := s.client()
+	if err != nil {
+		return "", err
+	}
+
+	key := p.localPath("")
+	opts := minio.PutObjectOptions{ContentType: "application/zip"}
+	if _, err = client.PutObjectWithContext(ctx, s.bucket, key, body, size, opts); err != nil {
+		return "", fmt.Errorf("unable to put the object %s to bucket %s: %w", key, s.bucket, err)
+	}
+
+	return strings.TrimSuffix(client.EndpointURL().String(), "/") + "/" + s.bucket + "/" + key, nil
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrShuttingDown is returned for the new mirror creations after StopMirrors
+var ErrShuttingDown = errors.New("mirroring is stopped for shutdown")
+
+// tracker tracks the active mirror creations for the graceful shutdown
+var tracker mirrorTracker
+
+// DrainSummary describes the mirror creations which were active on StopMirrors
+type DrainSummary struct {
+	Completed int
+	Failed    int
+	Cancelled int
+	Active    int // still in progress
+}
+
+type mirrorTracker struct {
+	active  int
+	stopped bool
+	idle    chan struct{} // closed when no mirrors are left after the stop
+	summary DrainSummary
+	mtx     sync.Mutex
+}
+
+// StopMirrors stops the new mirror creations, which fail with ErrShuttingDown after it
+func StopMirrors() {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+
+	if tracker.stopped {
+		return
+	}
+	tracker.stopped = true
+	tracker.idle = make(chan struct{})
+	if tracker.active == 0 {
+		close(tracker.idle)
+	}
+}
+
+// WaitMirrors waits for the active mirror creations to finish after StopMirrors, until ctx is done.
+// Returns the results of the mirror creations which have finished since StopMirrors,
+// along with the number of the ones still in progress.
+func WaitMirrors(ctx context.Context) DrainSummary {
+	tracker.mtx.Lock()
+	idle := tracker.idle
+	tracker.mtx.Unlock()
+
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-ctx.Done():
+		}
+	}
+
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	summary := tracker.summary
+	summary.Active = tracker.active
+	return summary
+}
+
+// start registers the new mirror creation, unless the mirroring is stopped
+func (t *mirrorTracker) start() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.stopped {
+		return false
+	}
+	t.active++
+	return true
+}
+
+// finish unregisters the mirror creation and counts its result, if it has finished after the stop
+func (t *mirrorTracker) finish(err error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.active--
+	if !t.stopped {
+		return
+	}
+	switch {
+	case err == nil:
+		t.summary.Completed++
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		t.summary.Cancelled++
+	default:
+		t.summary.Failed++
+	}
+	if t.active == 0 {
+		close(t.idle)
+	}
+}
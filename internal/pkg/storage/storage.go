@@ -6,15 +6,19 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/go-github/v29/github"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
 	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/db"
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/events"
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/flight"
 	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
 	"github.com/nezorflame/opengapps-mirror-bot/pkg/net"
 )
@@ -22,76 +26,233 @@ import (
 // CurrentStorageKey is used as GlobalStorage key for the current package
 const CurrentStorageKey = "current"
 
+const md5Extension = ".md5"
+
+// ErrPackageNotFound is returned when the package is missing from the Storage
+var ErrPackageNotFound = errors.New("package not found")
+
+// mirrors deduplicates the concurrent mirror creations of the same package
+var mirrors flight.Group
+
 // Storage describes a package storage
 type Storage struct {
-	Date     string                                                          `json:"date"`
-	Count    int                                                             `json:"count"`
-	Packages map[gapps.Platform]map[gapps.Android]map[gapps.Variant]*Package `json:"packages"`
-	cache    *db.DB
-	mtx      sync.RWMutex
+	Date      string                                                          `json:"date"`
+	Count     int                                                             `json:"count"`
+	ScannedAt time.Time                                                       `json:"scanned_at"`
+	Packages  map[gapps.Platform]map[gapps.Android]map[gapps.Variant]*Package `json:"packages"`
+	cache     *db.DB
+	index     *DB
+	mtx       sync.RWMutex
+}
+
+// ScanSummary describes the result of a single release scan
+type ScanSummary struct {
+	ReleaseDate string        `json:"release_date"`
+	Found       int           `json:"found"`
+	Added       int           `json:"added"`
+	Skipped     int           `json:"skipped"`
+	Unparsed    int           `json:"unparsed"`
+	Failed      int           `json:"failed"`
+	Bytes       int64         `json:"bytes"`
+	Duration    time.Duration `json:"duration"`
 }
 
 // GetPackageStorage creates and fills a new Storage
-func GetPackageStorage(ctx context.Context, ghClient *github.Client, dq *net.DownloadQueue, cfg *viper.Viper, releaseTag string) (*Storage, error) {
-	releases, err := getAllReleasesByTag(ctx, ghClient, cfg.GetString("github.repo"), releaseTag)
+func GetPackageStorage(ctx context.Context, ghClient *github.Client, dq *net.DownloadQueue, cfg *viper.Viper, releaseTag string) (*Storage, ScanSummary, error) {
+	var (
+		summary = ScanSummary{ReleaseDate: releaseTag}
+		start   = time.Now()
+	)
+	events.Emit(events.ScanStarted, events.Fields{"release_date": releaseTag})
+	releases, err := getAllReleasesByTag(ctx, ghClient, cfg, releaseTag, tagPattern(cfg))
 	if err != nil {
-		return nil, fmt.Errorf("unable to get latest releases from Github: %w", err)
+		return nil, summary, fmt.Errorf("unable to get latest releases from Github: %w", err)
 	}
 
-	storage := &Storage{Packages: make(map[gapps.Platform]map[gapps.Android]map[gapps.Variant]*Package, len(releases))}
+	budget := net.NewRetryBudget(cfg.GetInt("net.retry_budget"))
+	storage := &Storage{
+		ScannedAt: start,
+		Packages:  make(map[gapps.Platform]map[gapps.Android]map[gapps.Variant]*Package, len(releases)),
+	}
 	for _, release := range releases {
-		zipSlice := make([]github.ReleaseAsset, 0, len(release.Assets))
-		md5Slice := make([]github.ReleaseAsset, 0, len(release.Assets))
-
-		// Sort out zip and MD5's
-		for _, asset := range release.Assets {
-			name := asset.GetName()
-			if strings.HasSuffix(name, "zip") {
-				zipSlice = append(zipSlice, asset)
-			}
+		if err = storage.scanRelease(ctx, dq, cfg, release.RepositoryRelease, budget, &summary); err != nil {
+			return nil, summary, err
+		}
+	}
+
+	if budget.Left() == 0 {
+		log.Warn("Retry budget was exhausted during the scan")
+	}
+	summary.Duration = time.Since(start)
+	events.Emit(events.ScanFinished, events.Fields{"summary": summary})
+	return storage, summary, nil
+}
+
+// rescan rescans the Storage release for the new packages and merges them, returning their number.
+// Platform releases not modified since the previous fetch are not scanned again, keeping their packages.
+func (s *Storage) rescan(ctx context.Context, ghClient *github.Client, dq *net.DownloadQueue, cfg *viper.Viper, releaseTag string) (int, error) {
+	releases, err := getAllReleasesByTag(ctx, ghClient, cfg, releaseTag, tagPattern(cfg))
+	if err != nil {
+		return 0, fmt.Errorf("unable to get latest releases from Github: %w", err)
+	}
+
+	var (
+		summary   = ScanSummary{ReleaseDate: releaseTag}
+		budget    = net.NewRetryBudget(cfg.GetInt("net.retry_budget"))
+		rescanned = &Storage{ScannedAt: time.Now()}
+	)
+	for _, release := range releases {
+		if release.notModified {
+			log.WithField("release_date", releaseTag).Debugf("Release %s is not modified, skipping it", release.GetHTMLURL())
+			continue
+		}
+		if err = rescanned.scanRelease(ctx, dq, cfg, release.RepositoryRelease, budget, &summary); err != nil {
+			return 0, err
+		}
+	}
+	return s.Merge(rescanned), nil
+}
 
-			if strings.HasSuffix(name, "md5") {
-				md5Slice = append(md5Slice, asset)
+// scanRelease adds the packages from the release assets to the Storage and counts them in the summary
+func (s *Storage) scanRelease(ctx context.Context, dq *net.DownloadQueue, cfg *viper.Viper, release *github.RepositoryRelease, budget *net.RetryBudget, summary *ScanSummary) error {
+	var (
+		aggregateName = cfg.GetString("gapps.md5_aggregate")
+		zipSlice      = make([]github.ReleaseAsset, 0, len(release.Assets))
+		md5Assets     = make(map[string]github.ReleaseAsset, len(release.Assets))
+		checksums     map[string]string
+		mtx           sync.Mutex
+		err           error
+	)
+
+	// Sort out zip and MD5's
+	for _, asset := range release.Assets {
+		name := asset.GetName()
+		if aggregateName != "" && name == aggregateName {
+			if checksums, err = getChecksumAggregate(ctx, dq, asset.GetBrowserDownloadURL()); err != nil {
+				return fmt.Errorf("unable to get checksum aggregate for release %s: %w", release.GetTagName(), err)
 			}
+			summary.Bytes += int64(asset.GetSize())
+			continue
 		}
 
-		// Sort out Packages and fill MD5's
-		var wg sync.WaitGroup
-		wg.Add(len(zipSlice))
-		for i := 0; i < len(zipSlice); i++ {
-			go func(wg *sync.WaitGroup, i int) {
-				defer wg.Done()
-				p, err := formPackage(dq, cfg, zipSlice[i], md5Slice[i])
-				if err != nil {
-					log.Errorf("Unable to form package: %v", err)
-					return
-				}
-				storage.Add(p)
-			}(&wg, i)
+		if packageExtension(cfg, name) != "" {
+			zipSlice = append(zipSlice, asset)
+		}
+
+		if strings.HasSuffix(name, md5Extension) {
+			md5Assets[name] = asset
 		}
-		wg.Wait()
 	}
 
-	return storage, nil
+	// Match the MD5's with zips by name
+	md5Slice := make([]github.ReleaseAsset, len(zipSlice))
+	for i := range zipSlice {
+		md5Slice[i] = matchMD5Asset(cfg, zipSlice[i], md5Assets)
+	}
+
+	// Sort out Packages and fill MD5's
+	var wg sync.WaitGroup
+	wg.Add(len(zipSlice))
+	summary.Found += len(zipSlice)
+	for i := 0; i < len(zipSlice); i++ {
+		go func(wg *sync.WaitGroup, i int) {
+			defer wg.Done()
+			p, err := formPackage(ctx, dq, cfg, release.GetTagName(), zipSlice[i], md5Slice[i], checksums, budget)
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			switch {
+			case errors.Is(err, errFiltered):
+				log.Debugf("Package %s is skipped by filters", zipSlice[i].GetName())
+				summary.Skipped++
+			case errors.Is(err, ErrBadPackageName):
+				log.Warnf("Asset %s is skipped: %v", zipSlice[i].GetName(), err)
+				summary.Unparsed++
+			case err != nil:
+				log.Errorf("Unable to form package: %v", err)
+				summary.Failed++
+			default:
+				s.Add(p)
+				summary.Added++
+				if p.MD5 != "" {
+					summary.Bytes += int64(md5Slice[i].GetSize())
+				}
+			}
+		}(&wg, i)
+	}
+	wg.Wait()
+	return nil
+}
+
+// matchMD5Asset returns the MD5 asset for the zip one.
+// If the release has none, the sidecar file URL is used, when it's enabled in config.
+func matchMD5Asset(cfg *viper.Viper, zipAsset github.ReleaseAsset, md5Assets map[string]github.ReleaseAsset) github.ReleaseAsset {
+	name := zipAsset.GetName() + md5Extension
+	if asset, ok := md5Assets[name]; ok {
+		return asset
+	}
+	if !cfg.GetBool("gapps.md5_sidecar") {
+		return github.ReleaseAsset{}
+	}
+
+	log.Debugf("Release has no MD5 for package %s, trying the sidecar file", zipAsset.GetName())
+	return github.ReleaseAsset{
+		Name:               github.String(name),
+		BrowserDownloadURL: github.String(zipAsset.GetBrowserDownloadURL() + md5Extension),
+	}
 }
 
 // Add safely adds a new package to the Storage
 func (s *Storage) Add(p *Package) {
 	s.mtx.Lock()
+	s.add(p)
+	s.mtx.Unlock()
+}
+
+// add adds the package if it's not in the Storage yet and reports if it was added
+func (s *Storage) add(p *Package) bool {
+	if s.Packages == nil {
+		s.Packages = make(map[gapps.Platform]map[gapps.Android]map[gapps.Variant]*Package)
+	}
 	if s.Packages[p.Platform] == nil {
 		s.Packages[p.Platform] = make(map[gapps.Android]map[gapps.Variant]*Package, len(gapps.AndroidValues()))
 	}
 	if s.Packages[p.Platform][p.Android] == nil {
 		s.Packages[p.Platform][p.Android] = make(map[gapps.Variant]*Package, len(gapps.VariantValues()))
 	}
-	if _, ok := s.Packages[p.Platform][p.Android][p.Variant]; !ok {
-		s.Count++
-		s.Packages[p.Platform][p.Android][p.Variant] = p
-	}
 	if s.Date == "" {
 		s.Date = p.Date
 	}
-	s.mtx.Unlock()
+	if _, ok := s.Packages[p.Platform][p.Android][p.Variant]; ok {
+		return false
+	}
+	s.Count++
+	s.Packages[p.Platform][p.Android][p.Variant] = p
+	knownChecksums.add(p)
+	return true
+}
+
+// Merge safely adds the packages from the rescanned Storage of the same release,
+// keeping the existing ones with their mirrors. Returns the number of the new packages.
+func (s *Storage) Merge(rescanned *Storage) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var count int
+	for _, p := range rescanned.List() {
+		if s.add(p) {
+			count++
+		}
+	}
+	s.ScannedAt = rescanned.ScannedAt
+	return count
+}
+
+// Stale checks if the Storage was scanned more than ttl ago. Non-positive ttl means it's never stale.
+func (s *Storage) Stale(ttl time.Duration) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return ttl > 0 && time.Since(s.ScannedAt) > ttl
 }
 
 // Get safely gets a package from the Storage
@@ -107,6 +268,106 @@ func (s *Storage) Get(p gapps.Platform, a gapps.Android, v gapps.Variant) (*Pack
 	return result, ok
 }
 
+// GetOrMirror safely gets a package from the Storage and creates its mirror if there's none yet.
+// Concurrent calls for the same package share a single mirror creation,
+// which is aborted only if all of the callers have cancelled their ctx.
+// Partially created mirror is saved and returned along with its MirrorError.
+// If progress is not nil, it receives the shared download progress until GetOrMirror returns.
+func (s *Storage) GetOrMirror(ctx context.Context, p gapps.Platform, a gapps.Android, v gapps.Variant, dq *net.DownloadQueue, cfg *viper.Viper, progress net.ProgressFunc) (*Package, error) {
+	pkg, ok := s.Get(p, a, v)
+	if !ok {
+		return nil, ErrPackageNotFound
+	}
+	if pkg.Mirrored(cfg) {
+		return pkg, nil
+	}
+
+	return s.mirror(ctx, pkg, dq, cfg, progress, pkg.CreateMirror)
+}
+
+// Remirror safely recreates the package mirrors in the Storage, even if they already exist.
+// It shares the mirror creation with the concurrent GetOrMirror calls the same way,
+// and returns the partially created mirror along with its MirrorError.
+func (s *Storage) Remirror(ctx context.Context, p gapps.Platform, a gapps.Android, v gapps.Variant, dq *net.DownloadQueue, cfg *viper.Viper, progress net.ProgressFunc) (*Package, error) {
+	pkg, ok := s.Get(p, a, v)
+	if !ok {
+		return nil, ErrPackageNotFound
+	}
+	return s.mirror(ctx, pkg, dq, cfg, progress, pkg.Remirror)
+}
+
+// mirror runs the package mirror creation in the mirrors group and saves the Storage after it
+func (s *Storage) mirror(ctx context.Context, pkg *Package, dq *net.DownloadQueue, cfg *viper.Viper, progress net.ProgressFunc,
+	create func(context.Context, *net.DownloadQueue, *viper.Viper, net.ProgressFunc) error) (*Package, error) {
+	if progress != nil {
+		stop := pkg.progress.Report(progress)
+		defer stop()
+	}
+
+	_, shared, err := mirrors.DoContext(ctx, pkg.Name, func(ctx context.Context) (interface{}, error) {
+		pkg.progress.Set(0, 0)
+		if err := create(ctx, dq, cfg, pkg.progress.Set); err != nil {
+			if errors.Is(err, ErrMirrorPartial) {
+				if err := s.Save(); err != nil {
+					log.Errorf("Unable to save storage: %v", err)
+				}
+			}
+			return nil, err
+		}
+		if err := s.Save(); err != nil {
+			log.Errorf("Unable to save storage: %v", err)
+		}
+		return nil, nil
+	})
+	if errors.Is(err, ErrMirrorPartial) {
+		return pkg, fmt.Errorf("unable to create mirror: %w", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to create mirror: %w", err)
+	}
+	if shared {
+		log.Debugf("Mirror for the package %s was shared", pkg.Name)
+	}
+	return pkg, nil
+}
+
+// List safely returns all the packages from the Storage
+func (s *Storage) List() []*Package {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	result := make([]*Package, 0, s.Count)
+	for _, androids := range s.Packages {
+		for _, variants := range androids {
+			for _, p := range variants {
+				result = append(result, p)
+			}
+		}
+	}
+	return result
+}
+
+// FindByTag safely finds all packages in the Storage with the provided tag value
+func (s *Storage) FindByTag(key, value string) []*Package {
+	var result []*Package
+	for _, p := range s.List() {
+		if v, ok := p.Tag(key); ok && v == value {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// Pinned checks if any of the Storage packages has the PinnedTag
+func (s *Storage) Pinned() bool {
+	for _, p := range s.List() {
+		if _, ok := p.Tag(PinnedTag); ok {
+			return true
+		}
+	}
+	return false
+}
+
 // Delete safely deletes a package from the Storage (if it's there)
 func (s *Storage) Delete(p *Package) {
 	s.mtx.Lock()
@@ -115,11 +376,15 @@ func (s *Storage) Delete(p *Package) {
 	if s.Packages[p.Platform] == nil || s.Packages[p.Platform][p.Android] == nil {
 		return
 	}
+	if _, ok := s.Packages[p.Platform][p.Android][p.Variant]; !ok {
+		return
+	}
 
+	s.Count--
 	delete(s.Packages[p.Platform][p.Android], p.Variant)
 }
 
-// Save saves the Storage to the cache
+// Save saves the Storage to the cache, and its packages to the package DB, if it's set
 func (s *Storage) Save() error {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
@@ -135,12 +400,28 @@ func (s *Storage) Save() error {
 	if err = s.cache.Put(s.Date, body); err != nil {
 		return fmt.Errorf("unable to save storage %s to cache: %w", s.Date, err)
 	}
+
+	if s.index == nil {
+		return nil
+	}
+	packages := make([]*Package, 0, s.Count)
+	for _, androids := range s.Packages {
+		for _, variants := range androids {
+			for _, p := range variants {
+				packages = append(packages, p)
+			}
+		}
+	}
+	if err = s.index.Put(packages...); err != nil {
+		return fmt.Errorf("unable to save storage %s packages to DB: %w", s.Date, err)
+	}
 	return nil
 }
 
-// GetLatestReleaseDate returns the date for the latest OpenGApps release
-func GetLatestReleaseDate(ctx context.Context, ghClient *github.Client, repo string) (string, error) {
-	releases, err := getAllReleasesByTag(ctx, ghClient, repo, CurrentStorageKey)
+// GetLatestReleaseDate returns the date for the latest OpenGApps release.
+// If the pattern is not nil, only the releases with the matching tags are considered.
+func GetLatestReleaseDate(ctx context.Context, ghClient *github.Client, cfg *viper.Viper, pattern *regexp.Regexp) (string, error) {
+	releases, err := getAllReleasesByTag(ctx, ghClient, cfg, CurrentStorageKey, pattern)
 	if err != nil {
 		return "", fmt.Errorf("unable to get latest releases from Github: %w", err)
 	}
@@ -154,42 +435,152 @@ func GetLatestReleaseDate(ctx context.Context, ghClient *github.Client, repo str
 	return releaseDates[0], nil
 }
 
-func getAllReleasesByTag(ctx context.Context, ghClient *github.Client, repo, tag string) ([]*github.RepositoryRelease, error) {
+// GetLatestReleaseDates returns the latest OpenGApps release date for each platform.
+// Platforms which release is unavailable are skipped.
+func GetLatestReleaseDates(ctx context.Context, ghClient *github.Client, cfg *viper.Viper) (map[gapps.Platform]string, error) {
+	pattern := tagPattern(cfg)
+	dates := make(map[gapps.Platform]string, len(gapps.PlatformValues()))
+	for _, platform := range gapps.PlatformValues() {
+		release, err := getRelease(ctx, ghClient, cfg, platform, CurrentStorageKey, pattern)
+		if err != nil {
+			log.Errorf("Unable to get release from Github: %v", err)
+			continue
+		}
+		dates[platform] = release.GetTagName()
+	}
+	if len(dates) == 0 {
+		return nil, errors.New("no releases available")
+	}
+	return dates, nil
+}
+
+// fetchedRelease is the platform release fetched from Github
+type fetchedRelease struct {
+	*github.RepositoryRelease
+	// notModified is set if Github responded 304 Not Modified, so the cached release is used
+	notModified bool
+}
+
+func getAllReleasesByTag(ctx context.Context, ghClient *github.Client, cfg *viper.Viper, tag string, pattern *regexp.Regexp) ([]*fetchedRelease, error) {
+	releases := make([]*fetchedRelease, 0, len(gapps.PlatformValues()))
+	var notModified int
+	for _, platform := range gapps.PlatformValues() {
+		release, err := getRelease(ctx, ghClient, cfg, platform, tag, pattern)
+		if err != nil {
+			log.Errorf("Unable to get release from Github: %v", err)
+			continue
+		}
+		if release.notModified {
+			notModified++
+		}
+		releases = append(releases, release)
+	}
+	if len(releases) == 0 {
+		return nil, errors.New("no releases available")
+	}
+	log.WithField("tag", tag).WithField("fetched", len(releases)-notModified).WithField("not_modified", notModified).
+		Info("Github releases refreshed")
+	return releases, nil
+}
+
+// getRelease returns the platform release by its tag, or the latest one if the tag is empty or "current".
+// The request is conditional if the release was fetched before.
+func getRelease(ctx context.Context, ghClient *github.Client, cfg *viper.Viper, platform gapps.Platform, tag string, pattern *regexp.Regexp) (*fetchedRelease, error) {
 	var (
-		releases = make([]*github.RepositoryRelease, len(gapps.PlatformValues()))
-		release  *github.RepositoryRelease
-		resp     *github.Response
-		count    int
-		err      error
+		owner, repo = platformRepo(cfg, platform)
+		release     = &fetchedRelease{}
+		resp        *github.Response
+		err         error
 	)
-	if tag == "" {
-		tag = CurrentStorageKey
+	switch {
+	case (tag == "" || tag == CurrentStorageKey) && pattern != nil:
+		release, resp, err = getLatestMatchingRelease(ctx, ghClient, owner, repo, pattern)
+	case tag == "" || tag == CurrentStorageKey:
+		u := fmt.Sprintf("repos/%s/%s/releases/latest", owner, repo)
+		resp, release.notModified, err = getConditional(ctx, ghClient, u, &release.RepositoryRelease)
+	default:
+		u := fmt.Sprintf("repos/%s/%s/releases/tags/%s", owner, repo, tag)
+		resp, release.notModified, err = getConditional(ctx, ghClient, u, &release.RepositoryRelease)
+	}
+	logRate(resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && !release.notModified {
+		return nil, fmt.Errorf("bad response: %s", resp.Status)
+	}
+	if release.RepositoryRelease == nil {
+		return nil, errors.New("bad response: release is nil")
 	}
+	return release, nil
+}
 
+// platformRepo returns the Github owner and repo of the platform releases,
+// which are github.owner and github.repo formatted with the platform name
+func platformRepo(cfg *viper.Viper, platform gapps.Platform) (owner, repo string) {
+	repo = cfg.GetString("github.repo")
+	if strings.Contains(repo, "%s") {
+		repo = fmt.Sprintf(repo, platform)
+	}
+	return cfg.GetString("github.owner"), repo
+}
+
+// PlatformByRepo returns the platform which releases are published in the Github repo.
+// It reports false if the repo is not configured for any platform.
+func PlatformByRepo(cfg *viper.Viper, owner, repo string) (gapps.Platform, bool) {
 	for _, platform := range gapps.PlatformValues() {
-		if tag == CurrentStorageKey {
-			release, resp, err = ghClient.Repositories.GetLatestRelease(ctx, repo, platform.String())
-		} else {
-			release, resp, err = ghClient.Repositories.GetReleaseByTag(ctx, repo, platform.String(), tag)
+		if o, r := platformRepo(cfg, platform); strings.EqualFold(o, owner) && strings.EqualFold(r, repo) {
+			return platform, true
 		}
+	}
+	return 0, false
+}
+
+// getLatestMatchingRelease returns the newest release with the tag matching the pattern.
+// Github lists the releases from the newest ones, so the first match is used.
+// The release is not modified if none of the listed pages are.
+func getLatestMatchingRelease(ctx context.Context, ghClient *github.Client, owner, repo string, pattern *regexp.Regexp) (*fetchedRelease, *github.Response, error) {
+	notModified := true
+	for page := 1; ; {
+		var releases []*github.RepositoryRelease
+		u := fmt.Sprintf("repos/%s/%s/releases?per_page=100&page=%d", owner, repo, page)
+		resp, cached, err := getConditional(ctx, ghClient, u, &releases)
+		logRate(resp)
 		if err != nil {
-			log.Errorf("Unable to get release from Github: %v", err)
-			continue
+			return nil, resp, err
 		}
-		resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			log.Errorf("Unable to get release from Github with bad response: %s", resp.Status)
-			continue
+		notModified = notModified && cached
+		for _, release := range releases {
+			if !release.GetDraft() && pattern.MatchString(release.GetTagName()) {
+				return &fetchedRelease{RepositoryRelease: release, notModified: notModified}, resp, nil
+			}
 		}
-		if release == nil {
-			log.Error("Unable to get release from Github with bad response: release is nil")
-			continue
+		if resp.NextPage == 0 {
+			return nil, resp, fmt.Errorf("no release of %s/%s matches the tag pattern %s", owner, repo, pattern)
 		}
-		releases[count] = release
-		count++
+		page = resp.NextPage
 	}
-	if count == 0 {
-		return nil, errors.New("no releases available")
+}
+
+// logRate logs the Github API rate limit from the response
+func logRate(resp *github.Response) {
+	if resp == nil {
+		return
+	}
+	log.WithField("limit", resp.Rate.Limit).WithField("remaining", resp.Rate.Remaining).
+		WithField("reset", resp.Rate.Reset.Time).Debug("Github API rate limit")
+}
+
+// tagPattern returns the github.tag_pattern regexp, or nil if it's not set
+func tagPattern(cfg *viper.Viper) *regexp.Regexp {
+	pattern := cfg.GetString("github.tag_pattern")
+	if pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Errorf("Unable to compile the tag pattern, using the latest release: %v", err)
+		return nil
 	}
-	return releases[:count-1], nil
+	return re
 }
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/net"
+
+	"github.com/google/go-github/v29/github"
+)
+
+// testRelease describes the release listed by the test Github server
+type testRelease struct {
+	tag   string
+	draft bool
+}
+
+// newTestGithub starts the Github API server which lists the releases of the repo o/r by the pages,
+// and returns the client for it
+func newTestGithub(t *testing.T, pages [][]testRelease) (*github.Client, func()) {
+	t.Helper()
+
+	toJSON := func(releases []testRelease) []*github.RepositoryRelease {
+		result := make([]*github.RepositoryRelease, 0, len(releases))
+		for _, r := range releases {
+			result = append(result, &github.RepositoryRelease{TagName: github.String(r.tag), Draft: github.Bool(r.draft)})
+		}
+		return result
+	}
+
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/o/r/releases", func(w http.ResponseWriter, r *http.Request) {
+		var page int
+		fmt.Sscan(r.URL.Query().Get("page"), &page)
+		if page < 1 || page > len(pages) {
+			http.NotFound(w, r)
+			return
+		}
+		if page < len(pages) {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/repos/o/r/releases?per_page=100&page=%d>; rel="next"`, srv.URL, page+1))
+		}
+		json.NewEncoder(w).Encode(toJSON(pages[page-1]))
+	})
+	mux.HandleFunc("/repos/o/r/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(toJSON([]testRelease{{tag: "latest"}})[0])
+	})
+	mux.HandleFunc("/repos/o/r/releases/tags/", func(w http.ResponseWriter, r *http.Request) {
+		tag := r.URL.Path[len("/repos/o/r/releases/tags/"):]
+		json.NewEncoder(w).Encode(toJSON([]testRelease{{tag: tag}})[0])
+	})
+	srv = httptest.NewServer(mux)
+
+	client := github.NewClient(nil)
+	baseURL, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.BaseURL = baseURL
+	return client, srv.Close
+}
+
+func TestGetReleaseTagPattern(t *testing.T) {
+	pages := [][]testRelease{
+		{{tag: "20200103", draft: true}, {tag: "nightly-20200102"}, {tag: "20200102-test"}},
+		{{tag: "beta"}, {tag: "20200101"}, {tag: "20191231"}},
+	}
+
+	tests := []struct {
+		name    string
+		tag     string
+		pattern string
+		want    string
+		wantErr bool
+	}{
+		{name: "latest without pattern", want: "latest"},
+		{name: "current without pattern", tag: CurrentStorageKey, want: "latest"},
+		{name: "tag", tag: "20190101", pattern: `^\d{8}$`, want: "20190101"},
+		{name: "first page match", pattern: `^nightly-`, want: "nightly-20200102"},
+		{name: "draft is skipped", pattern: `^20200103$`, wantErr: true},
+		{name: "next page match", pattern: `^\d{8}$`, want: "20200101"},
+		{name: "current with pattern", tag: CurrentStorageKey, pattern: `^\d{8}$`, want: "20200101"},
+		{name: "no match", pattern: `^stable-`, wantErr: true},
+	}
+
+	client, stop := newTestGithub(t, pages)
+	defer stop()
+
+	cfg := testConfig()
+	cfg.Set("github.owner", "o")
+	cfg.Set("github.repo", "r")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pattern *regexp.Regexp
+			if tt.pattern != "" {
+				pattern = regexp.MustCompile(tt.pattern)
+			}
+
+			release, err := getRelease(context.Background(), client, cfg, gapps.PlatformArm64, tt.tag, pattern)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("getRelease() = %s, want error", release.GetTagName())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getRelease() error = %v", err)
+			}
+			if got := release.GetTagName(); got != tt.want {
+				t.Errorf("getRelease() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		wantNil bool
+	}{
+		{"empty", "", true},
+		{"invalid", "(", true},
+		{"valid", `^\d{8}$`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Set("github.tag_pattern", tt.pattern)
+			if got := tagPattern(cfg); (got == nil) != tt.wantNil {
+				t.Errorf("tagPattern(%q) = %v", tt.pattern, got)
+			}
+		})
+	}
+}
+
+func TestScanReleaseUnknownAssets(t *testing.T) {
+	tests := []struct {
+		name         string
+		assets       []string
+		wantAdded    int
+		wantUnparsed int
+		wantFailed   int
+	}{
+		{
+			name:      "valid only",
+			assets:    []string{"open_gapps-arm64-10.0-nano-20200101.zip", "open_gapps-arm-9.0-pico-20200101.zip"},
+			wantAdded: 2,
+		},
+		{
+			name: "unknown parts skipped",
+			assets: []string{
+				"open_gapps-arm64-10.0-nano-20200101.zip",
+				"open_gapps-riscv64-10.0-nano-20200101.zip",
+				"open_gapps-arm64-99.0-nano-20200101.zip",
+				"open_gapps-arm64-10.0-giant-20200101.zip",
+			},
+			wantAdded:    1,
+			wantUnparsed: 3,
+		},
+		{
+			name:         "malformed names skipped",
+			assets:       []string{"open_gapps-arm64-10.0-nano.zip", "open_gapps-arm64-10.0-nano-2020x101.zip"},
+			wantUnparsed: 2,
+		},
+		{
+			name:      "other assets ignored",
+			assets:    []string{"open_gapps-arm64-10.0-nano-20200101.zip", "README.txt", "sources.tar.gz"},
+			wantAdded: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "%s  %s", testMD5, strings.TrimSuffix(r.URL.Path[1:], md5Extension))
+			}))
+			defer srv.Close()
+
+			release := &github.RepositoryRelease{TagName: github.String("20200101")}
+			for _, name := range tt.assets {
+				for _, n := range []string{name, name + md5Extension} {
+					release.Assets = append(release.Assets, github.ReleaseAsset{
+						Name:               github.String(n),
+						BrowserDownloadURL: github.String(srv.URL + "/" + n),
+					})
+				}
+			}
+
+			s := &Storage{}
+			var summary ScanSummary
+			err := s.scanRelease(context.Background(), net.NewQueue(1), testConfig(), release, net.NewRetryBudget(10), &summary)
+			if err != nil {
+				t.Fatalf("scanRelease() error = %v", err)
+			}
+			if summary.Found != tt.wantAdded+tt.wantUnparsed+tt.wantFailed {
+				t.Errorf("found %d packages, want %d", summary.Found, tt.wantAdded+tt.wantUnparsed+tt.wantFailed)
+			}
+			if summary.Added != tt.wantAdded || summary.Unparsed != tt.wantUnparsed || summary.Failed != tt.wantFailed {
+				t.Errorf("added %d, unparsed %d, failed %d packages, want %d, %d, %d",
+					summary.Added, summary.Unparsed, summary.Failed, tt.wantAdded, tt.wantUnparsed, tt.wantFailed)
+			}
+			if got := len(s.List()); got != tt.wantAdded {
+				t.Errorf("storage has %d packages, want %d", got, tt.wantAdded)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// ErrWebDAVUnauthorized is returned when the WebDAV server rejects the credentials
+var ErrWebDAVUnauthorized = errors.New("WebDAV server rejected the credentials")
+
+// webdavProvider uploads the files to the WebDAV share (Nextcloud, ownCloud etc.)
+type webdavProvider struct {
+	url       string
+	user      string
+	password  string
+	publicURL string
+	maxSize   int64
+}
+
+func newWebDAVProvider(cfg *viper.Viper) *webdavProvider {
+	return &webdavProvider{
+		url:       strings.TrimSuffix(cfg.GetString("gapps.webdav.url"), "/"),
+		user:      cfg.GetString("gapps.webdav.user"),
+		password:  cfg.GetString("gapps.webdav.password"),
+		publicURL: cfg.GetString("gapps.webdav.public_url"),
+		maxSize:   providerMaxSize(cfg, "gapps.webdav.max_size"),
+	}
+}
+
+func (w *webdavProvider) Name() string {
+	return "webdav"
+}
+
+func (w *webdavProvider) MaxSize() int64 {
+	return w.maxSize
+}
+
+func (w *webdavProvider) Upload(ctx context.Context, p *Package, file *os.File) (string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("unable to stat the file: %w", err)
+	}
+	return w.put(ctx, p, file, info.Size())
+}
+
+func (w *webdavProvider) Stream(ctx context.Context, p *Package, body io.Reader, size int64) (string, error) {
+	return w.put(ctx, p, body, size)
+}
+
+// put uploads the package under the Platform/Date/Name path, creating its collections first.
+// The result is the gapps.webdav.public_url link with the path, or the WebDAV file URL if it's not set.
+func (w *webdavProvider) put(ctx context.Context, p *Package, body io.Reader, size int64) (string, error) {
+	path := p.localPath("")
+	if err := w.mkcol(ctx, path); err != nil {
+		return "", err
+	}
+
+	resp, err := w.do(ctx, http.MethodPut, path, body, size)
+	if err != nil {
+		return "", fmt.Errorf("unable to make upload request: %w", err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+	case http.StatusConflict:
+		return "", fmt.Errorf("unable to upload %s: parent collection is missing", path)
+	default:
+		return "", fmt.Errorf("unable to upload %s: %s", path, resp.Status)
+	}
+
+	if w.publicURL != "" {
+		return fmt.Sprintf(w.publicURL, path), nil
+	}
+	return w.url + "/" + path, nil
+}
+
+// Delete deletes the package file, the missing one is considered deleted
+func (w *webdavProvider) Delete(ctx context.Context, p *Package) error {
+	path := p.localPath("")
+	resp, err := w.do(ctx, http.MethodDelete, path, nil, 0)
+	if err != nil {
+		return fmt.Errorf("unable to make delete request: %w", err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("unable to delete %s: %s", path, resp.Status)
+	}
+}
+
+// mkcol creates all the parent collections of the path, one by one
+func (w *webdavProvider) mkcol(ctx context.Context, path string) error {
+	parts := strings.Split(path, "/")
+	for i := 1; i < len(parts); i++ {
+		collection := strings.Join(parts[:i], "/")
+		resp, err := w.do(ctx, "MKCOL", collection, nil, 0)
+		if err != nil {
+			return fmt.Errorf("unable to create collection %s: %w", collection, err)
+		}
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusCreated, http.StatusMethodNotAllowed: // created or already exists
+		case http.StatusConflict:
+			return fmt.Errorf("unable to create collection %s: parent collection is missing", collection)
+		default:
+			return fmt.Errorf("unable to create collection %s: %s", collection, resp.Status)
+		}
+	}
+	return nil
+}
+
+// do makes the request to the path with the basic auth, if the user is set
+func (w *webdavProvider) do(ctx context.Context, method, path string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, w.url+"/"+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %w", err)
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/zip")
+	}
+	if w.user != "" {
+		req.SetBasicAuth(w.user, w.password)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		return nil, ErrWebDAVUnauthorized
+	}
+	return resp, nil
+}
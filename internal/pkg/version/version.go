@@ -0,0 +1,35 @@
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Build info, set via ldflags
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// BuildInfo describes the bot build
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Info returns the bot build info
+func Info() BuildInfo {
+	return BuildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+}
+
+func (i BuildInfo) String() string {
+	return fmt.Sprintf("%s (commit %s, built %s with %s)", i.Version, i.Commit, i.BuildDate, i.GoVersion)
+}
@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/v29/github"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	signatureHeader = "X-Hub-Signature-256"
+	signaturePrefix = "sha256="
+	maxPayloadSize  = 5 << 20 // release payloads list all the assets, so they could be large
+)
+
+// ReleaseFunc receives the published release of the repository
+type ReleaseFunc func(owner, repo string, release *github.RepositoryRelease)
+
+// Handler returns the handler for the Github webhooks signed with the secret.
+// fn is called in the background for each published release,
+// and all the other events are ignored.
+func Handler(secret string, fn ReleaseFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadSize))
+		if err != nil {
+			log.Warnf("Unable to read the webhook payload: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !validSignature(secret, r.Header.Get(signatureHeader), payload) {
+			log.Warn("Webhook with the invalid signature is rejected")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		eventType := github.WebHookType(r)
+		if eventType != "release" {
+			log.WithField("event", eventType).Debug("Webhook is ignored")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		event, err := github.ParseWebHook(eventType, payload)
+		if err != nil {
+			log.Warnf("Unable to parse the webhook payload: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		release, ok := event.(*github.ReleaseEvent)
+		if !ok || release.GetAction() != "published" || release.Release == nil {
+			log.WithField("action", release.GetAction()).Debug("Release webhook is ignored")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		log.WithField("repo", release.GetRepo().GetFullName()).WithField("tag", release.GetRelease().GetTagName()).
+			Info("Release published")
+		go fn(release.GetRepo().GetOwner().GetLogin(), release.GetRepo().GetName(), release.Release)
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// validSignature checks the HMAC SHA256 signature of the payload
+func validSignature(secret, signature string, payload []byte) bool {
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, signaturePrefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hmac.Equal(got, mac.Sum(nil))
+}
@@ -2,14 +2,22 @@ package main
 
 import (
 	"context"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/api"
 	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/config"
 	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/db"
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/events"
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/fileserver"
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/health"
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/metrics"
 	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/storage"
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/version"
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/webhook"
 	"github.com/nezorflame/opengapps-mirror-bot/pkg/net"
 	"github.com/nezorflame/opengapps-mirror-bot/pkg/telegram"
 
@@ -19,6 +27,13 @@ import (
 	"golang.org/x/oauth2"
 )
 
+const (
+	// shutdownCleanupTimeout is how long the cancelled mirrors are given to clean up on shutdown
+	shutdownCleanupTimeout = 10 * time.Second
+	// requestsFlushPeriod is how often the package request counts are saved to the DB
+	requestsFlushPeriod = time.Minute
+)
+
 var configName string
 
 func init() {
@@ -47,32 +62,73 @@ func main() {
 	defer cancel()
 
 	// init config and tracing
-	log.Info("Starting the bot")
+	log.Infof("Starting the bot %s", version.Info())
 	cfg, err := config.New(configName)
 	if err != nil {
 		log.Fatalf("Unable to init config: %v", err)
 	}
 	log.Info("Config parsed")
 
-	// init Github client
+	// init event stream
+	if eventsFile := cfg.GetString("events.file"); eventsFile != "" {
+		log.Info("Opening the event stream")
+		if err = events.OpenFile(eventsFile); err != nil {
+			log.Fatalf("Unable to init event stream: %v", err)
+		}
+	}
+
+	// init HTTP transport for all the outbound requests
+	transport, err := net.NewTransport(cfg.GetString("net.http_proxy"), cfg.GetString("net.https_proxy"))
+	if err != nil {
+		log.Fatalf("Unable to init HTTP transport: %v", err)
+	}
+	storage.SetHTTPClient(&http.Client{Transport: transport})
+
+	// init Github client, anonymous one is heavily rate limited
 	log.Info("Creating Github client")
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: cfg.GetString("github.token")},
-	)
-	tc := oauth2.NewClient(ctx, ts)
+	tc := &http.Client{Transport: transport}
+	if token := cfg.GetString("github.token"); token != "" {
+		ts := oauth2.StaticTokenSource(
+			&oauth2.Token{AccessToken: token},
+		)
+		tc = oauth2.NewClient(context.WithValue(ctx, oauth2.HTTPClient, tc), ts)
+	} else {
+		log.Warn("Github token is not set, using the anonymous client")
+	}
 	gh := github.NewClient(tc)
 
 	// init download queue and cache
 	log.Info("Creating download queue")
-	dq := net.NewQueue(cfg.GetInt("max_downloads"))
+	maxDownloads := cfg.GetInt("net.max_concurrent")
+	if maxDownloads <= 0 {
+		maxDownloads = cfg.GetInt("max_downloads")
+	}
+	dq := net.NewQueue(maxDownloads,
+		net.WithContentTypes(cfg.GetStringSlice("net.zip_content_types")...),
+		net.WithRetries(cfg.GetInt("net.retry_count"), cfg.GetDuration("net.retry_base_delay")),
+		net.WithObserver(metrics.ObserveDownload),
+		net.WithRateLimit(cfg.GetInt64("net.max_bytes_per_sec")),
+		net.WithTempDir(cfg.GetString("net.temp_dir")),
+		net.WithTransport(transport),
+	)
+	metrics.RegisterQueue(dq.Depth)
 	cache, err := db.NewDB(cfg.GetString("db.path"), cfg.GetDuration("db.timeout"))
 	if err != nil {
 		log.Fatal(err)
 	}
+	index, err := storage.NewDB(cache, cfg.GetDuration("db.index_ttl"))
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// init GApps global storage
 	log.Info("Initiating GApps global storage")
 	gs := storage.NewGlobalStorage(cache)
+	metrics.RegisterFreshness(func() (time.Duration, error) {
+		f, err := gs.Freshness(cfg)
+		return f.Lag, err
+	})
+	gs.SetDB(index)
 	if err = gs.Load(); err != nil {
 		log.Fatalf("Unable to load the global storage from cache: %v", err)
 	}
@@ -81,6 +137,22 @@ func main() {
 		log.Fatalf("Unable to add the latest storage: %v", err)
 	}
 
+	// prewarm the popular mirrors
+	go gs.Prewarm(ctx, dq, cfg)
+
+	// remove the expired local mirrors
+	pruneExpired := func() {
+		if cfg.GetInt("gapps.local_retention_days") <= 0 {
+			return
+		}
+		if count, err := gs.PruneExpired(cfg); err != nil {
+			log.Errorf("Unable to remove the expired mirrors: %v", err)
+		} else if count > 0 {
+			log.WithField("count", count).Info("Expired mirrors removed")
+		}
+	}
+	pruneExpired()
+
 	// init package watcher
 	log.Info("Initiating GApps package watcher")
 	go func() {
@@ -92,6 +164,13 @@ func main() {
 				if err = gs.AddLatestStorage(ctx, gh, dq, cfg); err != nil {
 					log.Errorf("Unable to add the latest storage: %v", err)
 				}
+				pruneExpired()
+				if f, err := gs.Freshness(cfg); err != nil {
+					log.Errorf("Unable to check the mirror freshness: %v", err)
+				} else if f.Status == storage.FreshnessBehind {
+					log.WithField("local", f.Local).WithField("upstream", f.Upstream).
+						WithField("lag", f.Lag).Warn("Mirror is behind the upstream")
+				}
 			case <-ctx.Done():
 				log.Warnf("Closing the watcher by context: %v", ctx.Err())
 				ticker.Stop()
@@ -100,6 +179,65 @@ func main() {
 		}
 	}()
 
+	// save the package request counts in the background, so that the commands don't wait for the DB
+	go func() {
+		ticker := time.NewTicker(requestsFlushPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := gs.FlushRequests(); err != nil {
+					log.Errorf("Unable to save the request counts: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// init HTTP endpoints, the ones with the same listen address share the server
+	muxes := make(map[string]*http.ServeMux)
+	handle := func(addr, path string, h http.Handler) {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		muxes[addr].Handle(path, h)
+		log.Infof("Serving %s on %s", path, addr)
+	}
+	if cfg.GetBool("metrics.enabled") {
+		handle(cfg.GetString("metrics.listen"), cfg.GetString("metrics.path"), metrics.Handler())
+	}
+	if cfg.GetBool("api.enabled") {
+		handle(cfg.GetString("api.listen"), cfg.GetString("api.path"), api.PackagesHandler(gs))
+	}
+	if cfg.GetBool("health.enabled") {
+		handle(cfg.GetString("health.listen"), cfg.GetString("health.live_path"), health.LiveHandler())
+		handle(cfg.GetString("health.listen"), cfg.GetString("health.ready_path"), health.ReadyHandler(cfg, gh))
+		handle(cfg.GetString("health.listen"), cfg.GetString("health.freshness_path"), health.FreshnessHandler(cfg, gs))
+	}
+	if cfg.GetBool("serve.enabled") {
+		handle(cfg.GetString("serve.listen"), cfg.GetString("serve.path"),
+			fileserver.Handler(cfg.GetString("gapps.local_path"), cfg.GetString("serve.path"), cfg.GetStringSlice("gapps.extensions"), gs))
+	}
+	if cfg.GetBool("webhook.enabled") {
+		handle(cfg.GetString("webhook.listen"), cfg.GetString("webhook.path"), webhook.Handler(cfg.GetString("webhook.secret"),
+			func(owner, repo string, release *github.RepositoryRelease) {
+				platform, ok := storage.PlatformByRepo(cfg, owner, repo)
+				if !ok {
+					log.Warnf("Release of the unknown repository %s/%s is ignored", owner, repo)
+					return
+				}
+				gs.MirrorRelease(ctx, gh, dq, cfg, platform, release)
+			}))
+	}
+	for addr, mux := range muxes {
+		go func(addr string, mux *http.ServeMux) {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				log.Errorf("Unable to serve HTTP on %s: %v", addr, err)
+			}
+		}(addr, mux)
+	}
+
 	// create bot
 	bot, err := telegram.NewBot(ctx, cfg, dq, gs, gh)
 	if err != nil {
@@ -109,19 +247,43 @@ func main() {
 
 	// init graceful stop chan
 	log.Debug("Initiating system signal watcher")
-	var gracefulStop = make(chan os.Signal)
+	var gracefulStop = make(chan os.Signal, 1)
 	signal.Notify(gracefulStop, syscall.SIGTERM)
 	signal.Notify(gracefulStop, syscall.SIGINT)
 
 	go func() {
 		sig := <-gracefulStop
 		log.Warnf("Caught sig %+v, stopping the app", sig)
-		cancel()
 		bot.Stop()
+
+		// let the mirrors in progress finish, and cancel the ones which take too long
+		storage.StopMirrors()
+		waitCtx, waitCancel := context.WithTimeout(context.Background(), cfg.GetDuration("shutdown_timeout"))
+		summary := storage.WaitMirrors(waitCtx)
+		waitCancel()
+		cancel()
+		if summary.Active > 0 {
+			log.WithField("count", summary.Active).Warn("Cancelling the mirrors in progress")
+			cleanupCtx, cleanupCancel := context.WithTimeout(context.Background(), shutdownCleanupTimeout)
+			summary = storage.WaitMirrors(cleanupCtx)
+			cleanupCancel()
+		}
+		log.WithField("completed", summary.Completed).WithField("failed", summary.Failed).
+			WithField("cancelled", summary.Cancelled+summary.Active).Info("Mirrors stopped")
+
 		gs.Save()
+		if err = gs.FlushRequests(); err != nil {
+			log.Errorf("Unable to save the request counts: %v", err)
+		}
+		if err = index.Close(); err != nil {
+			log.WithError(err).Error("Unable to close the package DB")
+		}
 		if err = cache.Close(false); err != nil {
 			log.WithError(err).Error("Unable to close DB")
 		}
+		if err = events.Close(); err != nil {
+			log.WithError(err).Error("Unable to close the event stream")
+		}
 		os.Exit(0)
 	}()
 
@@ -0,0 +1,73 @@
+package gapps
+
+import "fmt"
+
+// Combo describes the package Platform, Android and Variant combination
+type Combo struct {
+	Platform Platform
+	Android  Android
+	Variant  Variant
+}
+
+// androidRange is the range of the supported Android versions, max is included
+type androidRange struct {
+	min, max Android
+}
+
+// Known OpenGApps build matrix
+var (
+	platformRanges = map[Platform]androidRange{
+		PlatformArm:    {Android44, Android100},
+		PlatformArm64:  {Android50, Android100}, // 64-bit builds start with Lollipop
+		PlatformX86:    {Android44, Android100},
+		PlatformX86_64: {Android50, Android100},
+	}
+	variantRanges = map[Variant]androidRange{
+		VariantTvstock: {Android50, Android100}, // Android TV starts with Lollipop
+		VariantPico:    {Android44, Android100},
+		VariantNano:    {Android44, Android100},
+		VariantMicro:   {Android50, Android90},
+		VariantMini:    {Android44, Android90},
+		VariantFull:    {Android44, Android90},
+		VariantStock:   {Android44, Android90},
+		VariantSuper:   {Android44, Android90},
+		VariantAroma:   {Android44, Android90}, // deprecated since Android 10
+	}
+)
+
+func (r androidRange) contains(a Android) bool {
+	return a >= r.min && a <= r.max
+}
+
+// IsValidCombo checks if OpenGApps builds the package for the combination
+func IsValidCombo(p Platform, a Android, v Variant) bool {
+	pr, ok := platformRanges[p]
+	if !ok || !pr.contains(a) {
+		return false
+	}
+	vr, ok := variantRanges[v]
+	return ok && vr.contains(a)
+}
+
+// CheckCombo returns ErrBadCombo if OpenGApps doesn't build the package for the combination
+func CheckCombo(p Platform, a Android, v Variant) error {
+	if !IsValidCombo(p, a, v) {
+		return fmt.Errorf("%w: %s-%s-%s", ErrBadCombo, p, a.HumanString(), v)
+	}
+	return nil
+}
+
+// ValidCombos returns all the combinations OpenGApps builds the packages for
+func ValidCombos() []Combo {
+	var result []Combo
+	for _, p := range PlatformValues() {
+		for _, a := range AndroidValues() {
+			for _, v := range VariantValues() {
+				if IsValidCombo(p, a, v) {
+					result = append(result, Combo{Platform: p, Android: a, Variant: v})
+				}
+			}
+		}
+	}
+	return result
+}
@@ -1,7 +1,10 @@
 package gapps
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 // Platform is an enum for different chip architectures
@@ -38,6 +41,30 @@ func (a Android) HumanString() string {
 	return result[:len(result)-1] + "." + result[len(result)-1:]
 }
 
+// Version returns the numeric major and minor Android version, like 10 and 0 for Android100.
+// Unknown versions are reported as 0.0.
+func (a Android) Version() (major, minor int) {
+	parts := strings.Split(a.HumanString(), ".")
+	var err error
+	if major, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0
+	}
+	if minor, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0
+	}
+	return major, minor
+}
+
+// Less reports whether the Android version is older than the other one
+func (a Android) Less(other Android) bool {
+	major, minor := a.Version()
+	otherMajor, otherMinor := other.Version()
+	if major != otherMajor {
+		return major < otherMajor
+	}
+	return minor < otherMinor
+}
+
 // Variant is an enum for different package variations
 type Variant uint
 
@@ -54,28 +81,45 @@ const (
 	VariantAroma
 )
 
-const parsingErrText = "parsing error: %w"
+// Parsing errors
+var (
+	ErrBadFormat   = errors.New("bad package format")
+	ErrBadPlatform = errors.New("unknown platform")
+	ErrBadAndroid  = errors.New("unknown Android version")
+	ErrBadVariant  = errors.New("unknown variant")
+	ErrBadCombo    = errors.New("package is not built for the combination")
+)
+
+const parsingErrText = "parsing error: %w: %v"
 
 // ParsePackageParts helps to parse package info args into proper parts
 func ParsePackageParts(args []string) (Platform, Android, Variant, error) {
 	if len(args) != 3 {
-		return 0, 0, 0, fmt.Errorf("bad number of arguments: want 4, got %d", len(args))
+		return 0, 0, 0, fmt.Errorf("%w: want 3 parts, got %d", ErrBadFormat, len(args))
 	}
 
 	platform, err := PlatformString(args[0])
 	if err != nil {
-		return 0, 0, 0, fmt.Errorf(parsingErrText, err)
+		return 0, 0, 0, fmt.Errorf(parsingErrText, ErrBadPlatform, err)
 	}
 
 	android, err := AndroidString(args[1])
 	if err != nil {
-		return 0, 0, 0, fmt.Errorf(parsingErrText, err)
+		return 0, 0, 0, fmt.Errorf(parsingErrText, ErrBadAndroid, err)
 	}
 
 	variant, err := VariantString(args[2])
 	if err != nil {
-		return 0, 0, 0, fmt.Errorf(parsingErrText, err)
+		return 0, 0, 0, fmt.Errorf(parsingErrText, ErrBadVariant, err)
 	}
 
 	return platform, android, variant, nil
 }
+
+// ParseDescriptor parses the package descriptor like "arm64-9.0-nano" or "arm64 9.0 nano"
+func ParseDescriptor(descriptor string) (Platform, Android, Variant, error) {
+	parts := strings.FieldsFunc(strings.Replace(descriptor, ".", "", -1), func(r rune) bool {
+		return r == ' ' || r == '-'
+	})
+	return ParsePackageParts(parts)
+}
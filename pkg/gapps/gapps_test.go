@@ -0,0 +1,59 @@
+package gapps
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestAndroidVersion(t *testing.T) {
+	tests := []struct {
+		android   Android
+		wantMajor int
+		wantMinor int
+	}{
+		{Android44, 4, 4},
+		{Android51, 5, 1},
+		{Android90, 9, 0},
+		{Android100, 10, 0},
+		{Android(99), 0, 0},
+	}
+
+	for _, tt := range tests {
+		if major, minor := tt.android.Version(); major != tt.wantMajor || minor != tt.wantMinor {
+			t.Errorf("%s.Version() = %d.%d, want %d.%d", tt.android, major, minor, tt.wantMajor, tt.wantMinor)
+		}
+	}
+}
+
+func TestAndroidLess(t *testing.T) {
+	tests := []struct {
+		a, b Android
+		want bool
+	}{
+		{Android44, Android50, true},
+		{Android50, Android44, false},
+		{Android90, Android100, true},
+		{Android100, Android90, false},
+		{Android80, Android81, true},
+		{Android81, Android81, false},
+		{Android(99), Android44, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.a.Less(tt.b); got != tt.want {
+			t.Errorf("%s.Less(%s) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestAndroidSort(t *testing.T) {
+	versions := []Android{Android100, Android44, Android90, Android81, Android50}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Less(versions[j]) })
+
+	want := []Android{Android44, Android50, Android81, Android90, Android100}
+	for i := range want {
+		if versions[i] != want[i] {
+			t.Fatalf("sorted versions = %v, want %v", versions, want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package gapps
+
+import "strconv"
+
+// Enum values are marshaled with MarshalJSON, but map keys use MarshalText,
+// so these are required for the Storage package maps to be readable.
+// Numeric keys are still accepted for the storages cached before.
+
+// MarshalText implements the encoding.TextMarshaler interface for Platform
+func (i Platform) MarshalText() ([]byte, error) {
+	return []byte(i.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface for Platform
+func (i *Platform) UnmarshalText(text []byte) error {
+	if n, err := strconv.ParseUint(string(text), 10, 0); err == nil {
+		*i = Platform(n)
+		return nil
+	}
+
+	var err error
+	*i, err = PlatformString(string(text))
+	return err
+}
+
+// MarshalText implements the encoding.TextMarshaler interface for Android
+func (i Android) MarshalText() ([]byte, error) {
+	return []byte(i.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface for Android.
+// Android values look like numbers too, so they are parsed as names first.
+func (i *Android) UnmarshalText(text []byte) error {
+	a, err := AndroidString(string(text))
+	if err == nil {
+		*i = a
+		return nil
+	}
+	if n, nErr := strconv.ParseUint(string(text), 10, 0); nErr == nil && Android(n).IsAAndroid() {
+		*i = Android(n)
+		return nil
+	}
+	return err
+}
+
+// MarshalText implements the encoding.TextMarshaler interface for Variant
+func (i Variant) MarshalText() ([]byte, error) {
+	return []byte(i.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface for Variant
+func (i *Variant) UnmarshalText(text []byte) error {
+	if n, err := strconv.ParseUint(string(text), 10, 0); err == nil {
+		*i = Variant(n)
+		return nil
+	}
+
+	var err error
+	*i, err = VariantString(string(text))
+	return err
+}
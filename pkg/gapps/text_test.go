@@ -0,0 +1,110 @@
+package gapps
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// testPackage mirrors the storage package fields and maps which use the enums
+type testPackage struct {
+	Platform Platform `json:"platform"`
+	Android  Android  `json:"android"`
+	Variant  Variant  `json:"variant"`
+}
+
+type testStorage struct {
+	Packages map[Platform]map[Android]map[Variant]*testPackage `json:"packages"`
+}
+
+func TestPackageJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		pkg  testPackage
+		want string
+	}{
+		{
+			name: "first values",
+			pkg:  testPackage{Platform: PlatformArm, Android: Android44, Variant: VariantTvstock},
+			want: `{"packages":{"arm":{"44":{"tvstock":{"platform":"arm","android":"44","variant":"tvstock"}}}}}`,
+		},
+		{
+			name: "last values",
+			pkg:  testPackage{Platform: PlatformX86_64, Android: Android100, Variant: VariantNano},
+			want: `{"packages":{"x86_64":{"100":{"nano":{"platform":"x86_64","android":"100","variant":"nano"}}}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkg := tt.pkg
+			s := testStorage{Packages: map[Platform]map[Android]map[Variant]*testPackage{
+				pkg.Platform: {pkg.Android: {pkg.Variant: &pkg}},
+			}}
+
+			body, err := json.Marshal(s)
+			if err != nil {
+				t.Fatalf("json.Marshal() error = %v", err)
+			}
+			if string(body) != tt.want {
+				t.Errorf("json.Marshal() = %s, want %s", body, tt.want)
+			}
+
+			var got testStorage
+			if err = json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("json.Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, s) {
+				t.Errorf("json.Unmarshal() = %+v, want %+v", got.Packages, s.Packages)
+			}
+		})
+	}
+}
+
+func TestUnmarshalTextNumeric(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    map[Platform]map[Android]map[Variant]int
+		wantErr bool
+	}{
+		{
+			name: "legacy numeric keys",
+			body: `{"1":{"9":{"3":1}}}`,
+			want: map[Platform]map[Android]map[Variant]int{PlatformArm64: {Android100: {Variant(3): 1}}},
+		},
+		{
+			name: "android name before its number",
+			body: `{"arm":{"44":{"nano":1}}}`,
+			want: map[Platform]map[Android]map[Variant]int{PlatformArm: {Android44: {VariantNano: 1}}},
+		},
+		{
+			name:    "unknown platform",
+			body:    `{"mips":{"100":{"nano":1}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown android number",
+			body:    `{"arm":{"11":{"nano":1}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown variant",
+			body:    `{"arm":{"100":{"huge":1}}}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[Platform]map[Android]map[Variant]int
+			err := json.Unmarshal([]byte(tt.body), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("json.Unmarshal() error = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("json.Unmarshal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,89 +1,408 @@
 package net
 
 import (
+	"context"
 	"crypto/md5"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Package errors
+var (
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrBadContentType   = errors.New("unexpected content type")
+	ErrShortDownload    = errors.New("short download")
+	ErrLongDownload     = errors.New("download is larger than expected")
+)
+
+// ShortDownloadError describes the download which is smaller than expected
+type ShortDownloadError struct {
+	Got  int64
+	Want int64
+}
+
+func (e *ShortDownloadError) Error() string {
+	return fmt.Sprintf("%v: got %d bytes, want %d", ErrShortDownload, e.Got, e.Want)
+}
+
+// Is allows to match the error with ErrShortDownload
+func (e *ShortDownloadError) Is(target error) bool {
+	return target == ErrShortDownload
+}
+
+// ChecksumError describes the download which MD5 checksum doesn't match the expected one
+type ChecksumError struct {
+	Got  string
+	Want string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%v: got %s, want %s", ErrChecksumMismatch, e.Got, e.Want)
+}
+
+// Is allows to match the error with ErrChecksumMismatch
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+const (
+	maxRedirects     = 10
+	defaultRetries   = 3
+	defaultBaseDelay = time.Second
+)
+
 // DownloadQueue is used to limit download process
 type DownloadQueue struct {
-	tokens chan struct{}
+	waiting      int64 // first for the 64-bit alignment of the atomic operations
+	tokens       chan struct{}
+	client       *http.Client
+	contentTypes []string
+	retries      int
+	baseDelay    time.Duration
+	observe      ObserveFunc
+	bytesPerSec  int64
+	tempDir      string
+	downloads    map[string]*download
+	mtx          sync.Mutex
+}
+
+// download describes the in-flight download shared by the concurrent callers
+type download struct {
+	progress Progress
+	done     chan struct{}
+	result   result
+	err      error
+	refs     int
+	cancel   context.CancelFunc
+}
+
+// result describes the downloaded temp file and its MD5 checksum computed during the download
+type result struct {
+	path   string
+	md5sum string
+}
+
+// downloadFunc downloads the file to the temp one, reporting its progress.
+// All the reads of the download are throttled by the same limit.
+type downloadFunc func(ctx context.Context, progress *Progress, limit *limiter) (result, error)
+
+// ObserveFunc receives the kind ("single" or "multi"), duration and error of each finished download
+type ObserveFunc func(kind string, duration time.Duration, err error)
+
+// Option describes the DownloadQueue option
+type Option func(dq *DownloadQueue)
+
+// WithContentTypes sets the allowed content types for the AddMultiple downloads.
+// Content type is not checked if the list is empty.
+func WithContentTypes(types ...string) Option {
+	return func(dq *DownloadQueue) {
+		dq.contentTypes = types
+	}
+}
+
+// WithRetries sets the number of download attempts for each of the AddMultiple segments
+// and the base delay between them, which grows exponentially with each attempt.
+// Non-positive count means the default one.
+func WithRetries(count int, baseDelay time.Duration) Option {
+	return func(dq *DownloadQueue) {
+		if count > 0 {
+			dq.retries = count
+		}
+		dq.baseDelay = baseDelay
+	}
+}
+
+// WithObserver sets the function which is called after each download, e.g. to collect the metrics.
+// Shared downloads are observed once.
+func WithObserver(fn ObserveFunc) Option {
+	return func(dq *DownloadQueue) {
+		dq.observe = fn
+	}
+}
+
+// WithRateLimit limits the speed of each download to bytesPerSec,
+// shared by all of its segments. Non-positive value means no limit.
+func WithRateLimit(bytesPerSec int64) Option {
+	return func(dq *DownloadQueue) {
+		dq.bytesPerSec = bytesPerSec
+	}
+}
+
+// WithTempDir sets the directory for the temp download files. Empty one means the OS temp dir.
+func WithTempDir(dir string) Option {
+	return func(dq *DownloadQueue) {
+		dq.tempDir = dir
+	}
 }
 
-// NewQueue creates a new instance of DownloadQueue
-func NewQueue(maxCount int) *DownloadQueue {
-	return &DownloadQueue{
-		tokens: make(chan struct{}, maxCount),
+// Depth returns the number of the active downloads and the ones waiting for a free slot
+func (dq *DownloadQueue) Depth() (active, waiting int) {
+	return len(dq.tokens), int(atomic.LoadInt64(&dq.waiting))
+}
+
+// NewQueue creates a new instance of DownloadQueue.
+// No more than maxCount downloads are active at once, the others wait for a free slot.
+func NewQueue(maxCount int, opts ...Option) *DownloadQueue {
+	dq := &DownloadQueue{
+		tokens:    make(chan struct{}, maxCount),
+		client:    &http.Client{CheckRedirect: checkRedirect},
+		retries:   defaultRetries,
+		baseDelay: defaultBaseDelay,
+		downloads: make(map[string]*download),
+	}
+	for _, opt := range opts {
+		opt(dq)
 	}
+	return dq
 }
 
 // AddSingle gets a file from URL in single thread
-func (dq *DownloadQueue) AddSingle(url string) (string, error) {
-	dq.acquire()
+func (dq *DownloadQueue) AddSingle(ctx context.Context, url string) (string, error) {
+	res, err := dq.shared(ctx, "single:"+url, nil, func(ctx context.Context, progress *Progress, limit *limiter) (result, error) {
+		return dq.single(ctx, url, false, progress, limit)
+	})
+	return res.path, err
+}
+
+func (dq *DownloadQueue) single(ctx context.Context, url string, checkType bool, progress *Progress, limit *limiter) (result, error) {
+	if err := dq.acquire(ctx); err != nil {
+		return result{}, err
+	}
 	defer dq.release()
 
-	resp, err := http.DefaultClient.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return "", fmt.Errorf("unable to make GET request: %w", err)
+		return result{}, fmt.Errorf("unable to create request: %w", err)
+	}
+
+	resp, err := dq.client.Do(req)
+	if err != nil {
+		return result{}, fmt.Errorf("unable to make GET request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	tmpFile, err := createTmpFile(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return result{}, fmt.Errorf("bad response status: %s", resp.Status)
+	}
+	if checkType {
+		if err = dq.checkContentType(resp); err != nil {
+			return result{}, err
+		}
+	}
+
+	if resp.ContentLength > 0 {
+		progress.SetTotal(resp.ContentLength)
+	}
+	hash := md5.New()
+	tmpFile, err := dq.createTmpFile(io.TeeReader(progress.Reader(limit.Reader(ctx, resp.Body)), hash))
+	if errors.Is(err, io.ErrUnexpectedEOF) && resp.ContentLength > 0 {
+		// the body is shorter than its Content-Length
+		done, _ := progress.Get()
+		err = &ShortDownloadError{Got: done, Want: resp.ContentLength}
+	}
 	if err != nil {
-		return "", fmt.Errorf("unable to create result file: %w", err)
+		return result{}, fmt.Errorf("unable to create result file: %w", err)
 	}
+	defer tmpFile.Close()
 
-	return tmpFile.Name(), nil
+	return result{path: tmpFile.Name(), md5sum: hex.EncodeToString(hash.Sum(nil))}, nil
 }
 
-// AddMultiple gets the file from URL in multiple threads
-func (dq *DownloadQueue) AddMultiple(url, md5sum string, limit, size int) (string, error) {
+// Head checks that the file from URL is available without downloading it
+// and returns its size, which is -1 if the server doesn't report it.
+// Content type is checked the same way as for AddMultiple.
+func (dq *DownloadQueue) Head(ctx context.Context, url string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create request: %w", err)
+	}
+
+	resp, err := dq.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("unable to make HEAD request: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("bad response status: %s", resp.Status)
+	}
+	if err = dq.checkContentType(resp); err != nil {
+		return 0, err
+	}
+	return resp.ContentLength, nil
+}
+
+// acceptsRanges checks if the server accepts the byte range requests for the file from URL
+func (dq *DownloadQueue) acceptsRanges(ctx context.Context, url string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := dq.client.Do(req)
+	if err != nil {
+		log.WithField("url", url).Debugf("Unable to check the byte ranges support: %v", err)
+		return false
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" {
+		log.WithField("url", url).Debug("Byte ranges are not accepted, using a single stream")
+		return false
+	}
+	return true
+}
+
+// Stream opens the file from URL for reading without saving it.
+// The file must have the provided size. Download is not shared with
+// other callers, and the queue slot is taken until the stream is closed.
+// The stream is read within the queue rate limit.
+func (dq *DownloadQueue) Stream(ctx context.Context, url string, size int64) (io.ReadCloser, error) {
+	if err := dq.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		dq.release()
+		return nil, fmt.Errorf("unable to create request: %w", err)
+	}
+
+	resp, err := dq.client.Do(req)
+	if err != nil {
+		dq.release()
+		return nil, fmt.Errorf("unable to make GET request: %w", err)
+	}
+
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		err = fmt.Errorf("bad response status: %s", resp.Status)
+	case resp.ContentLength != size:
+		err = fmt.Errorf("unexpected content length %d, want %d", resp.ContentLength, size)
+	default:
+		err = dq.checkContentType(resp)
+	}
+	if err != nil {
+		resp.Body.Close()
+		dq.release()
+		return nil, err
+	}
+
+	return &stream{Reader: newLimiter(dq.bytesPerSec).Reader(ctx, resp.Body), body: resp.Body, release: dq.release}, nil
+}
+
+// stream reads the response body within the queue rate limit,
+// and releases the queue slot when the body is closed
+type stream struct {
+	io.Reader
+	body    io.Closer
+	release func()
+	once    sync.Once
+}
+
+func (s *stream) Close() error {
+	err := s.body.Close()
+	s.once.Do(s.release)
+	return err
+}
+
+// AddMultiple gets the file from URL in multiple threads.
+// Download is aborted if ctx is cancelled by all of its callers.
+// Failed download of the file with known size keeps its partial files,
+// so the next call for the same URL and MD5 resumes it.
+// Each segment is retried if its size doesn't match the expected one,
+// and the result is discarded if it differs from the file size.
+// MD5 checksum of the file is computed during the download and returned
+// along with its path, so the file doesn't need to be read again.
+// If progress is not nil, it's called a few times a second until AddMultiple returns.
+// If limit is 1 or less, or the server doesn't accept the byte ranges,
+// the file is downloaded in a single stream instead, and its size and MD5 are checked the same way.
+// If MD5 checksum or the file size doesn't match, the whole file is downloaded again up to the retry count,
+// and ChecksumError, ErrShortDownload or ErrLongDownload is returned if the mismatch persists.
+func (dq *DownloadQueue) AddMultiple(ctx context.Context, url, md5sum string, limit, size int, progress ProgressFunc) (string, string, error) {
+	for attempt := 1; ; attempt++ {
+		path, sum, err := dq.addMultiple(ctx, url, md5sum, limit, size, progress)
+		var checksumErr *ChecksumError
+		if !errors.As(err, &checksumErr) && !errors.Is(err, ErrShortDownload) && !errors.Is(err, ErrLongDownload) {
+			return path, sum, err
+		}
+		if attempt >= dq.retries {
+			log.WithField("url", url).Errorf("Download mismatch persists after %d attempts: %v", attempt, err)
+			return "", "", err
+		}
+		log.WithField("url", url).Warnf("Downloading the file again (attempt %d/%d): %v", attempt, dq.retries, err)
+		if err = sleep(ctx, backoff(attempt, dq.baseDelay)); err != nil {
+			return "", "", err
+		}
+	}
+}
+
+func (dq *DownloadQueue) addMultiple(ctx context.Context, url, md5sum string, limit, size int, progress ProgressFunc) (string, string, error) {
 	var (
-		result string
-		err    error
+		res result
+		err error
 	)
 
 	switch {
-	case size > 0:
-		if result, err = dq.multi(url, size, limit); err != nil {
-			return "", errors.New("unable to download the file")
+	case size > 0 && limit > 1 && dq.acceptsRanges(ctx, url):
+		res, err = dq.shared(ctx, "multi:"+url, progress, func(ctx context.Context, p *Progress, l *limiter) (result, error) {
+			p.SetTotal(int64(size))
+			return dq.multi(ctx, url, md5sum, size, limit, p, l)
+		})
+		if err != nil {
+			return "", "", fmt.Errorf("unable to download the file: %w", err)
 		}
-	case size == 0:
-		if result, err = dq.AddSingle(url); err != nil {
-			return "", errors.New("unable to download the file")
+	case size >= 0:
+		res, err = dq.shared(ctx, "single-checked:"+url, progress, func(ctx context.Context, p *Progress, l *limiter) (result, error) {
+			return dq.single(ctx, url, true, p, l)
+		})
+		if err != nil {
+			return "", "", fmt.Errorf("unable to download the file: %w", err)
 		}
 	default:
-		return "", errors.New("file size must be more than 0")
+		return "", "", errors.New("file size must be more than 0")
 	}
 
-	if md5sum != "" {
-		if check, err := checkMD5(result, md5sum); err != nil {
-			return "", fmt.Errorf("unable to check MD5 checksum: %w", err)
-		} else if !check {
-			return "", errors.New("checksum mismatch")
+	if size > 0 {
+		if err = checkSize(res.path, int64(size)); err != nil {
+			_ = os.Remove(res.path)
+			return "", "", err
 		}
 	}
 
-	return result, nil
+	if md5sum != "" && !strings.EqualFold(res.md5sum, md5sum) {
+		_ = os.Remove(res.path)
+		return "", "", &ChecksumError{Got: res.md5sum, Want: md5sum}
+	}
+
+	return res.path, res.md5sum, nil
 }
 
-func (dq *DownloadQueue) multi(url string, size, limit int) (string, error) {
-	dq.acquire()
+func (dq *DownloadQueue) multi(ctx context.Context, url, md5sum string, size, limit int, progress *Progress, throttle *limiter) (result, error) {
+	if err := dq.acquire(ctx); err != nil {
+		return result{}, err
+	}
 	defer dq.release()
 
 	var wg sync.WaitGroup
 	wg.Add(limit)
 	lenSub, diff := size/limit, size%limit
-	tmpFileNames := make([]string, limit)
+	partNames := partFileNames(dq.tempDir, url, md5sum, size, limit)
+	errs := make([]error, limit)
 	for i := 0; i < limit; i++ {
 		min, max := lenSub*i, lenSub*(i+1)
 		if i == limit-1 {
@@ -91,48 +410,299 @@ func (dq *DownloadQueue) multi(url string, size, limit int) (string, error) {
 		}
 
 		go func(min, max, i int) {
-			req, _ := http.NewRequest(http.MethodGet, url, nil)
-			rangeHeader := "bytes=" + strconv.Itoa(min) + "-" + strconv.Itoa(max-1)
-			req.Header.Add("Range", rangeHeader)
-
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				log.Errorf("Unable to make request: %v", err)
-				return
+			defer wg.Done()
+			for attempt := 1; attempt <= dq.retries; attempt++ {
+				if errs[i] = dq.segment(ctx, url, min, max, partNames[i], progress, throttle); errs[i] == nil || errors.Is(errs[i], ErrBadContentType) {
+					return
+				}
+				log.Warnf("Unable to download segment %d (attempt %d/%d): %v", i, attempt, dq.retries, errs[i])
+				if attempt == dq.retries {
+					errs[i] = fmt.Errorf("failed after %d attempts: %w", attempt, errs[i])
+					return
+				}
+				if err := sleep(ctx, backoff(attempt, dq.baseDelay)); err != nil {
+					return
+				}
 			}
-			defer resp.Body.Close()
+		}(min, max, i)
+	}
+	wg.Wait()
 
-			tmpFile, err := createTmpFile(resp.Body)
-			if err != nil {
-				log.Errorf("Unable to make temp file: %v", err)
-				return
+	for i := range errs {
+		if errs[i] != nil {
+			// partial files are kept, so that the next download can resume them
+			if ctx.Err() != nil || errors.Is(errs[i], ErrBadContentType) {
+				removeFiles(partNames)
 			}
+			return result{}, fmt.Errorf("unable to download segment %d: %w", i, errs[i])
+		}
+	}
 
-			tmpFileNames[i] = tmpFile.Name()
-			tmpFile.Close()
-			wg.Done()
-		}(min, max, i)
+	// the result gets a new temp file name, so it's not resumed by the next download
+	res, err := dq.joinFiles(partNames)
+	removeFiles(partNames)
+	if err != nil {
+		return result{}, fmt.Errorf("unable to create result file: %w", err)
+	}
+	return res, nil
+}
+
+// segment downloads the [min, max) byte range of the file to the partial file at path.
+// If the partial file already has some bytes, the download is resumed after them,
+// unless the server doesn't accept the byte ranges for sure.
+// Request is always made to the origin URL, so that any redirect
+// (e.g. to the signed CDN URL, which can expire) is resolved anew.
+func (dq *DownloadQueue) segment(ctx context.Context, url string, min, max int, path string, progress *Progress, limit *limiter) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open partial file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat partial file: %w", err)
+	}
+	done := int(info.Size())
+	switch {
+	case done == max-min:
+		log.WithField("path", path).Debug("Segment is already downloaded")
+		progress.Add(int64(done))
+		return nil
+	case done > max-min:
+		done = 0
+	case done > 0:
+		log.WithField("path", path).WithField("offset", done).Debug("Resuming the segment download")
+	}
+	if err = truncate(file, done); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %w", err)
+	}
+	req.Header.Add("Range", "bytes="+strconv.Itoa(min+done)+"-"+strconv.Itoa(max-1))
+
+	resp, err := dq.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("bad response status: %s", resp.Status)
+	}
+	if err = dq.checkContentType(resp); err != nil {
+		return err
 	}
-	wg.Wait()
 
-	tmpFileName, err := joinFiles(tmpFileNames)
+	// failed and resumed bytes are counted only when the segment succeeds,
+	// so that the retries don't count them twice
+	written, err := io.Copy(file, progress.Reader(limit.Reader(ctx, resp.Body)))
 	if err != nil {
-		return "", fmt.Errorf("unable to create result file: %w", err)
+		progress.Add(-written)
+		// start from scratch next time if we can't resume
+		if resp.Header.Get("Accept-Ranges") != "bytes" {
+			_ = truncate(file, 0)
+		}
+		return fmt.Errorf("unable to write partial file: %w", err)
+	}
+
+	if err = checkSize(path, int64(max-min)); err != nil {
+		progress.Add(-written)
+		_ = truncate(file, 0)
+		return err
+	}
+	progress.Add(int64(done))
+
+	return nil
+}
+
+// truncate truncates the file to the size and moves the write offset to its end
+func truncate(file *os.File, size int) error {
+	if err := file.Truncate(int64(size)); err != nil {
+		return fmt.Errorf("unable to truncate partial file: %w", err)
+	}
+	if _, err := file.Seek(int64(size), io.SeekStart); err != nil {
+		return fmt.Errorf("unable to seek partial file: %w", err)
+	}
+	return nil
+}
+
+// partFileNames returns the partial file names for the download segments.
+// Names are the same for the same file, so the interrupted download can be resumed.
+func partFileNames(dir, url, md5sum string, size, limit int) []string {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	key := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s|%s|%d|%d", url, md5sum, size, limit))))
+	names := make([]string, limit)
+	for i := range names {
+		names[i] = filepath.Join(dir, fmt.Sprintf("%s-%d.part", key, i))
+	}
+	return names
+}
+
+// shared deduplicates the concurrent downloads with the same key.
+// The file is downloaded once, and each caller receives its own hard link
+// (or copy) of the result, so that it's free to move or remove its file.
+// Callers can stop waiting by cancelling their ctx: the download itself
+// is aborted and cleaned up only when all of its callers have left.
+// If progress is not nil, it receives the shared download progress until shared returns.
+func (dq *DownloadQueue) shared(ctx context.Context, key string, progress ProgressFunc, fn downloadFunc) (result, error) {
+	dq.mtx.Lock()
+	d, ok := dq.downloads[key]
+	if ok {
+		d.refs++
+		log.WithField("key", key).Debug("Waiting for the in-flight download")
+	} else {
+		downloadCtx, cancel := context.WithCancel(context.Background())
+		d = &download{done: make(chan struct{}), refs: 1, cancel: cancel}
+		dq.downloads[key] = d
+		go dq.run(downloadCtx, key, d, fn)
+	}
+	dq.mtx.Unlock()
+
+	if progress != nil {
+		stop := d.progress.Report(progress)
+		defer stop()
+	}
+
+	select {
+	case <-d.done:
+		return dq.claim(d)
+	case <-ctx.Done():
+		dq.leave(key, d)
+		return result{}, ctx.Err()
+	}
+}
+
+// run executes the shared download and removes its result if all the callers have left
+func (dq *DownloadQueue) run(ctx context.Context, key string, d *download, fn downloadFunc) {
+	defer d.cancel()
+	start := time.Now()
+	res, err := fn(ctx, &d.progress, newLimiter(dq.bytesPerSec))
+	if dq.observe != nil {
+		dq.observe(downloadKind(key), time.Since(start), err)
+	}
+
+	dq.mtx.Lock()
+	defer dq.mtx.Unlock()
+	if dq.downloads[key] == d {
+		delete(dq.downloads, key)
+	}
+	d.result, d.err = res, err
+	if d.refs == 0 && err == nil {
+		_ = os.Remove(res.path)
+	}
+	close(d.done)
+}
+
+// downloadKind returns the kind of the download by its shared key
+func downloadKind(key string) string {
+	if strings.HasPrefix(key, "multi:") {
+		return "multi"
+	}
+	return "single"
+}
+
+// claim returns the shared download result to the caller.
+// The last caller gets the result file itself, others get its links.
+func (dq *DownloadQueue) claim(d *download) (result, error) {
+	dq.mtx.Lock()
+	defer dq.mtx.Unlock()
+
+	d.refs--
+	switch {
+	case d.err != nil:
+		return result{}, d.err
+	case d.refs == 0:
+		return d.result, nil
+	default:
+		path, err := dq.linkTmpFile(d.result.path)
+		return result{path: path, md5sum: d.result.md5sum}, err
+	}
+}
+
+// leave drops the caller from the shared download.
+// When no callers are left, the download is aborted and its result is removed.
+func (dq *DownloadQueue) leave(key string, d *download) {
+	dq.mtx.Lock()
+	defer dq.mtx.Unlock()
+
+	if d.refs--; d.refs > 0 {
+		return
+	}
+	if dq.downloads[key] == d {
+		delete(dq.downloads, key)
+	}
+	d.cancel()
+
+	select {
+	case <-d.done:
+		if d.err == nil {
+			_ = os.Remove(d.result.path)
+		}
+	default:
+		log.WithField("key", key).Debug("Aborting the download, all of its callers have left")
 	}
+}
 
-	return tmpFileName, nil
+// checkContentType checks the response content type against the allowed ones
+func (dq *DownloadQueue) checkContentType(resp *http.Response) error {
+	if len(dq.contentTypes) == 0 {
+		return nil
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBadContentType, contentType)
+	}
+	for _, t := range dq.contentTypes {
+		if strings.EqualFold(mediaType, t) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrBadContentType, mediaType)
 }
 
-func (dq *DownloadQueue) acquire() {
-	dq.tokens <- struct{}{}
+// acquire takes the download slot, waiting for it until ctx is done
+func (dq *DownloadQueue) acquire(ctx context.Context) error {
+	select {
+	case dq.tokens <- struct{}{}:
+		return nil
+	default:
+	}
+
+	atomic.AddInt64(&dq.waiting, 1)
+	defer atomic.AddInt64(&dq.waiting, -1)
+	log.WithField("active", len(dq.tokens)).Debug("Download is queued until a slot frees")
+	select {
+	case dq.tokens <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (dq *DownloadQueue) release() {
 	<-dq.tokens
 }
 
-func createTmpFile(content io.Reader) (*os.File, error) {
-	file, err := ioutil.TempFile("", "*")
+// checkRedirect limits the redirect chain. Redirect targets are never cached,
+// every request is made to the origin URL and redirected again
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	log.WithField("origin", via[0].URL.Host).WithField("target", req.URL.Host).Debug("Following redirect")
+	return nil
+}
+
+func (dq *DownloadQueue) createTmpFile(content io.Reader) (*os.File, error) {
+	file, err := ioutil.TempFile(dq.tempDir, "*")
 	if err != nil {
 		return nil, fmt.Errorf("unable to create file: %w", err)
 	}
@@ -140,54 +710,114 @@ func createTmpFile(content io.Reader) (*os.File, error) {
 	if content != nil {
 		if _, err = io.Copy(file, content); err != nil {
 			file.Close()
+			_ = os.Remove(file.Name())
 			return nil, fmt.Errorf("unable to write file content: %w", err)
 		}
 	}
 	return file, nil
 }
 
-func joinFiles(filepaths []string) (string, error) {
-	if len(filepaths) <= 0 {
-		return "", errors.New("nothing to merge")
+// linkTmpFile creates a new temp file which is a hard link to the source,
+// or its copy if the link can't be created
+func (dq *DownloadQueue) linkTmpFile(src string) (string, error) {
+	file, err := dq.createTmpFile(nil)
+	if err != nil {
+		return "", err
+	}
+	path := file.Name()
+	file.Close()
+	if err = os.Remove(path); err != nil {
+		return "", fmt.Errorf("unable to prepare temp file: %w", err)
 	}
 
-	if len(filepaths) == 1 {
-		return filepaths[0], nil
+	if err = os.Link(src, path); err == nil {
+		return path, nil
 	}
 
-	dest, err := os.OpenFile(filepaths[0], os.O_APPEND|os.O_WRONLY, 0644)
+	source, err := os.Open(src)
 	if err != nil {
-		return "", fmt.Errorf("unable to open destination file: %w", err)
+		return "", fmt.Errorf("unable to open source file: %w", err)
+	}
+	defer source.Close()
+
+	dest, err := dq.createTmpFile(source)
+	if err != nil {
+		return "", fmt.Errorf("unable to copy source file: %w", err)
+	}
+	defer dest.Close()
+
+	return dest.Name(), nil
+}
+
+// joinFiles joins the files into the new temp file, computing its MD5 checksum on the way.
+// Source files are left as is.
+func (dq *DownloadQueue) joinFiles(filepaths []string) (result, error) {
+	if len(filepaths) <= 0 {
+		return result{}, errors.New("nothing to merge")
+	}
+
+	dest, err := dq.createTmpFile(nil)
+	if err != nil {
+		return result{}, err
 	}
 	defer dest.Close()
 
-	var source *os.File
-	for i := 1; i < len(filepaths); i++ {
-		if source, err = os.Open(filepaths[i]); err != nil {
-			return "", fmt.Errorf("unable to open destination file: %w", err)
+	hash := md5.New()
+	w := io.MultiWriter(dest, hash)
+	for i := range filepaths {
+		if err = appendFile(w, filepaths[i]); err != nil {
+			_ = os.Remove(dest.Name())
+			return result{}, fmt.Errorf("unable to append source file %d to destination: %w", i, err)
 		}
-		_, err := io.Copy(dest, source)
-		_ = source.Close()
-		_ = os.Remove(filepaths[i])
-		if err != nil {
-			return "", fmt.Errorf("unable to append source file %d to destination: %w", i, err)
+	}
+	return result{path: dest.Name(), md5sum: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+func appendFile(w io.Writer, path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open source file: %w", err)
+	}
+	defer source.Close()
+
+	_, err = io.Copy(w, source)
+	return err
+}
+
+// checkSize checks that the file has exactly the expected size
+func checkSize(path string, want int64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("unable to stat the file: %w", err)
+	}
+	switch got := info.Size(); {
+	case got < want:
+		return &ShortDownloadError{Got: got, Want: want}
+	case got > want:
+		return fmt.Errorf("%w: got %d bytes, want %d", ErrLongDownload, got, want)
+	}
+	return nil
+}
+
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		if path != "" {
+			_ = os.Remove(path)
 		}
 	}
-	return filepaths[0], nil
 }
 
-func checkMD5(path, md5sum string) (bool, error) {
+// CheckMD5 checks the MD5 checksum of the file
+func CheckMD5(path, md5sum string) (bool, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return false, fmt.Errorf("unable to open the file: %w", err)
 	}
 	defer file.Close()
 
-	content, err := ioutil.ReadAll(file)
-	if err != nil {
+	hash := md5.New()
+	if _, err = io.Copy(hash, file); err != nil {
 		return false, fmt.Errorf("unable to read the file: %w", err)
 	}
-
-	result := fmt.Sprintf("%x", md5.Sum(content))
-	return result == md5sum, nil
+	return hex.EncodeToString(hash.Sum(nil)) == md5sum, nil
 }
@@ -0,0 +1,457 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testContent returns the test file content of the size
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+func md5Hex(b []byte) string {
+	sum := md5.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// newTestQueue returns the queue with no delay between the retries, downloading to the temp dir,
+// and the function which removes the dir
+func newTestQueue(t *testing.T, maxCount int, opts ...Option) (*DownloadQueue, string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]Option{WithRetries(3, 0), WithTempDir(dir)}, opts...)
+	return NewQueue(maxCount, opts...), dir, func() { os.RemoveAll(dir) }
+}
+
+// tempFiles returns the names of the files left in the dir
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+// truncatedWriter drops the response body after the first bytes, so that the client gets the unexpected EOF
+type truncatedWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (w *truncatedWriter) Write(b []byte) (int, error) {
+	if len(b) > w.left {
+		b = b[:w.left]
+	}
+	w.left -= len(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// TestAddMultipleExpiredRedirect checks that the retry is made to the origin URL, which redirects
+// to the fresh signed URL, and not to the expired one the previous attempt was redirected to
+func TestAddMultipleExpiredRedirect(t *testing.T) {
+	content := testContent(64 << 10)
+	var (
+		mtx     sync.Mutex
+		tokens  int
+		expired = make(map[string]bool)
+		stale   int
+		origins int
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/origin", func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		tokens++
+		if r.Method == http.MethodGet {
+			origins++
+		}
+		token := strconv.Itoa(tokens)
+		mtx.Unlock()
+		http.Redirect(w, r, "/cdn?token="+token, http.StatusFound)
+	})
+	mux.HandleFunc("/cdn", func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		mtx.Lock()
+		if expired[token] {
+			stale++
+			mtx.Unlock()
+			http.Error(w, "signature expired", http.StatusForbidden)
+			return
+		}
+		first := r.Method == http.MethodGet && len(expired) == 0
+		if first {
+			// the signed URL expires in the middle of the first transfer
+			expired[token] = true
+		}
+		mtx.Unlock()
+
+		w.Header().Set("Content-Type", "application/zip")
+		if first {
+			w = &truncatedWriter{ResponseWriter: w, left: len(content) / 8}
+		}
+		http.ServeContent(w, r, "package.zip", time.Time{}, bytes.NewReader(content))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	dq, _, cleanup := newTestQueue(t, 1)
+	defer cleanup()
+
+	path, sum, err := dq.AddMultiple(context.Background(), srv.URL+"/origin", md5Hex(content), 2, len(content), nil)
+	if err != nil {
+		t.Fatalf("AddMultiple() error = %v", err)
+	}
+	defer os.Remove(path)
+
+	if sum != md5Hex(content) {
+		t.Errorf("AddMultiple() md5 = %s, want %s", sum, md5Hex(content))
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("AddMultiple() file content doesn't match")
+	}
+	if stale > 0 {
+		t.Errorf("expired signed URL was requested %d times", stale)
+	}
+	// two segments and the retry of the failed one
+	if origins != 3 {
+		t.Errorf("origin GET requests = %d, want 3", origins)
+	}
+}
+
+func TestAddMultipleSegmentRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		segments int
+	}{
+		{"single attempt", 1, 2},
+		{"non-positive count keeps the default", 0, 2},
+		{"configured attempts", 5, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gets int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Accept-Ranges", "bytes")
+				if r.Method == http.MethodHead {
+					return
+				}
+				atomic.AddInt32(&gets, 1)
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			}))
+			defer srv.Close()
+
+			dq, dir, cleanup := newTestQueue(t, 1, WithRetries(tt.retries, 0))
+			defer cleanup()
+
+			_, _, err := dq.AddMultiple(context.Background(), srv.URL+"/file.zip", "", tt.segments, 64<<10, nil)
+			if err == nil {
+				t.Fatal("AddMultiple() error = nil")
+			}
+			want := tt.retries
+			if want <= 0 {
+				want = 3 // set by newTestQueue
+			}
+			if got := atomic.LoadInt32(&gets); got != int32(want*tt.segments) {
+				t.Errorf("got %d segment requests, want %d", got, want*tt.segments)
+			}
+			if !strings.Contains(err.Error(), fmt.Sprintf("failed after %d attempts", want)) {
+				t.Errorf("AddMultiple() error = %v", err)
+			}
+			// partial files are kept for the resume, but they're empty
+			for _, name := range tempFiles(t, dir) {
+				if info, err := os.Stat(filepath.Join(dir, name)); err != nil || info.Size() != 0 {
+					t.Errorf("partial file %s has data", name)
+				}
+			}
+		})
+	}
+}
+
+// TestAddMultipleSizeRetries checks that the file is downloaded again
+// if the response is shorter than its Content-Length or the file is larger than expected
+func TestAddMultipleSizeRetries(t *testing.T) {
+	content := testContent(64 << 10)
+	tests := []struct {
+		name      string
+		truncated int32
+		size      int
+		wantGets  int32
+		wantErr   error
+	}{
+		{name: "short once", truncated: 1, size: len(content), wantGets: 2},
+		{name: "short twice", truncated: 2, size: len(content), wantGets: 3},
+		{name: "short persists", truncated: 3, size: len(content), wantGets: 3, wantErr: ErrShortDownload},
+		{name: "long persists", size: len(content) - 1, wantGets: 3, wantErr: ErrLongDownload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gets int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet && atomic.AddInt32(&gets, 1) <= tt.truncated {
+					w = &truncatedWriter{ResponseWriter: w, left: len(content) / 2}
+				}
+				http.ServeContent(w, r, "package.zip", time.Time{}, bytes.NewReader(content))
+			}))
+			defer srv.Close()
+
+			dq, dir, cleanup := newTestQueue(t, 1)
+			defer cleanup()
+
+			path, sum, err := dq.AddMultiple(context.Background(), srv.URL+"/file.zip", "", 1, tt.size, nil)
+			if got := atomic.LoadInt32(&gets); got != tt.wantGets {
+				t.Errorf("got %d requests, want %d", got, tt.wantGets)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("AddMultiple() error = %v, want %v", err, tt.wantErr)
+				}
+				if files := tempFiles(t, dir); len(files) != 0 {
+					t.Errorf("temp files %v are left", files)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AddMultiple() error = %v", err)
+			}
+			if sum != md5Hex(content) {
+				t.Errorf("AddMultiple() MD5 = %s, want %s", sum, md5Hex(content))
+			}
+			if got, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(got, content) {
+				t.Errorf("downloaded file doesn't match the content: %v", err)
+			}
+		})
+	}
+}
+
+// TestAddMultipleCancel checks that the download cancelled in the middle
+// leaves neither the temp file nor the partial ones
+func TestAddMultipleCancel(t *testing.T) {
+	content := testContent(64 << 10)
+	tests := []struct {
+		name  string
+		limit int
+	}{
+		{"single stream", 1},
+		{"segments", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{}, tt.limit)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				if r.Method == http.MethodHead {
+					return
+				}
+				w.Write(content[:len(content)/4])
+				w.(http.Flusher).Flush()
+				started <- struct{}{}
+				<-r.Context().Done()
+			}))
+			defer srv.Close()
+
+			dq, dir, cleanup := newTestQueue(t, 1)
+			defer cleanup()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-started
+				cancel()
+			}()
+			if _, _, err := dq.AddMultiple(ctx, srv.URL+"/file.zip", "", tt.limit, len(content), nil); !errors.Is(err, context.Canceled) {
+				t.Fatalf("AddMultiple() error = %v, want %v", err, context.Canceled)
+			}
+
+			// the aborted download is cleaned up in the background
+			deadline := time.Now().Add(5 * time.Second)
+			for files := tempFiles(t, dir); len(files) > 0; files = tempFiles(t, dir) {
+				if time.Now().After(deadline) {
+					t.Fatalf("temp files %v are left", files)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// TestQueueLimit checks that no more than maxCount downloads are active at once,
+// and the queued ones wait for a free slot until their ctx is done
+func TestQueueLimit(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxCount    int
+		downloads   int
+		wantActive  int
+		wantWaiting int
+	}{
+		{"limit 1 serializes", 1, 2, 1, 1},
+		{"limit 2 runs both", 2, 2, 2, 0},
+		{"limit 2 queues the third", 2, 3, 2, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var active, maxActive int32
+			unblock := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&active, 1)
+				defer atomic.AddInt32(&active, -1)
+				for {
+					max := atomic.LoadInt32(&maxActive)
+					if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+						break
+					}
+				}
+				<-unblock
+				w.Write([]byte("gapps"))
+			}))
+			defer srv.Close()
+
+			dq, _, cleanup := newTestQueue(t, tt.maxCount)
+			defer cleanup()
+
+			errs := make(chan error, tt.downloads)
+			for i := 0; i < tt.downloads; i++ {
+				go func(i int) {
+					_, err := dq.AddSingle(context.Background(), srv.URL+"/file"+strconv.Itoa(i)+".zip")
+					errs <- err
+				}(i)
+			}
+
+			// wait for the queue to settle
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				gotActive, gotWaiting := dq.Depth()
+				if gotActive == tt.wantActive && gotWaiting == tt.wantWaiting && atomic.LoadInt32(&active) == int32(tt.wantActive) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Depth() = %d, %d, want %d, %d", gotActive, gotWaiting, tt.wantActive, tt.wantWaiting)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			close(unblock)
+			for i := 0; i < tt.downloads; i++ {
+				if err := <-errs; err != nil {
+					t.Errorf("AddSingle() error = %v", err)
+				}
+			}
+			if got := atomic.LoadInt32(&maxActive); got != int32(tt.wantActive) {
+				t.Errorf("got %d concurrent downloads, want %d", got, tt.wantActive)
+			}
+		})
+	}
+}
+
+func TestQueueCancelWaiting(t *testing.T) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		w.Write([]byte("gapps"))
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	dq, _, cleanup := newTestQueue(t, 1)
+	defer cleanup()
+
+	// waitDepth waits until the queue has the active and waiting downloads
+	waitDepth := func(wantActive, wantWaiting int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for active, waiting := dq.Depth(); active != wantActive || waiting != wantWaiting; active, waiting = dq.Depth() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Depth() = %d, %d, want %d, %d", active, waiting, wantActive, wantWaiting)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	go dq.AddSingle(context.Background(), srv.URL+"/first.zip")
+	waitDepth(1, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := dq.AddSingle(ctx, srv.URL+"/second.zip")
+		errs <- err
+	}()
+	waitDepth(1, 1)
+
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("AddSingle() error = %v, want %v", err, context.Canceled)
+	}
+	// the shared download leaves the queue once its last caller has left
+	waitDepth(1, 0)
+}
+
+func TestStreamRateLimit(t *testing.T) {
+	content := testContent(4 * 1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	// the burst is the whole second of the rate, so the rest takes about a second
+	dq, _, cleanup := newTestQueue(t, 1, WithRateLimit(2*1024))
+	defer cleanup()
+
+	start := time.Now()
+	stream, err := dq.Stream(context.Background(), srv.URL+"/file.zip", int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = stream.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("stream is read in %s, want at least a second", elapsed)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("stream content is corrupted")
+	}
+	if active, waiting := dq.Depth(); active != 0 || waiting != 0 {
+		t.Errorf("Depth() after Close() = %d, %d, want 0, 0", active, waiting)
+	}
+}
@@ -0,0 +1,80 @@
+package net
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const progressInterval = 500 * time.Millisecond
+
+// ProgressFunc receives the number of the downloaded bytes and the total file size.
+// Total is 0 if the size is not known yet.
+type ProgressFunc func(done, total int64)
+
+// Progress describes the download progress, which can be updated and reported concurrently
+type Progress struct {
+	done  int64
+	total int64
+}
+
+// Add adds n bytes to the downloaded ones
+func (p *Progress) Add(n int64) {
+	atomic.AddInt64(&p.done, n)
+}
+
+// Set sets the downloaded bytes and the total file size
+func (p *Progress) Set(done, total int64) {
+	atomic.StoreInt64(&p.done, done)
+	atomic.StoreInt64(&p.total, total)
+}
+
+// SetTotal sets the total file size
+func (p *Progress) SetTotal(total int64) {
+	atomic.StoreInt64(&p.total, total)
+}
+
+// Get returns the downloaded bytes and the total file size
+func (p *Progress) Get() (done, total int64) {
+	return atomic.LoadInt64(&p.done), atomic.LoadInt64(&p.total)
+}
+
+// Report calls fn with the progress a few times a second until stop is called.
+// fn is never called after stop returns.
+func (p *Progress) Report(fn ProgressFunc) (stop func()) {
+	quit, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn(p.Get())
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-exited
+	}
+}
+
+// Reader returns the reader which adds all the bytes read from r to the progress
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, p: p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *Progress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.p.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,55 @@
+package net
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// NewTransport returns the HTTP transport which sends the http and https requests
+// through the httpProxy and httpsProxy. Empty proxy means the one from
+// the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables, as usual.
+func NewTransport(httpProxy, httpsProxy string) (*http.Transport, error) {
+	httpURL, err := parseProxy(httpProxy)
+	if err != nil {
+		return nil, fmt.Errorf("bad HTTP proxy: %w", err)
+	}
+	httpsURL, err := parseProxy(httpsProxy)
+	if err != nil {
+		return nil, fmt.Errorf("bad HTTPS proxy: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		switch {
+		case req.URL.Scheme == "http" && httpURL != nil:
+			return httpURL, nil
+		case req.URL.Scheme == "https" && httpsURL != nil:
+			return httpsURL, nil
+		default:
+			return http.ProxyFromEnvironment(req)
+		}
+	}
+	return transport, nil
+}
+
+// WithTransport sets the HTTP transport for the downloads, e.g. the one from NewTransport
+func WithTransport(transport http.RoundTripper) Option {
+	return func(dq *DownloadQueue) {
+		dq.client.Transport = transport
+	}
+}
+
+func parseProxy(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %s should have the scheme and host", proxy)
+	}
+	return u, nil
+}
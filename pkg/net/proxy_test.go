@@ -0,0 +1,107 @@
+package net
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewTransportProxy(t *testing.T) {
+	const (
+		httpProxy  = "http://http-proxy.local:3128"
+		httpsProxy = "http://https-proxy.local:3129"
+	)
+	tests := []struct {
+		name       string
+		httpProxy  string
+		httpsProxy string
+		url        string
+		want       string
+	}{
+		{"http via http proxy", httpProxy, httpsProxy, "http://origin.local/file.zip", httpProxy},
+		{"https via https proxy", httpProxy, httpsProxy, "https://origin.local/file.zip", httpsProxy},
+		{"https without https proxy", httpProxy, "", "https://origin.local/file.zip", ""},
+		{"http without http proxy", "", httpsProxy, "http://origin.local/file.zip", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, err := NewTransport(tt.httpProxy, tt.httpsProxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := transport.Proxy(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				// the environment proxy is used instead
+				want, _ := http.ProxyFromEnvironment(req)
+				if (got == nil) != (want == nil) || got != nil && got.String() != want.String() {
+					t.Errorf("Proxy(%s) = %v, want the environment one %v", tt.url, got, want)
+				}
+				return
+			}
+			if got == nil || got.String() != tt.want {
+				t.Errorf("Proxy(%s) = %v, want %s", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTransportBadProxy(t *testing.T) {
+	tests := []struct {
+		name       string
+		httpProxy  string
+		httpsProxy string
+	}{
+		{"no scheme", "proxy.local:3128", ""},
+		{"no host", "", "http://"},
+		{"unparsable", "http://proxy.local:port", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewTransport(tt.httpProxy, tt.httpsProxy); err == nil {
+				t.Errorf("NewTransport(%q, %q) error = nil", tt.httpProxy, tt.httpsProxy)
+			}
+		})
+	}
+}
+
+// TestNewTransportRouting checks that the download is made through the proxy
+func TestNewTransportRouting(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("gapps"))
+	}))
+	defer proxy.Close()
+
+	transport, err := NewTransport(proxy.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dq, _, cleanup := newTestQueue(t, 1, WithTransport(transport))
+	defer cleanup()
+
+	// the origin host doesn't resolve, so only the proxy can serve it
+	const origin = "http://origin.invalid/file.zip"
+	path, err := dq.AddSingle(context.Background(), origin)
+	if err != nil {
+		t.Fatalf("AddSingle() error = %v", err)
+	}
+	if proxied != origin {
+		t.Errorf("proxy got the request for %q, want %q", proxied, origin)
+	}
+	if body, err := ioutil.ReadFile(path); err != nil || string(body) != "gapps" {
+		t.Errorf("downloaded file = %q, %v", body, err)
+	}
+}
@@ -0,0 +1,92 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// maxBackoffShift limits the exponential growth of the backoff delay
+const maxBackoffShift = 10
+
+// ErrRetryBudgetExhausted is returned when the operation fails and no retries are left in the budget
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// RetryBudget limits the total number of retries shared by multiple operations
+type RetryBudget struct {
+	tokens int64
+}
+
+// NewRetryBudget creates a new instance of RetryBudget
+func NewRetryBudget(retries int) *RetryBudget {
+	return &RetryBudget{tokens: int64(retries)}
+}
+
+// Take consumes a single retry from the budget and reports if it was available
+func (b *RetryBudget) Take() bool {
+	if b == nil {
+		return false
+	}
+	return atomic.AddInt64(&b.tokens, -1) >= 0
+}
+
+// Left returns the number of retries left in the budget
+func (b *RetryBudget) Left() int {
+	if b == nil {
+		return 0
+	}
+	if left := atomic.LoadInt64(&b.tokens); left > 0 {
+		return int(left)
+	}
+	return 0
+}
+
+// Retry calls fn up to attempts times until it succeeds,
+// consuming a retry from the budget before each repeated call
+func (b *RetryBudget) Retry(attempts int, fn func() error) error {
+	return b.RetryIf(attempts, func(error) bool { return true }, fn)
+}
+
+// RetryIf calls fn the same way as Retry, but only while its error is retryable
+func (b *RetryBudget) RetryIf(attempts int, retryable func(err error) bool, fn func() error) error {
+	err := fn()
+	for i := 1; err != nil && i < attempts && retryable(err); i++ {
+		if !b.Take() {
+			return fmt.Errorf("%w: %v", ErrRetryBudgetExhausted, err)
+		}
+		err = fn()
+	}
+	return err
+}
+
+// backoff returns the exponential delay with jitter before the retry attempt (starting from 1):
+// the base delay is doubled on each attempt, and up to a half of it is added randomly
+func backoff(attempt int, base time.Duration) time.Duration {
+	if base <= 0 || attempt < 1 {
+		return 0
+	}
+	shift := attempt - 1
+	if shift > maxBackoffShift {
+		shift = maxBackoffShift
+	}
+	delay := base << uint(shift)
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// sleep waits for the delay or until ctx is done
+func sleep(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,48 @@
+package net
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRetryBudgetRetryIf(t *testing.T) {
+	errTransient, errPermanent := errors.New("transient"), errors.New("permanent")
+	tests := []struct {
+		name      string
+		budget    int
+		attempts  int
+		errs      []error
+		wantCalls int
+		wantErr   error
+		wantLeft  int
+	}{
+		{"success", 5, 3, nil, 1, nil, 5},
+		{"retried until success", 5, 3, []error{errTransient, errTransient}, 3, nil, 3},
+		{"attempts exhausted", 5, 3, []error{errTransient, errTransient, errTransient, errTransient}, 3, errTransient, 3},
+		{"permanent error", 5, 3, []error{errTransient, errPermanent}, 2, errPermanent, 4},
+		{"budget exhausted", 1, 3, []error{errTransient, errTransient, errTransient}, 2, ErrRetryBudgetExhausted, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewRetryBudget(tt.budget)
+			var calls int
+			err := b.RetryIf(tt.attempts, func(err error) bool { return err != errPermanent }, func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("RetryIf() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("RetryIf() made %d calls, want %d", calls, tt.wantCalls)
+			}
+			if left := b.Left(); left != tt.wantLeft {
+				t.Errorf("Left() = %d, want %d", left, tt.wantLeft)
+			}
+		})
+	}
+}
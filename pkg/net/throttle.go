@@ -0,0 +1,87 @@
+package net
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxThrottleBurst is the max number of bytes read at once by the throttled reader
+const maxThrottleBurst = 32 * 1024
+
+// limiter is the token bucket which limits the download speed.
+// nil limiter doesn't limit anything.
+type limiter struct {
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	mtx    sync.Mutex
+}
+
+// newLimiter creates the limiter for bytesPerSec, or returns nil if it's not positive
+func newLimiter(bytesPerSec int64) *limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := float64(bytesPerSec)
+	if burst > maxThrottleBurst {
+		burst = maxThrottleBurst
+	}
+	return &limiter{rate: float64(bytesPerSec), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait takes n bytes from the bucket, waiting until they are available or ctx is done
+func (l *limiter) wait(ctx context.Context, n int) error {
+	l.mtx.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mtx.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reader returns the reader which doesn't read from r faster than the limiter allows.
+// Reading stops with ctx error if ctx is done while waiting.
+func (l *limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, l: l}
+}
+
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *limiter
+}
+
+func (tr *throttledReader) Read(b []byte) (int, error) {
+	if len(b) > int(tr.l.burst) {
+		b = b[:int(tr.l.burst)]
+	}
+	n, err := tr.r.Read(b)
+	if n > 0 {
+		if waitErr := tr.l.wait(tr.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
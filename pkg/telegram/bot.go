@@ -5,9 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/config"
 	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/storage"
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/version"
 	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
 	"github.com/nezorflame/opengapps-mirror-bot/pkg/net"
 
@@ -18,13 +21,13 @@ import (
 )
 
 const (
-	platformErrText = "does not belong to Platform values"
-	androidErrText  = "does not belong to Android values"
-	variantErrText  = "does not belong to Variant values"
-	dateErrText     = "unable to parse time"
-	mirrorFormat    = "[%s](%s)"
+	mirrorFormat = "[%s](%s)"
+	progressStep = 5 // min progress change in percents to update the message
 )
 
+// errBadDate is returned when the release date in the command can't be parsed
+var errBadDate = errors.New("unable to parse time")
+
 // Bot describes Telegram bot
 type Bot struct {
 	ctx context.Context
@@ -33,6 +36,13 @@ type Bot struct {
 	dq  *net.DownloadQueue
 	gs  *storage.GlobalStorage
 	gh  *github.Client
+
+	// in-flight mirror requests by user and message IDs
+	requests map[int]map[int]context.CancelFunc
+	mtx      sync.Mutex
+
+	latestCache latestCache
+	statsCache  statsCache
 }
 
 // NewBot creates new instance of Bot
@@ -51,7 +61,15 @@ func NewBot(ctx context.Context, cfg *viper.Viper, dq *net.DownloadQueue, gs *st
 	}
 
 	log.Debugf("Authorized on account %s", api.Self.UserName)
-	return &Bot{api: api, cfg: cfg, ctx: ctx, dq: dq, gs: gs, gh: gh}, nil
+	return &Bot{
+		api:      api,
+		cfg:      cfg,
+		ctx:      ctx,
+		dq:       dq,
+		gs:       gs,
+		gh:       gh,
+		requests: make(map[int]map[int]context.CancelFunc),
+	}, nil
 }
 
 // Start starts to listen the bot updates channel
@@ -68,7 +86,11 @@ func (b *Bot) Stop() {
 
 func (b *Bot) listen(updates tgbotapi.UpdatesChannel) {
 	for u := range updates {
-		if u.Message == nil { // ignore any non-Message Updates
+		if u.InlineQuery != nil {
+			go b.inline(u.InlineQuery)
+			continue
+		}
+		if u.Message == nil { // ignore any other non-Message Updates
 			continue
 		}
 
@@ -78,9 +100,36 @@ func (b *Bot) listen(updates tgbotapi.UpdatesChannel) {
 		case strings.HasPrefix(u.Message.Text, b.cfg.GetString("commands.help")):
 			log.WithField("user_id", u.Message.From.ID).Debug("Got help request")
 			go b.help(u.Message)
+		case strings.HasPrefix(u.Message.Text, b.cfg.GetString("commands.version")):
+			log.WithField("user_id", u.Message.From.ID).Debug("Got version request")
+			go b.version(u.Message)
+		case strings.HasPrefix(u.Message.Text, b.cfg.GetString("commands.list")):
+			log.WithField("user_id", u.Message.From.ID).Debug("Got list request")
+			go b.list(u.Message)
+		case strings.HasPrefix(u.Message.Text, b.cfg.GetString("commands.latest")):
+			log.WithField("user_id", u.Message.From.ID).Debug("Got latest request")
+			go b.latest(u.Message)
+		case strings.HasPrefix(u.Message.Text, b.cfg.GetString("commands.stats")):
+			log.WithField("user_id", u.Message.From.ID).Debug("Got stats request")
+			go b.stats(u.Message)
+		case strings.HasPrefix(u.Message.Text, b.cfg.GetString("commands.cancel")):
+			log.WithField("user_id", u.Message.From.ID).Debug("Got cancel request")
+			go b.cancel(u.Message)
+		case strings.HasPrefix(u.Message.Text, b.cfg.GetString("commands.popular")):
+			log.WithField("user_id", u.Message.From.ID).Debug("Got popular request")
+			go b.popular(u.Message)
+		case strings.HasPrefix(u.Message.Text, b.cfg.GetString("commands.release")):
+			log.WithField("user_id", u.Message.From.ID).Debug("Got release mirror request")
+			go b.mirrorRelease(u.Message)
+		case strings.HasPrefix(u.Message.Text, b.cfg.GetString("commands.purge")):
+			log.WithField("user_id", u.Message.From.ID).Debug("Got purge request")
+			go b.purge(u.Message)
+		case strings.HasPrefix(u.Message.Text, b.cfg.GetString("commands.remirror")):
+			log.WithField("user_id", u.Message.From.ID).Debug("Got remirror request")
+			go b.remirror(u.Message)
 		case strings.HasPrefix(u.Message.Text, b.cfg.GetString("commands.mirror")):
 			log.WithField("user_id", u.Message.From.ID).Debug("Got mirror request")
-			go b.mirror(u.Message)
+			go b.mirror(u.Message, false)
 		}
 	}
 }
@@ -89,11 +138,98 @@ func (b *Bot) hello(msg *tgbotapi.Message) {
 	b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.hello"))
 }
 
+// help replies with the valid /mirror command arguments, which are taken right from the gapps enums,
+// followed by the messages.help text
 func (b *Bot) help(msg *tgbotapi.Message) {
-	b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.help"))
+	platforms, androids, variants := validValues()
+	example := b.cfg.GetString("commands.mirror")
+	for _, c := range gapps.ValidCombos() {
+		// the latest Android version with the popular variant makes the best example
+		if c.Platform == gapps.PlatformArm64 && c.Variant == gapps.VariantNano {
+			example = fmt.Sprintf("%s %s %s %s", b.cfg.GetString("commands.mirror"), c.Platform, c.Android.HumanString(), c.Variant)
+		}
+	}
+
+	text := fmt.Sprintf(b.cfg.GetString("messages.help_values"), platforms, androids, variants, example)
+	if help := b.cfg.GetString("messages.help"); help != "" {
+		text += "\n\n" + help
+	}
+	b.reply(msg.Chat.ID, msg.MessageID, text)
+}
+
+// version replies with the bot version, followed by the config overview for the bot admins only
+func (b *Bot) version(msg *tgbotapi.Message) {
+	text := fmt.Sprintf("Version: `%s`", version.Info())
+	if b.isAdmin(msg.From.ID) {
+		text += fmt.Sprintf("\n\n```\n%s```", config.Summary(b.cfg))
+	}
+	b.reply(msg.Chat.ID, msg.MessageID, text)
+}
+
+// cancel cancels all of the user's mirror requests in progress.
+// Shared mirrors are still created while any other user is waiting for them.
+func (b *Bot) cancel(msg *tgbotapi.Message) {
+	b.mtx.Lock()
+	requests := b.requests[msg.From.ID]
+	delete(b.requests, msg.From.ID)
+	b.mtx.Unlock()
+
+	if len(requests) == 0 {
+		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.mirror.no_request"))
+		return
+	}
+	for _, cancel := range requests {
+		cancel()
+	}
+	log.WithField("user_id", msg.From.ID).WithField("count", len(requests)).Info("Cancelled mirror requests")
+	b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.mirror.cancelled"))
 }
 
-func (b *Bot) mirror(msg *tgbotapi.Message) {
+// track registers the user's mirror request, so that it can be cancelled later
+func (b *Bot) track(msg *tgbotapi.Message) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(b.ctx)
+
+	b.mtx.Lock()
+	if b.requests[msg.From.ID] == nil {
+		b.requests[msg.From.ID] = make(map[int]context.CancelFunc)
+	}
+	b.requests[msg.From.ID][msg.MessageID] = cancel
+	b.mtx.Unlock()
+
+	return ctx, func() {
+		cancel()
+		b.mtx.Lock()
+		delete(b.requests[msg.From.ID], msg.MessageID)
+		if len(b.requests[msg.From.ID]) == 0 {
+			delete(b.requests, msg.From.ID)
+		}
+		b.mtx.Unlock()
+	}
+}
+
+// remirror recreates the package mirrors, bypassing the existing ones, for the bot admins only
+func (b *Bot) remirror(msg *tgbotapi.Message) {
+	if !b.isAdmin(msg.From.ID) {
+		log.WithField("user_id", msg.From.ID).Warn("Remirror request from non-admin user")
+		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.forbidden"))
+		return
+	}
+	b.mirror(msg, true)
+}
+
+// isAdmin checks if the user is listed in telegram.admins
+func (b *Bot) isAdmin(userID int) bool {
+	for _, id := range b.cfg.GetIntSlice("telegram.admins") {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// mirror looks up the package and sends its mirrors, creating them if there're none yet.
+// If force is set, the mirrors are recreated even if they already exist.
+func (b *Bot) mirror(msg *tgbotapi.Message, force bool) {
 	// parse the message
 	logger := log.WithField("chat_id", msg.Chat.ID).WithField("msg_id", msg.MessageID)
 	cmd := strings.Replace(msg.Text, ".", "", -1)
@@ -105,15 +241,15 @@ func (b *Bot) mirror(msg *tgbotapi.Message) {
 
 	platform, android, variant, date, err := parseCmd(parts[1:], b.cfg.GetString("gapps.time_format"))
 	if err != nil {
-		errMsg := err.Error()
+		var errMsg string
 		switch {
-		case strings.Contains(errMsg, platformErrText):
+		case errors.Is(err, gapps.ErrBadPlatform):
 			errMsg = b.cfg.GetString("messages.errors.platform")
-		case strings.Contains(errMsg, androidErrText):
+		case errors.Is(err, gapps.ErrBadAndroid):
 			errMsg = b.cfg.GetString("messages.errors.android")
-		case strings.Contains(errMsg, variantErrText):
+		case errors.Is(err, gapps.ErrBadVariant):
 			errMsg = b.cfg.GetString("messages.errors.variant")
-		case strings.Contains(errMsg, dateErrText):
+		case errors.Is(err, errBadDate):
 			errMsg = b.cfg.GetString("messages.errors.date")
 		default:
 			errMsg = b.cfg.GetString("messages.errors.mirror")
@@ -123,60 +259,182 @@ func (b *Bot) mirror(msg *tgbotapi.Message) {
 		return
 	}
 
-	// look up the package storage
+	// check if such package is built at all
+	if err = gapps.CheckCombo(platform, android, variant); err != nil {
+		logger.Debug(err)
+		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.combo"))
+		return
+	}
+	b.gs.CountRequest(platform, android, variant)
+
+	// look up the package storage, then the release packages saved to the DB
 	s, ok := b.gs.Get(date)
+	if !ok {
+		s, ok = b.gs.Restore(date)
+	}
 	if !ok {
 		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.mirror.in_progress"))
 
 		var err error
-		if s, err = storage.GetPackageStorage(b.ctx, b.gh, b.dq, b.cfg, date); err != nil {
-			b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.unknown"))
-			logger.Fatal("No current storage available")
+		if s, _, err = storage.GetPackageStorage(b.ctx, b.gh, b.dq, b.cfg, date); err != nil {
+			if date == storage.CurrentStorageKey {
+				logger.Errorf("No current storage available: %v", err)
+				b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.unknown"))
+				return
+			}
+			logger.Warnf("Unable to get the package storage for %s: %v", date, err)
+			s = nil
+		} else {
+			b.gs.Add(s.Date, s)
 		}
-
-		b.gs.Add(s.Date, s)
 	}
 
-	// look up the package
-	pkg, ok := s.Get(platform, android, variant)
+	// look up the package, or the one from the nearest earlier release if the date has no such build
+	var pkg *storage.Package
+	if s != nil {
+		pkg, ok = s.Get(platform, android, variant)
+		if !ok && !s.HasPlatform(platform) {
+			// the platform is purged or its release was unavailable during the scan
+			if _, err = s.ScanPlatform(b.ctx, b.gh, b.dq, b.cfg, platform); err != nil {
+				logger.Warnf("Unable to scan the %s release for %s: %v", platform, s.Date, err)
+			}
+			pkg, ok = s.Get(platform, android, variant)
+		}
+	}
+	nearest := false
+	if !ok && date != storage.CurrentStorageKey {
+		if s, pkg, ok = b.gs.FindNearest(b.cfg, platform, android, variant, date); ok {
+			logger.Infof("Using the nearest release %s instead of %s", pkg.Date, date)
+			nearest = true
+		}
+	}
 	if !ok {
 		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.mirror.not_found"))
 		return
 	}
 
+	// the package is shared with the concurrent mirrors, so only its copies are read
+	pkg = pkg.Copy()
+
 	// check if we already have mirrors
-	text := ""
-	if pkg.LocalURL == "" && pkg.RemoteURL == "" {
-		text = fmt.Sprintf(b.cfg.GetString("messages.mirror.found"), pkg.Name, pkg.OriginURL, pkg.MD5, b.cfg.GetString("messages.mirror.missing"))
+	text, partial, created := "", false, false
+	if force || !pkg.Mirrored(b.cfg) {
+		create, status := s.GetOrMirror, b.cfg.GetString("messages.mirror.missing")
+		if force {
+			create, status = s.Remirror, b.cfg.GetString("messages.mirror.remirror")
+		}
+		text = fmt.Sprintf(b.cfg.GetString("messages.mirror.found"), pkg.Name, pkg.OriginURL, b.checksum(pkg), status)
 		b.reply(msg.Chat.ID, 0, text)
-		logger.Debugf("Creating a mirror for the package %s", pkg.Name)
-		if err := pkg.CreateMirror(b.dq, b.cfg); err != nil {
+		logger.WithField("force", force).Debugf("Creating a mirror for the package %s", pkg.Name)
+		ctx, done := b.track(msg)
+		var mirrored *storage.Package
+		mirrored, err = create(ctx, platform, android, variant, b.dq, b.cfg, b.progress(msg.Chat.ID))
+		done()
+		if errors.Is(err, context.Canceled) {
+			logger.Infof("Mirror request for the package %s was cancelled", pkg.Name)
+			return
+		}
+		var mirrorErr *storage.MirrorError
+		switch {
+		case errors.As(err, &mirrorErr) && mirrorErr.LocalDone:
+			logger.Warnf("Mirror is created partially: %v", err)
+			partial = true
+		case errors.Is(err, net.ErrChecksumMismatch):
+			logger.Errorf("Package %s doesn't match its checksum: %v", pkg.Name, err)
+			b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.mirror.corrupted"))
+			return
+		case err != nil:
 			logger.Errorf("Unable to create mirror: %v", err)
 			b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.mirror.fail"))
 			return
 		}
-		if err := s.Save(); err != nil {
-			logger.Errorf("Unable to save storage: %v", err)
-		}
-		text = b.cfg.GetString("messages.mirror.ok")
+		text, created, pkg = b.cfg.GetString("messages.mirror.ok"), true, mirrored.Copy()
 	} else {
-		text = fmt.Sprintf(b.cfg.GetString("messages.mirror.found"), pkg.Name, pkg.OriginURL, pkg.MD5, b.cfg.GetString("messages.mirror.ok"))
+		text = fmt.Sprintf(b.cfg.GetString("messages.mirror.found"), pkg.Name, pkg.OriginURL, b.checksum(pkg), b.cfg.GetString("messages.mirror.ok"))
 	}
 
 	logger.Debugf("Got the mirror for the package %s", pkg.Name)
-	mirrorResult := ""
-	if pkg.LocalURL != "" {
-		mirrorResult = fmt.Sprintf(mirrorFormat, b.cfg.GetString("gapps.local_host"), pkg.LocalURL)
+	var mirrors []string
+	for _, link := range pkg.Links(b.cfg) {
+		if link.Kind != storage.LinkOrigin {
+			mirrors = append(mirrors, fmt.Sprintf(mirrorFormat, link.Label, link.URL))
+		}
+	}
+	mirrorResult := strings.Join(mirrors, " | ")
+
+	text = fmt.Sprintf(text, mirrorResult)
+	if stats := pkg.Stats; created && stats.Duration() > 0 {
+		text += " " + fmt.Sprintf(b.cfg.GetString("messages.mirror.stats"), stats.Duration().Round(time.Second), storage.HumanBytes(stats.Speed()))
+	}
+	if nearest {
+		text += "\n\n" + fmt.Sprintf(b.cfg.GetString("messages.mirror.nearest"), date, pkg.Date)
+	}
+	if partial {
+		text += "\n\n" + b.cfg.GetString("messages.mirror.partial")
+	}
+	if pkg.Unverified {
+		text += "\n\n" + b.cfg.GetString("messages.mirror.unverified")
+	}
+
+	b.reply(msg.Chat.ID, msg.MessageID, text)
+	logger.WithField("release", pkg.Release).WithField("suffix", pkg.Suffix).Infof("Sent mirror for pkg %s", pkg.Name)
+
+	if b.cfg.GetBool("telegram.qr_code") {
+		b.sendQRCode(msg.Chat.ID, pkg)
 	}
-	if pkg.RemoteURL != "" {
-		if mirrorResult != "" {
-			mirrorResult += " | "
+}
+
+// progress returns the ProgressFunc which reports the download progress
+// in a single message, editing it in place
+func (b *Bot) progress(chatID int64) net.ProgressFunc {
+	msgID, last := 0, 0
+	return func(done, total int64) {
+		if total <= 0 {
+			return
+		}
+		percent := int(done * 100 / total)
+		if msgID != 0 && percent-last < progressStep {
+			return
+		}
+		last = percent
+
+		text := fmt.Sprintf(b.cfg.GetString("messages.mirror.progress"), percent)
+		if msgID == 0 {
+			msg, err := b.api.Send(tgbotapi.NewMessage(chatID, text))
+			if err != nil {
+				log.Errorf("Unable to send the progress message: %v", err)
+				return
+			}
+			msgID = msg.MessageID
+			return
+		}
+		if _, err := b.api.Send(tgbotapi.NewEditMessageText(chatID, msgID, text)); err != nil {
+			log.Errorf("Unable to update the progress message: %v", err)
 		}
-		mirrorResult += fmt.Sprintf(mirrorFormat, b.cfg.GetString("gapps.remote_host"), pkg.RemoteURL)
 	}
+}
 
-	b.reply(msg.Chat.ID, msg.MessageID, fmt.Sprintf(text, mirrorResult))
-	logger.Infof("Sent mirror for pkg %s", pkg.Name)
+// checksum returns the package MD5 checksum, or the note that it's checked on mirroring
+// if the MD5 file is not downloaded yet
+func (b *Bot) checksum(p *storage.Package) string {
+	if p.MD5 == "" {
+		return b.cfg.GetString("messages.mirror.md5_pending")
+	}
+	return p.MD5
+}
+
+func (b *Bot) sendQRCode(chatID int64, pkg *storage.Package) {
+	png, err := pkg.QRCode()
+	if err != nil {
+		log.Errorf("Unable to create QR code: %v", err)
+		return
+	}
+
+	photo := tgbotapi.NewPhotoUpload(chatID, tgbotapi.FileBytes{Name: pkg.Name + ".png", Bytes: png})
+	photo.Caption = pkg.Name
+	if _, err = b.api.Send(photo); err != nil {
+		log.Errorf("Unable to send the QR code: %v", err)
+	}
 }
 
 func (b *Bot) reply(chatID int64, msgID int, text string) {
@@ -198,7 +456,7 @@ func parseCmd(parts []string, timeFormat string) (platform gapps.Platform, andro
 	switch len(parts) {
 	case 4:
 		if _, err = time.Parse(timeFormat, parts[3]); err != nil {
-			err = fmt.Errorf("%s: %w", dateErrText, err)
+			err = fmt.Errorf("%w: %v", errBadDate, err)
 			return
 		}
 		date = parts[3]
@@ -0,0 +1,79 @@
+package telegram
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/storage"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	inlinePageSize  = 50 // max number of results allowed by Telegram
+	inlineCacheTime = 60 // seconds
+)
+
+// inline answers the inline query, like "@bot arm64 10.0 nano", with the matching current packages.
+// Query is parsed the same way as the /list filters, so the partial ones return all the suggestions.
+func (b *Bot) inline(q *tgbotapi.InlineQuery) {
+	logger := log.WithField("user_id", q.From.ID).WithField("query", q.Query)
+	answer := tgbotapi.InlineConfig{InlineQueryID: q.ID, CacheTime: inlineCacheTime, Results: []interface{}{}}
+
+	// results are paged with the query offset, so the page filter is ignored
+	filter, err := parseListCmd(strings.Fields(q.Query))
+	if err != nil {
+		logger.Debugf("Unable to parse inline query: %v", err)
+		b.answer(answer)
+		return
+	}
+
+	packages, ok := b.findPackages(filter)
+	if !ok {
+		logger.Error("Unable to answer inline query: no current storage")
+		b.answer(answer)
+		return
+	}
+
+	// Telegram passes the offset back to get the next page
+	offset, _ := strconv.Atoi(q.Offset)
+	if offset < 0 || offset > len(packages) {
+		offset = 0
+	}
+	end := offset + inlinePageSize
+	if end < len(packages) {
+		answer.NextOffset = strconv.Itoa(end)
+	} else {
+		end = len(packages)
+	}
+
+	for _, p := range packages[offset:end] {
+		p = p.Copy()
+		article := tgbotapi.NewInlineQueryResultArticleMarkdown(p.Name, p.Name, b.packageText(p))
+		article.Description = fmt.Sprintf("%s %s %s, %s, %s", p.Platform, p.Android.HumanString(), p.Variant, p.HumanSize(), p.Date)
+		answer.Results = append(answer.Results, article)
+	}
+	b.answer(answer)
+}
+
+// packageText returns the package info with all of its download links
+func (b *Bot) packageText(p *storage.Package) string {
+	links := p.Links(b.cfg)
+	sources := make([]string, 0, len(links))
+	for _, link := range links {
+		sources = append(sources, fmt.Sprintf(mirrorFormat, link.Label, link.URL))
+	}
+	release := p.Release
+	if release == "" {
+		release = p.Date
+	}
+	return fmt.Sprintf(b.cfg.GetString("messages.inline.package"), p.Name, release, p.HumanSize(), b.checksum(p), strings.Join(sources, " | "))
+}
+
+func (b *Bot) answer(answer tgbotapi.InlineConfig) {
+	if _, err := b.api.Request(answer); err != nil {
+		log.Errorf("Unable to answer inline query: %v", err)
+	}
+}
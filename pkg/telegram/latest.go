@@ -0,0 +1,84 @@
+package telegram
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/storage"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// latestCacheTTL is how long the latest release dates are reused between the /latest requests
+const latestCacheTTL = time.Minute
+
+// latestCache keeps the latest release dates for a while, so that
+// a bunch of simultaneous /latest requests make a single Github lookup
+type latestCache struct {
+	dates     map[gapps.Platform]string
+	fetchedAt time.Time
+	mtx       sync.Mutex
+}
+
+func (b *Bot) latest(msg *tgbotapi.Message) {
+	dates, err := b.latestDates()
+	if err != nil {
+		log.Errorf("Unable to get the latest release dates: %v", err)
+		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.unknown"))
+		return
+	}
+
+	platforms := make([]gapps.Platform, 0, len(dates))
+	for platform := range dates {
+		platforms = append(platforms, platform)
+	}
+	sort.Slice(platforms, func(i, j int) bool { return platforms[i] < platforms[j] })
+
+	same := true
+	for _, platform := range platforms {
+		same = same && dates[platform] == dates[platforms[0]]
+	}
+	if same && len(platforms) == len(gapps.PlatformValues()) {
+		b.reply(msg.Chat.ID, msg.MessageID, fmt.Sprintf(b.cfg.GetString("messages.latest.all"), dates[platforms[0]]))
+		return
+	}
+
+	// show the platforms with the newest releases first
+	timeFormat := b.cfg.GetString("gapps.time_format")
+	sort.SliceStable(platforms, func(i, j int) bool {
+		ti, errI := time.Parse(timeFormat, dates[platforms[i]])
+		tj, errJ := time.Parse(timeFormat, dates[platforms[j]])
+		if errI != nil || errJ != nil {
+			return errJ != nil && errI == nil
+		}
+		return ti.After(tj)
+	})
+
+	var sb strings.Builder
+	for _, platform := range platforms {
+		fmt.Fprintf(&sb, "`%s`: %s\n", platform, dates[platform])
+	}
+	b.reply(msg.Chat.ID, msg.MessageID, fmt.Sprintf(b.cfg.GetString("messages.latest.platforms"), sb.String()))
+}
+
+// latestDates returns the cached latest release dates, or gets them from Github if the cache is expired
+func (b *Bot) latestDates() (map[gapps.Platform]string, error) {
+	b.latestCache.mtx.Lock()
+	defer b.latestCache.mtx.Unlock()
+
+	if b.latestCache.dates != nil && time.Since(b.latestCache.fetchedAt) < latestCacheTTL {
+		return b.latestCache.dates, nil
+	}
+
+	dates, err := storage.GetLatestReleaseDates(b.ctx, b.gh, b.cfg)
+	if err != nil {
+		return nil, err
+	}
+	b.latestCache.dates, b.latestCache.fetchedAt = dates, time.Now()
+	return dates, nil
+}
@@ -0,0 +1,226 @@
+package telegram
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/storage"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const listPageSize = 20
+
+// listFilter describes the optional /list command filters
+type listFilter struct {
+	platform *gapps.Platform
+	android  *gapps.Android
+	// minAndroid is the oldest Android version, set like "9.0+" or "10+"
+	minAndroid *gapps.Android
+	variant    *gapps.Variant
+	page       int
+}
+
+func (f listFilter) match(p *storage.Package) bool {
+	return (f.platform == nil || *f.platform == p.Platform) &&
+		(f.android == nil || *f.android == p.Android) &&
+		(f.minAndroid == nil || !p.Android.Less(*f.minAndroid)) &&
+		(f.variant == nil || *f.variant == p.Variant)
+}
+
+func (b *Bot) list(msg *tgbotapi.Message) {
+	filter, err := parseListCmd(strings.Fields(msg.Text)[1:])
+	if err != nil {
+		platforms, androids, variants := validValues()
+		b.reply(msg.Chat.ID, msg.MessageID, fmt.Sprintf(b.cfg.GetString("messages.errors.filter"), err, platforms, androids, variants))
+		return
+	}
+
+	packages, ok := b.findPackages(filter)
+	if !ok {
+		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.unknown"))
+		return
+	}
+	if len(packages) == 0 {
+		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.list.empty"))
+		return
+	}
+
+	pages := (len(packages) + listPageSize - 1) / listPageSize
+	if filter.page > pages {
+		filter.page = pages
+	}
+	start := (filter.page - 1) * listPageSize
+	end := start + listPageSize
+	if end > len(packages) {
+		end = len(packages)
+	}
+
+	var sb strings.Builder
+	for _, p := range packages[start:end] {
+		fmt.Fprintf(&sb, "`%s` %s %s %s, %s, %s\n", p.Name, p.Platform, p.Android.HumanString(), p.Variant, p.HumanSize(), p.Date)
+	}
+	if pages > 1 {
+		fmt.Fprintf(&sb, "\n"+b.cfg.GetString("messages.list.page"), filter.page, pages)
+	}
+	b.reply(msg.Chat.ID, msg.MessageID, sb.String())
+}
+
+// findPackages returns the current packages matching the filter, sorted by platform, Android version and variant.
+// It reports false if there's no current storage.
+func (b *Bot) findPackages(filter listFilter) ([]*storage.Package, bool) {
+	s, ok := b.gs.Get(storage.CurrentStorageKey)
+	if !ok {
+		return nil, false
+	}
+
+	var packages []*storage.Package
+	for _, p := range s.List() {
+		if filter.match(p) {
+			packages = append(packages, p)
+		}
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		pi, pj := packages[i], packages[j]
+		if pi.Platform != pj.Platform {
+			return pi.Platform < pj.Platform
+		}
+		if pi.Android != pj.Android {
+			return pi.Android.Less(pj.Android)
+		}
+		return pi.Variant < pj.Variant
+	})
+	return packages, true
+}
+
+// parseListCmd parses the /list command filters. Each of them is optional
+// and can be set with a flag, like "--android 9.0", or just by its value.
+// Page number is set with the "--page" flag.
+func parseListCmd(args []string) (filter listFilter, err error) {
+	filter.page = 1
+	for i := 0; i < len(args); i++ {
+		flag, value := "", args[i]
+		if strings.HasPrefix(value, "--") {
+			flag = strings.TrimPrefix(value, "--")
+			if i+1 >= len(args) {
+				return filter, fmt.Errorf("no value for the filter %s", value)
+			}
+			i++
+			value = args[i]
+		}
+		if err = filter.set(flag, value); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// set sets the filter by its name, or by the value itself if the name is empty
+func (f *listFilter) set(name, value string) error {
+	switch name {
+	case "page":
+		page, err := strconv.Atoi(value)
+		if err != nil || page < 1 {
+			return fmt.Errorf("bad page number %s", value)
+		}
+		f.page = page
+		return nil
+	case "platform", "android", "variant", "":
+	default:
+		return fmt.Errorf("unknown filter %s", name)
+	}
+
+	if name == "platform" || name == "" {
+		if p, err := gapps.PlatformString(value); err == nil {
+			f.platform = &p
+			return nil
+		}
+	}
+	if name == "android" || name == "" {
+		if strings.HasSuffix(value, "+") {
+			if a, ok := minAndroid(strings.TrimSuffix(value, "+")); ok {
+				f.minAndroid = &a
+				return nil
+			}
+		}
+		if a, err := gapps.AndroidString(strings.Replace(value, ".", "", -1)); err == nil {
+			f.android = &a
+			return nil
+		}
+	}
+	if name == "variant" || name == "" {
+		if v, err := gapps.VariantString(value); err == nil {
+			f.variant = &v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown filter value %s", value)
+}
+
+// minAndroid returns the oldest known Android version which is not older than the value.
+// The value is either the full version, like "9.0", or just the major one, like "10".
+func minAndroid(value string) (gapps.Android, bool) {
+	major, minor := 0, 0
+	parts := strings.Split(value, ".")
+	var err error
+	if major, err = strconv.Atoi(parts[0]); err != nil || len(parts) > 2 {
+		return 0, false
+	}
+	if len(parts) == 2 {
+		if minor, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, false
+		}
+	}
+
+	var (
+		result gapps.Android
+		found  bool
+	)
+	for _, a := range gapps.AndroidValues() {
+		aMajor, aMinor := a.Version()
+		if aMajor < major || aMajor == major && aMinor < minor {
+			continue
+		}
+		if !found || a.Less(result) {
+			result, found = a, true
+		}
+	}
+	return result, found
+}
+
+// validValues returns the lists of the valid platforms, Android versions and variants.
+// Platforms are sorted alphabetically, Android versions are sorted numerically
+// and grouped by the major version.
+func validValues() (platforms, androids, variants string) {
+	var p, v []string
+	for _, value := range gapps.PlatformValues() {
+		p = append(p, value.String())
+	}
+	sort.Strings(p)
+
+	androidValues := append([]gapps.Android(nil), gapps.AndroidValues()...)
+	sort.Slice(androidValues, func(i, j int) bool { return androidValues[i].Less(androidValues[j]) })
+	var (
+		groups    [][]string
+		prevMajor = -1
+	)
+	for _, value := range androidValues {
+		if major, _ := value.Version(); major != prevMajor {
+			groups = append(groups, nil)
+			prevMajor = major
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], value.HumanString())
+	}
+	a := make([]string, len(groups))
+	for i := range groups {
+		a[i] = strings.Join(groups[i], "`, `")
+	}
+
+	for _, value := range gapps.VariantValues() {
+		v = append(v, value.String())
+	}
+	return "`" + strings.Join(p, "`|`") + "`", "`" + strings.Join(a, "` | `") + "`", "`" + strings.Join(v, "`|`") + "`"
+}
@@ -0,0 +1,51 @@
+package telegram
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultPopularLimit is how many package combinations /popular reports without the argument
+const defaultPopularLimit = 10
+
+// popular reports the most requested package combinations, for the bot admins only.
+// The optional argument is the number of combinations to report.
+func (b *Bot) popular(msg *tgbotapi.Message) {
+	logger := log.WithField("user_id", msg.From.ID)
+	if !b.isAdmin(msg.From.ID) {
+		logger.Warn("Popular request from non-admin user")
+		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.forbidden"))
+		return
+	}
+
+	limit := defaultPopularLimit
+	if args := strings.Fields(msg.Text)[1:]; len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.popular"))
+			return
+		}
+		limit = n
+	}
+
+	counts, err := b.gs.PopularRequests(limit)
+	if err != nil {
+		logger.Errorf("Unable to get the popular requests: %v", err)
+		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.unknown"))
+		return
+	}
+	if len(counts) == 0 {
+		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.popular.empty"))
+		return
+	}
+
+	var sb strings.Builder
+	for i, c := range counts {
+		fmt.Fprintf(&sb, "%d. `%s`: %d\n", i+1, c.Descriptor(), c.Count)
+	}
+	b.reply(msg.Chat.ID, msg.MessageID, fmt.Sprintf(b.cfg.GetString("messages.popular.list"), sb.String()))
+}
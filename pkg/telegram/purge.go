@@ -0,0 +1,68 @@
+package telegram
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const purgeConfirm = "confirm"
+
+// purge removes the cached packages, optionally only of the platform, for the bot admins only.
+// Without the confirmation it only reports how many packages are to be removed.
+func (b *Bot) purge(msg *tgbotapi.Message) {
+	logger := log.WithField("user_id", msg.From.ID)
+	if !b.isAdmin(msg.From.ID) {
+		logger.Warn("Purge request from non-admin user")
+		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.forbidden"))
+		return
+	}
+
+	var (
+		platform *gapps.Platform
+		confirm  bool
+	)
+	for _, arg := range strings.Fields(msg.Text)[1:] {
+		if arg == purgeConfirm {
+			confirm = true
+			continue
+		}
+		p, err := gapps.PlatformString(arg)
+		if err != nil {
+			b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.platform"))
+			return
+		}
+		platform = &p
+	}
+
+	target, command := "all", b.cfg.GetString("commands.purge")
+	if platform != nil {
+		target = platform.String()
+		command += " " + target
+	}
+	if !confirm {
+		command += " " + purgeConfirm
+		b.reply(msg.Chat.ID, msg.MessageID, fmt.Sprintf(b.cfg.GetString("messages.purge.confirm"), b.gs.PackageCount(platform), target, command))
+		return
+	}
+
+	count, err := b.gs.Purge(platform)
+	if err != nil {
+		logger.Errorf("Unable to purge the storage: %v", err)
+		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.unknown"))
+		return
+	}
+	logger.WithField("platform", target).WithField("count", count).Info("Storage purged")
+	b.reply(msg.Chat.ID, msg.MessageID, fmt.Sprintf(b.cfg.GetString("messages.purge.done"), count, target))
+
+	// fetch the current release again right away, so that the lookups don't wait for it
+	if platform == nil {
+		if err = b.gs.AddLatestStorage(b.ctx, b.gh, b.dq, b.cfg); err != nil {
+			logger.Errorf("Unable to add the latest storage: %v", err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package telegram
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/storage"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	releaseLatest = "latest"
+	// releaseProgressPeriod is the min period between the release mirroring progress updates,
+	// so that the quickly processed packages don't hit the Telegram rate limits
+	releaseProgressPeriod = 5 * time.Second
+)
+
+// mirrorRelease creates the mirrors for all the packages of the release, for the bot admins only.
+// The argument is the release date or "latest", which is the default. The progress is posted
+// while the packages are mirrored, and the request can be cancelled like the other mirrors.
+func (b *Bot) mirrorRelease(msg *tgbotapi.Message) {
+	logger := log.WithField("user_id", msg.From.ID)
+	if !b.isAdmin(msg.From.ID) {
+		logger.Warn("Release mirror request from non-admin user")
+		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.forbidden"))
+		return
+	}
+
+	date := storage.CurrentStorageKey
+	if args := strings.Fields(msg.Text)[1:]; len(args) > 0 && args[0] != releaseLatest {
+		if _, err := time.Parse(b.cfg.GetString("gapps.time_format"), args[0]); err != nil {
+			b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.date"))
+			return
+		}
+		date = args[0]
+	}
+	logger = logger.WithField("release_date", date)
+
+	s, ok := b.gs.Get(date)
+	if !ok {
+		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.mirror.in_progress"))
+
+		var err error
+		if s, _, err = storage.GetPackageStorage(b.ctx, b.gh, b.dq, b.cfg, date); err != nil {
+			logger.Errorf("Unable to get the package storage: %v", err)
+			b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.mirror.not_found"))
+			return
+		}
+		b.gs.Add(s.Date, s)
+	}
+
+	packages := s.List()
+	logger.WithField("count", len(packages)).Info("Mirroring the release")
+	b.reply(msg.Chat.ID, msg.MessageID, fmt.Sprintf(b.cfg.GetString("messages.release.started"), len(packages), s.Date))
+
+	ctx, done := b.track(msg)
+	summary := s.MirrorPackages(ctx, packages, b.dq, b.cfg, b.releaseProgress(msg.Chat.ID, len(packages)))
+	cancelled := ctx.Err() != nil
+	done()
+
+	logger.WithField("created", summary.Created).WithField("existing", summary.Existing).
+		WithField("failed", summary.Failed).WithField("cancelled", cancelled).Info("Release mirrored")
+	text := fmt.Sprintf(b.cfg.GetString("messages.release.done"), s.Date, summary.Created, summary.Existing, summary.Failed)
+	if skipped := len(packages) - summary.Done(); skipped > 0 {
+		text += "\n" + fmt.Sprintf(b.cfg.GetString("messages.release.cancelled"), skipped)
+	}
+	b.reply(msg.Chat.ID, msg.MessageID, text)
+}
+
+// releaseProgress returns the function which posts the release mirroring progress
+// and then updates the same message, at most once per releaseProgressPeriod
+func (b *Bot) releaseProgress(chatID int64, total int) func(storage.MirrorSummary) {
+	var (
+		msgID   int
+		updated time.Time
+	)
+	return func(summary storage.MirrorSummary) {
+		if time.Since(updated) < releaseProgressPeriod {
+			return
+		}
+		updated = time.Now()
+
+		text := fmt.Sprintf(b.cfg.GetString("messages.release.progress"), summary.Done(), total, summary.Failed)
+		// the estimate appears once the first bytes or packages are mirrored
+		switch eta := summary.ETA.Round(time.Second); {
+		case eta <= 0:
+		case summary.BytesTotal > 0:
+			text += "\n" + fmt.Sprintf(b.cfg.GetString("messages.release.eta_bytes"),
+				storage.HumanBytes(summary.BytesDone), storage.HumanBytes(summary.BytesTotal), eta)
+		default:
+			text += "\n" + fmt.Sprintf(b.cfg.GetString("messages.release.eta"), eta)
+		}
+		if msgID == 0 {
+			msg, err := b.api.Send(tgbotapi.NewMessage(chatID, text))
+			if err != nil {
+				log.Errorf("Unable to send the progress message: %v", err)
+				return
+			}
+			msgID = msg.MessageID
+			return
+		}
+		if _, err := b.api.Send(tgbotapi.NewEditMessageText(chatID, msgID, text)); err != nil {
+			log.Errorf("Unable to update the progress message: %v", err)
+		}
+	}
+}
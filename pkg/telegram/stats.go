@@ -0,0 +1,76 @@
+package telegram
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nezorflame/opengapps-mirror-bot/internal/pkg/storage"
+	"github.com/nezorflame/opengapps-mirror-bot/pkg/gapps"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// statsCacheTTL is how long the local storage stats are reused between the /stats requests
+const statsCacheTTL = time.Minute
+
+// statsCache keeps the local storage stats for a while, so that
+// the local storage is not walked on each /stats request
+type statsCache struct {
+	text      string
+	fetchedAt time.Time
+	mtx       sync.Mutex
+}
+
+func (b *Bot) stats(msg *tgbotapi.Message) {
+	text, err := b.statsText()
+	if err != nil {
+		log.Errorf("Unable to get the storage stats: %v", err)
+		b.reply(msg.Chat.ID, msg.MessageID, b.cfg.GetString("messages.errors.unknown"))
+		return
+	}
+	b.reply(msg.Chat.ID, msg.MessageID, text)
+}
+
+// statsText returns the cached stats message, or collects the stats again if the cache is expired
+func (b *Bot) statsText() (string, error) {
+	b.statsCache.mtx.Lock()
+	defer b.statsCache.mtx.Unlock()
+
+	if b.statsCache.text != "" && time.Since(b.statsCache.fetchedAt) < statsCacheTTL {
+		return b.statsCache.text, nil
+	}
+
+	usage, err := storage.DiskStatsByPlatform(b.cfg)
+	if err != nil {
+		return "", fmt.Errorf("unable to get disk usage: %w", err)
+	}
+	releases, packages, err := b.gs.Counts()
+	if err != nil {
+		return "", err
+	}
+
+	platforms := make([]gapps.Platform, 0, len(usage))
+	for platform := range usage {
+		platforms = append(platforms, platform)
+	}
+	sort.Slice(platforms, func(i, j int) bool { return platforms[i].String() < platforms[j].String() })
+
+	var (
+		total storage.DiskUsage
+		sb    strings.Builder
+	)
+	for _, platform := range platforms {
+		u := usage[platform]
+		total.Files += u.Files
+		total.Bytes += u.Bytes
+		fmt.Fprintf(&sb, "`%s`: %d files, %s\n", platform, u.Files, storage.HumanBytes(u.Bytes))
+	}
+
+	text := fmt.Sprintf(b.cfg.GetString("messages.stats"), total.Files, storage.HumanBytes(total.Bytes), sb.String(), releases, packages)
+	b.statsCache.text, b.statsCache.fetchedAt = text, time.Now()
+	return text, nil
+}